@@ -0,0 +1,410 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/pubsubapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+)
+
+/*
+ * The pubsub service tells Smartthings about devices that are added to or
+ * removed from a tenant's homes, so that they appear without the user having
+ * to run discovery in the app.  Google sends relation updates when it notices
+ * a change, and each tenant's devices are also compared with the devices
+ * Google reports every so often, in case a relation update was missed.
+ *
+ * Looking up devices needs the user's Google access token, which only the web
+ * service receives, so the latest token that it recorded for the tenant is
+ * used while it is fresh enough.
+ */
+
+// Settings that control how added and removed devices are discovered
+type discoveryOptions struct {
+	builder   *discovery.Builder
+	filters   discovery.Filters
+	sdmClient sdmapi.SmartDeviceManagement
+
+	// The mapping of each device, for the states sent to Smartthings
+	mappings *deviceMappings
+
+	// The temperature scale of each device, learned when it is fetched
+	scales *deviceScales
+
+	// How long after the web service saw it a Google access token is used
+	googleTokenMaxAge time.Duration
+
+	// How often to compare each tenant's devices with Google, zero to only
+	// act on relation updates
+	reconcileInterval time.Duration
+}
+
+// Events don't say what type of device they are for, which choosing its
+// mapping needs, so the mapping of each device is remembered from the last
+// time the device was fetched.  This is the mapping that applies to the device
+// now, which is the one it was discovered with unless the mappings changed.
+type deviceMappings struct {
+	mu       sync.Mutex
+	mappings map[string]*discovery.Mapping
+}
+
+func newDeviceMappings() *deviceMappings {
+	return &deviceMappings{
+		mappings: make(map[string]*discovery.Mapping),
+	}
+}
+
+// Remember the mapping of a device, or that none applies to it
+func (d *deviceMappings) update(b *discovery.Builder, nestDevice sdmapi.Device) *discovery.Mapping {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var mapping *discovery.Mapping
+	if m, ok := b.Mapping(nestDevice); ok {
+		mapping = &m
+	}
+
+	d.mappings[nestDevice.ID] = mapping
+	return mapping
+}
+
+// Return the mapping of a device, nil if none applies, or false if the
+// device hasn't been seen
+func (d *deviceMappings) get(deviceID string) (*discovery.Mapping, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m, ok := d.mappings[deviceID]
+	return m, ok
+}
+
+func (d *deviceMappings) forget(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.mappings, deviceID)
+}
+
+// Remember what publishing the states of a device needs to know about it,
+// returning its mapping
+func rememberDevice(opts *discoveryOptions, nestDevice sdmapi.Device) *discovery.Mapping {
+	if opts.scales != nil {
+		opts.scales.learn(nestDevice)
+	}
+
+	return opts.mappings.update(opts.builder, nestDevice)
+}
+
+// Forget a device that no longer belongs to a tenant
+func forgetDevice(opts *discoveryOptions, deviceID string) {
+	if opts.scales != nil {
+		opts.scales.forget(deviceID)
+	}
+
+	opts.mappings.forget(deviceID)
+}
+
+// Return the mapping of a device of a tenant, fetching the device if it
+// hasn't been seen.  Returns nil if no mapping applies or the device can't be
+// fetched, in which case its states aren't filtered and its temperatures are
+// in Celsius unless an event includes its settings.
+func deviceMapping(tenants *stoauth.Tenants, opts *discoveryOptions, tenantID string, deviceID string) *discovery.Mapping {
+	if m, ok := opts.mappings.get(deviceID); ok {
+		return m
+	}
+
+	c, ok := tenantSdmClient(tenants, opts, tenantID)
+	if !ok {
+		logging.Logger(nil).Debugf("no recent Google access token for tenant %s, not filtering the states of device %s", tenantID, deviceID)
+		return nil
+	}
+
+	nestDevice, err := c.GetDevice(deviceID)
+	if err != nil {
+		logging.Logger(nil).WithError(err).Warnf("fetching device %s, not filtering its states", deviceID)
+		return nil
+	}
+
+	return rememberDevice(opts, *nestDevice)
+}
+
+func newDiscoveryCallback() models.DiscoveryCallback {
+	stSchema := "st-schema"
+	stVersion := "1.0"
+	requestID := uuid.New().String()
+	tokenType := "Bearer"
+
+	return models.DiscoveryCallback{
+		Headers: &models.Headers{
+			Schema:          &stSchema,
+			Version:         &stVersion,
+			RequestID:       &requestID,
+			InteractionType: models.InteractionTypeDiscoveryCallback,
+		},
+		Authentication: &models.Authentication{TokenType: &tokenType},
+	}
+}
+
+func executeDiscoveryCallback(tokens *stoauth.TokenManager, tenantID string, devices []*models.Device) error {
+	token, callbackURL, err := tokens.AccessToken(tenantID)
+	if err != nil {
+		return errors.Wrap(err, "fetching access token for discovery callback")
+	}
+
+	req := newDiscoveryCallback()
+	req.Devices = devices
+	req.Authentication.Token = &token
+
+	return postCallback(callbackURL, req, "discovery")
+}
+
+// Devices are removed from Smartthings by a state callback with a
+// DEVICE-DELETED error
+func executeDeviceDeletedCallback(tokens *stoauth.TokenManager, tenantID string, deviceIDs []string) error {
+	token, callbackURL, err := tokens.AccessToken(tenantID)
+	if err != nil {
+		return errors.Wrap(err, "fetching access token for device deleted callback")
+	}
+
+	req := newDeviceStateCallback()
+	req.Authentication.Token = &token
+
+	for _, deviceID := range deviceIDs {
+		errEnum := "DEVICE-DELETED"
+		req.DeviceState = append(req.DeviceState, &models.DeviceState{
+			ExternalDeviceID: deviceID,
+			States:           []*models.DeviceStateStatesItems0{},
+			DeviceError: []*models.DeviceStateDeviceErrorItems0{{
+				Detail:    "device removed from Google Nest",
+				ErrorEnum: &errEnum,
+			}},
+		})
+	}
+
+	return postCallback(callbackURL, req, "device deleted")
+}
+
+// Return an SDM client that uses the Google access token recorded for a
+// tenant, if it is fresh enough
+func tenantSdmClient(tenants *stoauth.Tenants, opts *discoveryOptions, tenantID string) (sdmapi.SmartDeviceManagement, bool) {
+	tenant, ok := tenants.Get(tenantID)
+	if !ok || tenant.GoogleToken == "" || time.Since(tenant.GoogleTokenSeen) > opts.googleTokenMaxAge {
+		return nil, false
+	}
+
+	return opts.sdmClient.WithAccessToken(tenant.GoogleToken), true
+}
+
+// Load the names of a tenant's homes, or nil if they can't be loaded, in
+// which case devices are discovered without them
+func loadHomes(c sdmapi.SmartDeviceManagement) *discovery.Homes {
+	homes, err := discovery.LoadHomes(c)
+	if err != nil {
+		logging.Logger(nil).WithError(err).Warn("fetching the names of homes")
+		return nil
+	}
+
+	return homes
+}
+
+// A device was added to, removed from or moved within a tenant's home
+func handleRelationUpdate(tenants *stoauth.Tenants, tokens *stoauth.TokenManager, opts *discoveryOptions, tenantID string, event pubsubapi.SdmEvent) error {
+	logging.Logger(nil).Infof("relation update for tenant %s: device %s %s %s", tenantID, event.DeviceID, event.Relation.Type, event.Relation.Subject)
+
+	tenant, ok := tenants.Get(tenantID)
+	if !ok {
+		return errors.Errorf("no such tenant: %s", tenantID)
+	}
+	bridged := contains(tenant.DeviceIDs, event.DeviceID) && !tenant.Excludes(event.DeviceID)
+
+	// Removed from the home, rather than from a room
+	if event.Relation.Type == pubsubapi.RelationDeleted && !strings.Contains(event.Relation.Subject, "/rooms/") {
+		forgetDevice(opts, event.DeviceID)
+		if bridged {
+			if err := executeDeviceDeletedCallback(tokens, tenantID, []string{event.DeviceID}); err != nil {
+				return err
+			}
+		}
+
+		return tenants.RemoveDevice(tenantID, event.DeviceID)
+	}
+
+	c, ok := tenantSdmClient(tenants, opts, tenantID)
+	if !ok {
+		logging.Logger(nil).Infof("no recent Google access token for tenant %s, device %s will be discovered later", tenantID, event.DeviceID)
+		return nil
+	}
+
+	nestDevice, err := c.GetDevice(event.DeviceID)
+	if err != nil {
+		logging.Logger(nil).WithError(err).Warnf("fetching device %s, it will be discovered later", event.DeviceID)
+		return nil
+	}
+	rememberDevice(opts, *nestDevice)
+
+	homes := loadHomes(c)
+
+	// The device may have moved into or out of a structure or room that is
+	// filtered
+	if !opts.filters.Allows(tenantID, *nestDevice, homes) {
+		logging.Logger(nil).Infof("device %s of tenant %s is excluded by the device filters", event.DeviceID, tenantID)
+		if bridged {
+			if err := executeDeviceDeletedCallback(tokens, tenantID, []string{event.DeviceID}); err != nil {
+				return err
+			}
+		}
+
+		return tenants.AddDevice(tenantID, event.DeviceID, true)
+	}
+
+	if stDevice, ok := opts.builder.Device(*nestDevice, homes); ok {
+		if err := executeDiscoveryCallback(tokens, tenantID, []*models.Device{stDevice}); err != nil {
+			return err
+		}
+	}
+
+	return tenants.AddDevice(tenantID, event.DeviceID, false)
+}
+
+// Compare the devices of a tenant with the devices Google reports
+func reconcileTenant(tenants *stoauth.Tenants, tokens *stoauth.TokenManager, opts *discoveryOptions, tenant stoauth.Tenant) error {
+	c, ok := tenantSdmClient(tenants, opts, tenant.ID)
+	if !ok {
+		logging.Logger(nil).Debugf("no recent Google access token for tenant %s, not reconciling devices", tenant.ID)
+		return nil
+	}
+
+	nestDevices, err := c.Devices()
+	if err != nil {
+		return errors.Wrap(err, "listing devices")
+	}
+	for _, nestDevice := range nestDevices {
+		rememberDevice(opts, nestDevice)
+	}
+
+	// Only filters on structure names need the homes
+	var homes *discovery.Homes
+	if len(opts.filters) > 0 {
+		homes = loadHomes(c)
+	}
+	allowed, excluded := opts.filters.Split(tenant.ID, nestDevices, homes)
+
+	// The devices that Smartthings has been told about
+	known := make(map[string]bool)
+	for _, deviceID := range tenant.DeviceIDs {
+		if !tenant.Excludes(deviceID) {
+			known[deviceID] = true
+		}
+	}
+
+	var added []sdmapi.Device
+	for _, nestDevice := range allowed {
+		if !known[nestDevice.ID] {
+			added = append(added, nestDevice)
+		}
+		delete(known, nestDevice.ID)
+	}
+
+	deviceIDs := make([]string, 0, len(nestDevices))
+	for _, nestDevice := range nestDevices {
+		deviceIDs = append(deviceIDs, nestDevice.ID)
+	}
+
+	var removed []string
+	for deviceID := range known {
+		removed = append(removed, deviceID)
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		if sameDevices(deviceIDs, tenant.DeviceIDs) && sameDevices(excluded, tenant.ExcludedDeviceIDs) {
+			return nil
+		}
+		return tenants.SetDevices(tenant.ID, deviceIDs, excluded)
+	}
+
+	logging.Logger(nil).Infof("tenant %s: %d devices added, %d removed", tenant.ID, len(added), len(removed))
+
+	if len(added) > 0 {
+		if homes == nil {
+			homes = loadHomes(c)
+		}
+		if stDevices := opts.builder.Devices(added, homes); len(stDevices) > 0 {
+			if err := executeDiscoveryCallback(tokens, tenant.ID, stDevices); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(removed) > 0 {
+		if err := executeDeviceDeletedCallback(tokens, tenant.ID, removed); err != nil {
+			return err
+		}
+	}
+
+	return tenants.SetDevices(tenant.ID, deviceIDs, excluded)
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tell whether two lists hold the same device IDs, in any order
+func sameDevices(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, i := range a {
+		if !contains(b, i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reconcile the devices of every tenant periodically, until the context is
+// cancelled
+func reconcileLoop(ctx context.Context, tenants *stoauth.Tenants, tokens *stoauth.TokenManager, opts *discoveryOptions) {
+	if opts.reconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(opts.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logging.Logger(nil).Info("reconcile-loop: shutting down")
+			return
+		case <-ticker.C:
+		}
+
+		for _, tenant := range tenants.List() {
+			if tenant.NeedsRelink {
+				continue
+			}
+
+			if err := reconcileTenant(tenants, tokens, opts, tenant); err != nil {
+				logging.Logger(nil).WithError(err).Errorf("reconciling devices of tenant %s", tenant.ID)
+			}
+		}
+	}
+}
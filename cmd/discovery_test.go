@@ -0,0 +1,381 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/pubsubapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+)
+
+// A Smartthings callback URL that keeps the callbacks it is sent
+type callbackServer struct {
+	mu        sync.Mutex
+	callbacks []testCallback
+}
+
+type testCallback struct {
+	Headers struct {
+		InteractionType string `json:"interactionType"`
+	} `json:"headers"`
+	Authentication struct {
+		Token string `json:"token"`
+	} `json:"authentication"`
+
+	// Discovery callbacks
+	Devices []struct {
+		ExternalDeviceID string `json:"externalDeviceId"`
+	} `json:"devices"`
+
+	// State callbacks
+	DeviceState []struct {
+		ExternalDeviceID string `json:"externalDeviceId"`
+		DeviceError      []struct {
+			ErrorEnum string `json:"errorEnum"`
+		} `json:"deviceError"`
+	} `json:"deviceState"`
+}
+
+func (s *callbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var callback testCallback
+	if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.callbacks = append(s.callbacks, callback)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The devices that were discovered and deleted by the callbacks, sorted
+func (s *callbackServer) received(t *testing.T) (discovered []string, deleted []string) {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, callback := range s.callbacks {
+		if callback.Authentication.Token != "st-token" {
+			t.Errorf("callback sent with token %q, want the tenant's", callback.Authentication.Token)
+		}
+
+		switch callback.Headers.InteractionType {
+		case "discoveryCallback":
+			for _, d := range callback.Devices {
+				discovered = append(discovered, d.ExternalDeviceID)
+			}
+		case "stateCallback":
+			for _, d := range callback.DeviceState {
+				if len(d.DeviceError) != 1 || d.DeviceError[0].ErrorEnum != "DEVICE-DELETED" {
+					t.Errorf("state callback for %s has errors %+v, want DEVICE-DELETED", d.ExternalDeviceID, d.DeviceError)
+				}
+				deleted = append(deleted, d.ExternalDeviceID)
+			}
+		default:
+			t.Errorf("unexpected %s callback", callback.Headers.InteractionType)
+		}
+	}
+
+	sort.Strings(discovered)
+	sort.Strings(deleted)
+	return discovered, deleted
+}
+
+// The tenant as the web service saves it once it is linked
+type testTenant struct {
+	deviceIDs       []string
+	excludedIDs     []string
+	googleTokenSeen time.Time
+}
+
+// Save a tenant "home" whose callbacks go to the server, and load it
+func newTestDiscoveryTenants(t *testing.T, callbackURL string, tenant testTenant) *stoauth.Tenants {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"tenants": map[string]interface{}{
+			"home": map[string]interface{}{
+				"client-id":                "client-id",
+				"token-url":                callbackURL + "/token",
+				"state-callback-url":       callbackURL,
+				"access-token":             "st-token",
+				"access-token-expiry":      time.Now().Add(time.Hour),
+				"refresh-token":            "st-refresh-token",
+				"device-ids":               tenant.deviceIDs,
+				"excluded-device-ids":      tenant.excludedIDs,
+				"google-access-token":      "google-token",
+				"google-access-token-seen": tenant.googleTokenSeen,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("encoding tenants: %v", err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "tenants.json")
+	if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatalf("saving tenants: %v", err)
+	}
+
+	tenants := stoauth.NewTenants(stoauth.NewFileStore(fileName))
+	if err := tenants.Load(); err != nil {
+		t.Fatalf("loading tenants: %v", err)
+	}
+
+	return tenants
+}
+
+func newTestDiscoveryOptions(t *testing.T, filters discovery.Filters) *discoveryOptions {
+	t.Helper()
+
+	fake := sdmapi.NewFakeClient("my-project-id")
+	if err := fake.LoadFile("../sample-sdm-fixtures.json"); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+
+	profiles := map[string]string{
+		sdmapi.DeviceTypeThermostat: discovery.StNestThermostatDeviceProfileID,
+		sdmapi.DeviceTypeDoorbell:   "11111111-2222-3333-4444-555555555555",
+	}
+
+	return &discoveryOptions{
+		builder:           discovery.NewBuilder(discovery.DefaultMappings(profiles)),
+		filters:           filters,
+		sdmClient:         fake,
+		mappings:          newDeviceMappings(),
+		scales:            newDeviceScales(),
+		googleTokenMaxAge: time.Hour,
+	}
+}
+
+func newTestCallbackServer(t *testing.T) (*callbackServer, string) {
+	s := &callbackServer{}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return s, server.URL
+}
+
+func TestReconcileTenant(t *testing.T) {
+	excludeDoorbell := discovery.Filters{{Action: discovery.FilterExclude, DeviceID: "doorbell1"}}
+	both := []string{"doorbell1", "thermostat1"}
+
+	tests := []struct {
+		name    string
+		filters discovery.Filters
+		tenant  testTenant
+
+		wantDiscovered []string
+		wantDeleted    []string
+		wantDevices    []string
+		wantExcluded   []string
+	}{
+		{
+			name:           "new devices",
+			wantDiscovered: both,
+			wantDevices:    both,
+		},
+		{
+			name:           "one new device",
+			tenant:         testTenant{deviceIDs: []string{"thermostat1"}},
+			wantDiscovered: []string{"doorbell1"},
+			wantDevices:    both,
+		},
+		{
+			name:        "removed device",
+			tenant:      testTenant{deviceIDs: []string{"thermostat1", "doorbell1", "gone1"}},
+			wantDeleted: []string{"gone1"},
+			wantDevices: both,
+		},
+		{
+			name:         "newly excluded device",
+			filters:      excludeDoorbell,
+			tenant:       testTenant{deviceIDs: both},
+			wantDeleted:  []string{"doorbell1"},
+			wantDevices:  both,
+			wantExcluded: []string{"doorbell1"},
+		},
+		{
+			name:         "excluded device",
+			filters:      excludeDoorbell,
+			tenant:       testTenant{deviceIDs: both, excludedIDs: []string{"doorbell1"}},
+			wantDevices:  both,
+			wantExcluded: []string{"doorbell1"},
+		},
+		{
+			name:           "no longer excluded",
+			tenant:         testTenant{deviceIDs: both, excludedIDs: []string{"doorbell1"}},
+			wantDiscovered: []string{"doorbell1"},
+			wantDevices:    both,
+		},
+		{
+			name:         "removed excluded device",
+			filters:      excludeDoorbell,
+			tenant:       testTenant{deviceIDs: []string{"thermostat1", "doorbell1", "gone1"}, excludedIDs: []string{"doorbell1", "gone1"}},
+			wantDevices:  both,
+			wantExcluded: []string{"doorbell1"},
+		},
+		{
+			name:        "unchanged",
+			tenant:      testTenant{deviceIDs: both},
+			wantDevices: both,
+		},
+		{
+			name:        "old google token",
+			tenant:      testTenant{deviceIDs: []string{"gone1"}, googleTokenSeen: time.Now().Add(-time.Hour * 2)},
+			wantDevices: []string{"gone1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, url := newTestCallbackServer(t)
+
+			if tt.tenant.googleTokenSeen.IsZero() {
+				tt.tenant.googleTokenSeen = time.Now()
+			}
+			tenants := newTestDiscoveryTenants(t, url, tt.tenant)
+			opts := newTestDiscoveryOptions(t, tt.filters)
+
+			tenant, _ := tenants.Get("home")
+			if err := reconcileTenant(tenants, stoauth.NewTokenManager(tenants), opts, tenant); err != nil {
+				t.Fatalf("reconciling: %v", err)
+			}
+
+			discovered, deleted := server.received(t)
+			if !sameStrings(discovered, tt.wantDiscovered) {
+				t.Errorf("discovered %v, want %v", discovered, tt.wantDiscovered)
+			}
+			if !sameStrings(deleted, tt.wantDeleted) {
+				t.Errorf("deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+
+			tenant, _ = tenants.Get("home")
+			if !sameDevices(tenant.DeviceIDs, tt.wantDevices) || !sameDevices(tenant.ExcludedDeviceIDs, tt.wantExcluded) {
+				t.Errorf("saved devices %v excluding %v, want %v excluding %v", tenant.DeviceIDs, tenant.ExcludedDeviceIDs, tt.wantDevices, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+func TestHandleRelationUpdate(t *testing.T) {
+	const home = "enterprises/my-project-id/structures/home"
+
+	tests := []struct {
+		name     string
+		filters  discovery.Filters
+		tenant   testTenant
+		deviceID string
+		relation pubsubapi.RelationUpdate
+
+		wantDiscovered []string
+		wantDeleted    []string
+		wantDevices    []string
+		wantExcluded   []string
+	}{
+		{
+			name:           "added to the home",
+			tenant:         testTenant{deviceIDs: []string{"doorbell1"}},
+			deviceID:       "thermostat1",
+			relation:       pubsubapi.RelationUpdate{Type: pubsubapi.RelationCreated, Subject: home},
+			wantDiscovered: []string{"thermostat1"},
+			wantDevices:    []string{"doorbell1", "thermostat1"},
+		},
+		{
+			name:         "added to an excluded room",
+			filters:      discovery.Filters{{Action: discovery.FilterExclude, Room: "Hallway"}},
+			deviceID:     "thermostat1",
+			relation:     pubsubapi.RelationUpdate{Type: pubsubapi.RelationCreated, Subject: home + "/rooms/hallway"},
+			wantDevices:  []string{"thermostat1"},
+			wantExcluded: []string{"thermostat1"},
+		},
+		{
+			name:         "moved into an excluded room",
+			filters:      discovery.Filters{{Action: discovery.FilterExclude, Room: "Hallway"}},
+			tenant:       testTenant{deviceIDs: []string{"thermostat1"}},
+			deviceID:     "thermostat1",
+			relation:     pubsubapi.RelationUpdate{Type: pubsubapi.RelationUpdated, Subject: home + "/rooms/hallway"},
+			wantDeleted:  []string{"thermostat1"},
+			wantDevices:  []string{"thermostat1"},
+			wantExcluded: []string{"thermostat1"},
+		},
+		{
+			name:        "removed from the home",
+			tenant:      testTenant{deviceIDs: []string{"doorbell1", "thermostat1"}},
+			deviceID:    "thermostat1",
+			relation:    pubsubapi.RelationUpdate{Type: pubsubapi.RelationDeleted, Subject: home},
+			wantDeleted: []string{"thermostat1"},
+			wantDevices: []string{"doorbell1"},
+		},
+		{
+			name:        "excluded device removed from the home",
+			tenant:      testTenant{deviceIDs: []string{"doorbell1", "thermostat1"}, excludedIDs: []string{"thermostat1"}},
+			deviceID:    "thermostat1",
+			relation:    pubsubapi.RelationUpdate{Type: pubsubapi.RelationDeleted, Subject: home},
+			wantDevices: []string{"doorbell1"},
+		},
+		{
+			name:           "removed from a room",
+			tenant:         testTenant{deviceIDs: []string{"thermostat1"}},
+			deviceID:       "thermostat1",
+			relation:       pubsubapi.RelationUpdate{Type: pubsubapi.RelationDeleted, Subject: home + "/rooms/hallway"},
+			wantDiscovered: []string{"thermostat1"},
+			wantDevices:    []string{"thermostat1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, url := newTestCallbackServer(t)
+
+			tt.tenant.googleTokenSeen = time.Now()
+			tenants := newTestDiscoveryTenants(t, url, tt.tenant)
+			opts := newTestDiscoveryOptions(t, tt.filters)
+
+			relation := tt.relation
+			event := pubsubapi.SdmEvent{DeviceID: tt.deviceID, Relation: &relation}
+			if err := handleRelationUpdate(tenants, stoauth.NewTokenManager(tenants), opts, "home", event); err != nil {
+				t.Fatalf("handling relation update: %v", err)
+			}
+
+			discovered, deleted := server.received(t)
+			if !sameStrings(discovered, tt.wantDiscovered) {
+				t.Errorf("discovered %v, want %v", discovered, tt.wantDiscovered)
+			}
+			if !sameStrings(deleted, tt.wantDeleted) {
+				t.Errorf("deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+
+			tenant, _ := tenants.Get("home")
+			if !sameDevices(tenant.DeviceIDs, tt.wantDevices) || !sameDevices(tenant.ExcludedDeviceIDs, tt.wantExcluded) {
+				t.Errorf("saved devices %v excluding %v, want %v excluding %v", tenant.DeviceIDs, tenant.ExcludedDeviceIDs, tt.wantDevices, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/pubsubapi"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
@@ -35,6 +36,7 @@ var _pubSubCmdOpts struct {
 	googlePubSubProjectID    string
 	googleCloudCredsFile     string
 	maxMessageAge            time.Duration
+	eventResetDelay          time.Duration
 	logMessages              bool
 }
 
@@ -67,6 +69,7 @@ func init() {
 	pubSubCmd.Flags().StringVar(&_pubSubCmdOpts.googlePubSubSubscription, "pubsub-subscription", "", "Google pub/sub subscription ID")
 	pubSubCmd.Flags().StringVar(&_pubSubCmdOpts.googleCloudCredsFile, "gcp-creds", "", "Google Cloud service account credentials file")
 	pubSubCmd.Flags().DurationVar(&_pubSubCmdOpts.maxMessageAge, "pubsub-maxage", time.Second*1200, "maximum age of a Device Access message that we will process, eg. 1m or 10s")
+	pubSubCmd.Flags().DurationVar(&_pubSubCmdOpts.eventResetDelay, "event-reset", time.Second*30, "delay before returning a sensor to its resting state after a device event that is not part of a thread, eg. 30s")
 	pubSubCmd.Flags().BoolVar(&_pubSubCmdOpts.logMessages, "log-messages", false, "log pubsub messages (only in debug mode)")
 
 	errPanic(viper.GetViper().BindPFlag("smartthings.callback-timeout", pubSubCmd.Flags().Lookup("smartthings-timeout")))
@@ -78,8 +81,13 @@ func init() {
 	errPanic(viper.GetViper().BindPFlag("google.pubsub.subscription-id", pubSubCmd.Flags().Lookup("pubsub-subscription")))
 	errPanic(viper.GetViper().BindPFlag("google.pubsub.max-message-age", pubSubCmd.Flags().Lookup("pubsub-maxage")))
 	errPanic(viper.GetViper().BindPFlag("google.creds.file", pubSubCmd.Flags().Lookup("gcp-creds")))
+	errPanic(viper.GetViper().BindPFlag("smartthings.event-reset-delay", pubSubCmd.Flags().Lookup("event-reset")))
 	errPanic(viper.GetViper().BindPFlag("logging.log-messages", pubSubCmd.Flags().Lookup("log-messages")))
 
+	viper.SetDefault("smartthings.token-renewal-jitter", time.Minute*5)
+	viper.SetDefault("smartthings.discovery.reconcile-interval", time.Hour)
+	viper.SetDefault("google.device-access.token-max-age", time.Minute*50)
+
 	rootCmd.AddCommand(pubSubCmd)
 }
 
@@ -117,12 +125,80 @@ func pullLoop(pubsub pubsubapi.PubSub, ctx context.Context, c chan pubsubapi.Sdm
 	}
 }
 
-func publishLoop(maxConcurrent int, pubsub pubsubapi.PubSub, tokenState stoauth.State, c chan pubsubapi.SdmEvent) {
+// Settings that control how events are published to Smartthings
+type publishOptions struct {
+	// Delay before resetting sensors after an event outside of a thread
+	resetDelay time.Duration
+
+	// Namespace of the custom capabilities that unknown traits are
+	// forwarded as, empty to drop unknown traits
+	customNamespace string
+
+	// Overrides the temperature scale of every device if set
+	temperatureScale *sdmapi.TemperatureScale
+
+	// Temperature scales learned from previous events
+	scales *deviceScales
+
+	// How long the fan runs for when the timer is started without a duration
+	fanTimers sdmapi.FanTimerDurations
+
+	// How devices that are added or removed are discovered
+	discovery *discoveryOptions
+}
+
+// Trait updates only contain the traits that changed, so remember the
+// temperature scale of each device.  It is learned when the device is fetched
+// from Google, the first time an event arrives for it or when devices are
+// discovered, and from any update that includes the device settings.
+type deviceScales struct {
+	mu     sync.Mutex
+	scales map[string]sdmapi.TemperatureScale
+}
+
+func newDeviceScales() *deviceScales {
+	return &deviceScales{
+		scales: make(map[string]sdmapi.TemperatureScale),
+	}
+}
+
+// Return the temperature scale of a device, updating it from the traits if
+// they include the device settings
+func (d *deviceScales) update(deviceID string, traits sdmapi.Traits) sdmapi.TemperatureScale {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if settings := traits.Settings(); settings != nil {
+		d.scales[deviceID] = settings.TemperatureScale
+	}
+
+	return d.scales[deviceID]
+}
+
+// Learn the temperature scale of a device fetched from Google
+func (d *deviceScales) learn(nestDevice sdmapi.Device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if settings := nestDevice.Traits.Settings(); settings != nil {
+		d.scales[nestDevice.ID] = settings.TemperatureScale
+	}
+}
+
+// Forget the temperature scale of a device that no longer belongs to a tenant
+func (d *deviceScales) forget(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.scales, deviceID)
+}
+
+func publishLoop(maxConcurrent int, pubsub pubsubapi.PubSub, tenants *stoauth.Tenants, tokens *stoauth.TokenManager, opts publishOptions, c chan pubsubapi.SdmEvent) {
 	limit := limiter.NewConcurrencyLimiter(maxConcurrent)
 
 	for event := range c {
 		limit.ExecuteWithTicket(func(ticket int) {
-			publishEvent(ticket, pubsub, tokenState, event)
+			publishEvent(ticket, pubsub, tenants, tokens, opts, event)
 		})
 	}
 
@@ -131,16 +207,29 @@ func publishLoop(maxConcurrent int, pubsub pubsubapi.PubSub, tokenState stoauth.
 	logging.Logger(nil).Info("publish-loop: done")
 }
 
-func makeDeviceStates(event pubsubapi.SdmEvent) []*models.DeviceStateStatesItems0 {
+func makeDeviceStates(event pubsubapi.SdmEvent, opts publishOptions) []*models.DeviceStateStatesItems0 {
+	// Device events are sent on their own, without the health check
+	if len(event.Events) > 0 {
+		return makeDeviceEventStates(event, event.ThreadState)
+	}
+
+	switch {
+	case opts.temperatureScale != nil:
+		event.Traits.SetTemperatureScale(opts.temperatureScale)
+	case opts.scales != nil:
+		scale := opts.scales.update(event.DeviceID, event.Traits)
+		event.Traits.SetTemperatureScale(&scale)
+	}
+
+	event.Traits.SetFanTimerDuration(opts.fanTimers.For(event.DeviceID))
+
 	nestTraits := event.Traits.TraitIDs()
 	states := make([]*models.DeviceStateStatesItems0, 0, len(nestTraits))
 
 	for _, nestTraitID := range nestTraits {
-		nestTrait := event.Traits.Trait(nestTraitID)
-
 		// Does the trait know how to expose itself to Smartthings?
-		i, ok := nestTrait.(sdmapi.StCapability)
-		if !ok {
+		i := event.Traits.StCapability(nestTraitID)
+		if i == nil {
 			logging.Logger(nil).Debugf("Ignoring Nest trait %s, no Smartthings adapter", nestTraitID.Name())
 			continue
 		}
@@ -149,6 +238,10 @@ func makeDeviceStates(event pubsubapi.SdmEvent) []*models.DeviceStateStatesItems
 		states = append(states, stStates...)
 	}
 
+	if opts.customNamespace != "" {
+		states = append(states, event.Traits.CustomToSmartthingsStates(opts.customNamespace)...)
+	}
+
 	// tack on the health check state
 	deviceState := models.DeviceStateStatesItems0{
 		Component:  "main",
@@ -166,8 +259,40 @@ func makeDeviceStates(event pubsubapi.SdmEvent) []*models.DeviceStateStatesItems
 	return states
 }
 
-func executeDeviceStateCallback(tokenState stoauth.State, deviceInfo models.DeviceState) error {
-	token, err := tokenState.GetAccessToken()
+// Drop the states of capabilities that the mapping of a device doesn't
+// expose, if it has one
+func filterStates(mapping *discovery.Mapping, states []*models.DeviceStateStatesItems0) []*models.DeviceStateStatesItems0 {
+	if mapping == nil {
+		return states
+	}
+
+	return mapping.FilterStates(states)
+}
+
+func makeDeviceEventStates(event pubsubapi.SdmEvent, threadState sdmapi.EventThreadState) []*models.DeviceStateStatesItems0 {
+	var states []*models.DeviceStateStatesItems0
+
+	for _, deviceEvent := range event.Events {
+		// Does the event know how to expose itself to Smartthings?
+		i, ok := deviceEvent.(sdmapi.StEvent)
+		if !ok {
+			logging.Logger(nil).Debugf("Ignoring Nest event %s, no Smartthings adapter", deviceEvent.Name())
+			continue
+		}
+
+		states = append(states, i.ToSmartthingsEvent(threadState)...)
+	}
+
+	timestampMillis := event.Timestamp.UnixNano() / 1000000
+	for _, s := range states {
+		s.Timestamp = &timestampMillis
+	}
+
+	return states
+}
+
+func executeDeviceStateCallback(tokens *stoauth.TokenManager, tenantID string, deviceInfo models.DeviceState) error {
+	token, callbackURL, err := tokens.AccessToken(tenantID)
 	if err != nil {
 		return errors.Wrap(err, "fetching access token for device callback")
 	}
@@ -176,17 +301,22 @@ func executeDeviceStateCallback(tokenState stoauth.State, deviceInfo models.Devi
 	req.DeviceState = []*models.DeviceState{&deviceInfo}
 	req.Authentication.Token = &token
 
+	return postCallback(callbackURL, req, "device")
+}
+
+// Send a callback request to Smartthings
+func postCallback(callbackURL string, req interface{}, kind string) error {
 	reqBody, err := json.Marshal(req)
 	if err != nil {
-		return errors.Wrap(err, "encoding smartthing device callback request")
+		return errors.Wrapf(err, "encoding smartthing %s callback request", kind)
 	}
 
-	logging.Logger(nil).Debugf("Sending device callback request to Smartthings URL [%s]: %s", tokenState.StateCallbackURL, reqBody)
+	logging.Logger(nil).Debugf("Sending %s callback request to Smartthings URL [%s]: %s", kind, callbackURL, reqBody)
 
 	// Send request
-	resp, err := http.Post(tokenState.StateCallbackURL, "application/json", bytes.NewBuffer(reqBody))
+	resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(reqBody))
 	if err != nil {
-		return errors.Wrap(err, "executing smartthing device callback")
+		return errors.Wrapf(err, "executing smartthing %s callback", kind)
 	}
 	defer resp.Body.Close()
 
@@ -195,21 +325,80 @@ func executeDeviceStateCallback(tokenState stoauth.State, deviceInfo models.Devi
 		return errors.Wrap(err, "reading response body")
 	}
 
-	if resp.StatusCode != 200 && resp.StatusCode == 204 {
-		return errors.Wrapf(err, "non-200/204 code from Smartthings device callback URL: %d (%s): %s", resp.StatusCode, resp.Status, bodyBytes)
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return errors.Errorf("non-200/204 code from Smartthings %s callback URL: %d (%s): %s", kind, resp.StatusCode, resp.Status, bodyBytes)
 	}
 
 	return nil
 }
 
-func publishEvent(ticket int, pubsub pubsubapi.PubSub, tokenState stoauth.State, event pubsubapi.SdmEvent) {
+func publishEvent(ticket int, pubsub pubsubapi.PubSub, tenants *stoauth.Tenants, tokens *stoauth.TokenManager, opts publishOptions, event pubsubapi.SdmEvent) {
 	logging.Logger(nil).Debugf("publish-goroutine %d: got %+v", ticket, event)
 
+	// Which installation does the event belong to ?
+	tenantID, ok := tenants.ForEvent(event.UserID, event.DeviceID)
+	if !ok {
+		logging.Logger(nil).Warnf("no tenant for user %s, device %s, dropping event", event.UserID, event.DeviceID)
+		forgetDevice(opts.discovery, event.DeviceID)
+		if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
+			logging.Logger(nil).WithError(err).Error("acknowledging event")
+		}
+		return
+	}
+
+	// Smartthings won't accept callbacks until the installation is linked again
+	if tokens.NeedsRelink(tenantID) {
+		logging.Logger(nil).Debugf("tenant %s needs to be linked again, dropping event", tenantID)
+		if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
+			logging.Logger(nil).WithError(err).Error("acknowledging event")
+		}
+		return
+	}
+
+	if event.Relation != nil {
+		if err := handleRelationUpdate(tenants, tokens, opts.discovery, tenantID, event); err == nil {
+			if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
+				logging.Logger(nil).WithError(err).Error("acknowledging event")
+			}
+		} else {
+			logging.Logger(nil).WithError(err).Error("handling relation update")
+		}
+		return
+	}
+
+	// Smartthings doesn't know about devices that the filters exclude
+	if tenant, ok := tenants.Get(tenantID); ok && tenant.Excludes(event.DeviceID) {
+		logging.Logger(nil).Debugf("device %s of tenant %s is excluded by the device filters, dropping event", event.DeviceID, tenantID)
+		if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
+			logging.Logger(nil).WithError(err).Error("acknowledging event")
+		}
+		return
+	}
+
+	// Only send the states of the capabilities in the device's profile, as
+	// the web service does.  Fetching a device seen for the first time also
+	// learns its temperature scale.
+	mapping := deviceMapping(tenants, opts.discovery, tenantID, event.DeviceID)
+
 	deviceInfo := models.DeviceState{}
 	deviceInfo.ExternalDeviceID = event.DeviceID
-	deviceInfo.States = makeDeviceStates(event)
+	deviceInfo.States = filterStates(mapping, makeDeviceStates(event, opts))
+
+	// Nothing to tell Smartthings about, eg. an event thread update for a chime
+	if len(deviceInfo.States) == 0 {
+		if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
+			logging.Logger(nil).WithError(err).Error("acknowledging event")
+		}
+		return
+	}
+
+	// Events outside of a thread won't be followed by an ENDED message, so
+	// return the sensors to their resting state ourselves
+	if len(event.Events) > 0 && event.ThreadState == "" {
+		scheduleEventReset(tokens, tenantID, opts.resetDelay, event, mapping)
+	}
 
-	if err := executeDeviceStateCallback(tokenState, deviceInfo); err == nil {
+	if err := executeDeviceStateCallback(tokens, tenantID, deviceInfo); err == nil {
 		if err := pubsub.AckMessages([]string{event.AckID}); err != nil {
 			logging.Logger(nil).WithError(err).Error("acknowledging event")
 		}
@@ -220,6 +409,25 @@ func publishEvent(ticket int, pubsub pubsubapi.PubSub, tokenState stoauth.State,
 	logging.Logger(nil).Debugf("publish-goroutine %d: done", ticket)
 }
 
+func scheduleEventReset(tokens *stoauth.TokenManager, tenantID string, resetDelay time.Duration, event pubsubapi.SdmEvent, mapping *discovery.Mapping) {
+	time.AfterFunc(resetDelay, func() {
+		resetEvent := event
+		resetEvent.Timestamp = event.Timestamp.Add(resetDelay)
+
+		deviceInfo := models.DeviceState{}
+		deviceInfo.ExternalDeviceID = event.DeviceID
+		deviceInfo.States = filterStates(mapping, makeDeviceEventStates(resetEvent, sdmapi.EventThreadEnded))
+		if len(deviceInfo.States) == 0 {
+			return
+		}
+
+		logging.Logger(nil).Debugf("resetting event states for device %s", event.DeviceID)
+		if err := executeDeviceStateCallback(tokens, tenantID, deviceInfo); err != nil {
+			logging.Logger(nil).WithError(err).Error("executing Smartthings device callback for event reset")
+		}
+	})
+}
+
 func newDeviceStateCallback() models.DeviceStateCallback {
 	stSchema := "st-schema"
 	stVersion := "1.0"
@@ -243,8 +451,49 @@ func doPubSub() error {
 	gcpProject := viper.GetString("google.pubsub.project-id")
 	subscription := viper.GetString("google.pubsub.subscription-id")
 	credsFile := viper.GetString("google.creds.file")
-	oauthFile := viper.GetString("smartthings.oauth-param-file")
 	clientSecret := viper.GetString("smartthings.client-secret")
+	temperatureScale, err := sdmapi.ParseTemperatureScale(viper.GetString("smartthings.temperature-scale"))
+	if err != nil {
+		return err
+	}
+
+	fanTimers, err := fanTimerDurationsFromConfig()
+	if err != nil {
+		return err
+	}
+
+	mappings, err := deviceMappingsFromConfig()
+	if err != nil {
+		return err
+	}
+
+	filters, err := deviceFiltersFromConfig()
+	if err != nil {
+		return err
+	}
+
+	sdmTransport, err := googleTransport("pubsub-sdm")
+	if err != nil {
+		return err
+	}
+
+	scales := newDeviceScales()
+	opts := publishOptions{
+		resetDelay:       viper.GetDuration("smartthings.event-reset-delay"),
+		customNamespace:  viper.GetString("smartthings.custom-capability-namespace"),
+		temperatureScale: temperatureScale,
+		scales:           scales,
+		fanTimers:        fanTimers,
+		discovery: &discoveryOptions{
+			builder:           discovery.NewBuilder(mappings),
+			filters:           filters,
+			sdmClient:         sdmapi.NewLiveClient(sdmProject).WithTransport(sdmTransport).WithTimeout(time.Second * 15),
+			mappings:          newDeviceMappings(),
+			scales:            scales,
+			googleTokenMaxAge: viper.GetDuration("google.device-access.token-max-age"),
+			reconcileInterval: viper.GetDuration("smartthings.discovery.reconcile-interval"),
+		},
+	}
 
 	var logMesssages bool
 	if viper.GetBool("logging.log-messages") {
@@ -265,24 +514,54 @@ func doPubSub() error {
 	// comms between pull and publish loops
 	eventChan := make(chan pubsubapi.SdmEvent)
 
+	transport, err := googleTransport("pubsub")
+	if err != nil {
+		return err
+	}
+
 	// pubsub API instance
-	pubsub := pubsubapi.NewLiveClient(sdmProject, gcpProject, subscription).WithMaxMessageAge(maxAge).WithServiceAccountCreds(credsFile)
+	pubsub := pubsubapi.NewLiveClient(sdmProject, gcpProject, subscription).WithMaxMessageAge(maxAge).WithTransport(transport).WithServiceAccountCreds(credsFile)
 	if logMesssages {
 		pubsub = pubsub.(*pubsubapi.Live).WithLogMessages()
 	}
 
 	/* Start the publishing loop first */
 	// load oauth data that should have been written by the web service
-	tokenState := stoauth.NewState().WithClientSecret(clientSecret)
-	if err := tokenState.Load(oauthFile); err != nil {
+	store, err := tokenStoreFromConfig()
+	if err != nil {
 		return err
 	}
 
+	tenants := stoauth.NewTenants(store).WithClientSecret(clientSecret)
+	if err := tenants.Load(); err != nil {
+		return err
+	}
+
+	// pick up tenants linked, and tokens refreshed, by the web service
+	if err := tenants.Watch(ctx); err != nil {
+		return err
+	}
+
+	// Renew access tokens before they expire
+	tokens := stoauth.NewTokenManager(tenants).WithRenewalJitter(viper.GetDuration("smartthings.token-renewal-jitter"))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tokens.Run(ctx)
+	}()
+
+	// Tell Smartthings about devices that are added or removed
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reconcileLoop(ctx, tenants, tokens, opts.discovery)
+	}()
+
 	// Run the publish loop in a goroutine
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		publishLoop(10, pubsub, tokenState, eventChan)
+		publishLoop(10, pubsub, tenants, tokens, opts, eventChan)
 	}()
 
 	/* Start the pubsub pull loop */
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/pubsubapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+)
+
+func newTestEvent(t *testing.T, deviceID string, traits string) pubsubapi.SdmEvent {
+	event := pubsubapi.SdmEvent{
+		DeviceID:  deviceID,
+		Timestamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Traits:    sdmapi.NewTraits(),
+	}
+
+	if err := event.Traits.Parse([]byte(traits)); err != nil {
+		t.Fatalf("parsing traits: %v", err)
+	}
+
+	return event
+}
+
+func findState(states []*models.DeviceStateStatesItems0, capability string, attribute string) *models.DeviceStateStatesItems0 {
+	for _, s := range states {
+		if s.Capability == capability && s.Attribute == attribute {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// The unit of a state, which the model keeps with its additional properties
+func unit(s *models.DeviceStateStatesItems0) interface{} {
+	if s == nil {
+		return nil
+	}
+
+	return s.DeviceStateStatesItems0AdditionalProperties["unit"]
+}
+
+const testThermostatTraits = `{
+	"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 21.0},
+	"sdm.devices.traits.ThermostatMode": {"mode": "HEATCOOL", "availableModes": ["HEAT", "COOL", "HEATCOOL", "OFF"]},
+	"sdm.devices.traits.ThermostatTemperatureSetpoint": {"heatCelsius": 19.0, "coolCelsius": 25.0}
+}`
+
+func TestMakeDeviceStates(t *testing.T) {
+	event := newTestEvent(t, "thermostat1", testThermostatTraits)
+
+	states := makeDeviceStates(event, publishOptions{scales: newDeviceScales()})
+
+	if s := findState(states, "st.temperatureMeasurement", "temperature"); unit(s) != "C" {
+		t.Errorf("got temperature %+v, want one in C", s)
+	}
+	if s := findState(states, "st.thermostatMode", "thermostatMode"); s == nil || s.Value != "auto" {
+		t.Errorf("got thermostat mode %+v, want auto", s)
+	}
+	if findState(states, "st.thermostatHeatingSetpoint", "heatingSetpoint") == nil || findState(states, "st.thermostatCoolingSetpoint", "coolingSetpoint") == nil {
+		t.Error("missing a setpoint")
+	}
+	if findState(states, "st.healthcheck", "healthStatus") == nil {
+		t.Error("no health check state")
+	}
+
+	want := event.Timestamp.UnixNano() / int64(time.Millisecond)
+	for _, s := range states {
+		if s.Timestamp == nil || *s.Timestamp != want {
+			t.Errorf("state %s.%s has timestamp %v, want %d", s.Capability, s.Attribute, s.Timestamp, want)
+		}
+	}
+}
+
+func TestMakeDeviceStatesRemembersScale(t *testing.T) {
+	opts := publishOptions{scales: newDeviceScales()}
+
+	makeDeviceStates(newTestEvent(t, "thermostat1", `{"sdm.devices.traits.Settings": {"temperatureScale": "FAHRENHEIT"}}`), opts)
+
+	// A later update without the settings is still in the device's scale
+	states := makeDeviceStates(newTestEvent(t, "thermostat1", `{"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 21.0}}`), opts)
+	if s := findState(states, "st.temperatureMeasurement", "temperature"); unit(s) != "F" {
+		t.Errorf("got temperature %+v, want one in F", s)
+	}
+
+	states = makeDeviceStates(newTestEvent(t, "thermostat2", `{"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 21.0}}`), opts)
+	if s := findState(states, "st.temperatureMeasurement", "temperature"); unit(s) != "C" {
+		t.Errorf("got temperature %+v for another device, want one in C", s)
+	}
+}
+
+func TestFilterStates(t *testing.T) {
+	states := makeDeviceStates(newTestEvent(t, "thermostat1", testThermostatTraits), publishOptions{})
+
+	if got := filterStates(nil, states); len(got) != len(states) {
+		t.Errorf("got %d states without a mapping, want all %d", len(got), len(states))
+	}
+
+	heatOnly := &discovery.Mapping{
+		Name:         "heat-only",
+		Capabilities: []string{"temperatureMeasurement", "thermostatHeatingSetpoint", "thermostatMode"},
+	}
+	filtered := filterStates(heatOnly, states)
+
+	if findState(filtered, "st.thermostatCoolingSetpoint", "coolingSetpoint") != nil {
+		t.Error("kept the cooling setpoint of a heat-only mapping")
+	}
+	for _, want := range []string{"st.temperatureMeasurement", "st.thermostatHeatingSetpoint", "st.thermostatMode", "st.healthcheck"} {
+		found := false
+		for _, s := range filtered {
+			found = found || s.Capability == want
+		}
+		if !found {
+			t.Errorf("dropped the %s state", want)
+		}
+	}
+}
+
+func TestDeviceScaleLearnedWhenFirstSeen(t *testing.T) {
+	fake := sdmapi.NewFakeClient("my-project-id")
+	if err := fake.LoadFile("../sample-sdm-fixtures.json"); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+	if err := fake.SetTrait("thermostat1", "sdm.devices.traits.Settings", map[string]interface{}{"temperatureScale": "FAHRENHEIT"}); err != nil {
+		t.Fatalf("setting the scale: %v", err)
+	}
+
+	tenants := stoauth.NewTenants(stoauth.NewFileStore(filepath.Join(t.TempDir(), "tenants.json")))
+	err := tenants.Put(stoauth.Tenant{
+		ID:              "home",
+		DeviceIDs:       []string{"thermostat1"},
+		State:           stoauth.NewState(),
+		GoogleToken:     "google-token",
+		GoogleTokenSeen: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("adding tenant: %v", err)
+	}
+
+	scales := newDeviceScales()
+	opts := publishOptions{
+		scales: scales,
+		discovery: &discoveryOptions{
+			builder:           discovery.NewBuilder(nil),
+			sdmClient:         fake,
+			mappings:          newDeviceMappings(),
+			scales:            scales,
+			googleTokenMaxAge: time.Hour,
+		},
+	}
+
+	// The first event for the device doesn't include its settings
+	event := newTestEvent(t, "thermostat1", `{"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 21.0}}`)
+	deviceMapping(tenants, opts.discovery, "home", event.DeviceID)
+
+	if s := findState(makeDeviceStates(event, opts), "st.temperatureMeasurement", "temperature"); unit(s) != "F" {
+		t.Errorf("got temperature %+v, want one in the device's scale F", s)
+	}
+
+	// An explicit scale still overrides the device's
+	celsius := sdmapi.TemperatureScaleCelsius
+	opts.temperatureScale = &celsius
+	if s := findState(makeDeviceStates(event, opts), "st.temperatureMeasurement", "temperature"); unit(s) != "C" {
+		t.Errorf("got temperature %+v, want the configured scale C", s)
+	}
+
+	forgetDevice(opts.discovery, event.DeviceID)
+	opts.temperatureScale = nil
+	if s := findState(makeDeviceStates(event, opts), "st.temperatureMeasurement", "temperature"); unit(s) != "C" {
+		t.Errorf("got temperature %+v for a forgotten device, want C", s)
+	}
+}
@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -10,7 +12,9 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 
+	"github.com/jake-scott/smartthings-nest/internal/pkg/cassette"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
 )
 
 var (
@@ -18,6 +22,8 @@ var (
 	debug   bool
 
 	deviceAccessProject string
+	httpMode            string
+	cassetteDir         string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -47,11 +53,15 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.smartthings-nest.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "enable debugging (default: false)")
 	rootCmd.PersistentFlags().StringVarP(&deviceAccessProject, "device-access-project", "p", "", "Google device access project ID")
+	rootCmd.PersistentFlags().StringVar(&httpMode, "http-mode", "live", "Google API traffic: live, record (to the cassette dir) or replay (from the cassette dir)")
+	rootCmd.PersistentFlags().StringVar(&cassetteDir, "cassette-dir", ".", "directory for recorded Google API traffic")
 
 	// errPanic(rootCmd.MarkPersistentFlagRequired("device-access-project"))
 
 	errPanic(viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug")))
 	errPanic(viper.BindPFlag("google.device-access.project", rootCmd.PersistentFlags().Lookup("device-access-project")))
+	errPanic(viper.BindPFlag("google.http.mode", rootCmd.PersistentFlags().Lookup("http-mode")))
+	errPanic(viper.BindPFlag("google.http.cassette-dir", rootCmd.PersistentFlags().Lookup("cassette-dir")))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -93,6 +103,75 @@ func doConfigure(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// Return the transport to use for a Google API client, according to the
+// configured HTTP mode.  Returns nil for live traffic.
+func googleTransport(apiName string) (http.RoundTripper, error) {
+	mode, err := cassette.ParseMode(viper.GetString("google.http.mode"))
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := filepath.Join(viper.GetString("google.http.cassette-dir"), apiName+".json")
+	return cassette.NewTransport(mode, fileName)
+}
+
+// Return the store for the Smartthings oauth state of every tenant, according
+// to the configured token store type
+func tokenStoreFromConfig() (stoauth.TokenStore, error) {
+	switch storeType := viper.GetString("smartthings.token-store.type"); storeType {
+	case "", "file":
+		if err := checkRequiredFlags("smartthings.oauth-param-file"); err != nil {
+			return nil, err
+		}
+		return stoauth.NewFileStore(viper.GetString("smartthings.oauth-param-file")), nil
+
+	case "encrypted-file":
+		if err := checkRequiredFlags("smartthings.oauth-param-file"); err != nil {
+			return nil, err
+		}
+
+		var key []byte
+		var err error
+		switch {
+		case viper.GetString("smartthings.token-store.key-file") != "":
+			key, err = stoauth.KeyFromFile(viper.GetString("smartthings.token-store.key-file"))
+		case viper.GetString("smartthings.token-store.key-env") != "":
+			key, err = stoauth.KeyFromEnv(viper.GetString("smartthings.token-store.key-env"))
+		default:
+			err = fmt.Errorf("encrypted-file token store needs `smartthings.token-store.key-file` or `smartthings.token-store.key-env`")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return stoauth.NewEncryptedFileStore(viper.GetString("smartthings.oauth-param-file"), key)
+
+	case "bucket":
+		if err := checkRequiredFlags("google.storage.bucket"); err != nil {
+			return nil, err
+		}
+
+		store := stoauth.NewBucketStore(viper.GetString("google.storage.bucket"), viper.GetString("google.storage.object")).
+			WithServiceAccountCreds(viper.GetString("google.creds.file")).
+			WithEndpoint(viper.GetString("google.storage.endpoint"))
+		return store, nil
+
+	default:
+		return nil, fmt.Errorf("unknown token store type [%s], expected file, encrypted-file or bucket", storeType)
+	}
+}
+
+// Whether the Google access tokens of the tenants may be saved in the token
+// store, which is only safe if it is encrypted or the operator says so
+func googleTokensStorable() bool {
+	switch viper.GetString("smartthings.token-store.type") {
+	case "encrypted-file", "bucket":
+		return true
+	}
+
+	return viper.GetBool("smartthings.token-store.plaintext-google-tokens")
+}
+
 func errPanic(err error) {
 	if err != nil {
 		panic(err)
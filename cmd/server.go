@@ -10,13 +10,18 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/handlers"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/livestream"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
 	"github.com/jake-scott/smartthings-nest/pkg/middlewares"
 )
 
@@ -31,6 +36,8 @@ var _serverCmdOpts struct {
 	readTimeout             time.Duration
 	writeTimeout            time.Duration
 	googleapiTImeout        time.Duration
+	streamMaxDuration       time.Duration
+	sdmFixturesFile         string
 	logRequests             bool
 }
 
@@ -47,7 +54,7 @@ var serverCmd = &cobra.Command{
 	},
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		return checkRequiredFlags("https.key", "https.cert", "smartthings.oauth-param-file")
+		return checkRequiredFlags("https.key", "https.cert")
 	},
 }
 
@@ -59,6 +66,8 @@ func init() {
 	serverCmd.Flags().DurationVar(&_serverCmdOpts.readTimeout, "read-timeout", time.Second*15, "duration to wait for request read, eg. 1m or 10s")
 	serverCmd.Flags().DurationVar(&_serverCmdOpts.writeTimeout, "write-timeout", time.Second*60, "duration to wait for request write, eg. 1m or 10s")
 	serverCmd.Flags().DurationVar(&_serverCmdOpts.googleapiTImeout, "googleapi-timeout", time.Second*15, "maximum durarion of a Google API call, eg. 1m or 10s")
+	serverCmd.Flags().DurationVar(&_serverCmdOpts.streamMaxDuration, "stream-max-duration", time.Minute*30, "maximum duration of a camera live stream, eg. 30m, or 0 for no limit")
+	serverCmd.Flags().StringVar(&_serverCmdOpts.sdmFixturesFile, "sdm-fixtures", "", "use a simulated Smart Device Management API seeded from this JSON file, instead of Google")
 	serverCmd.Flags().BoolVar(&_serverCmdOpts.logRequests, "log-requests", false, "log requests and responses (only in debug mode)")
 	serverCmd.Flags().StringVar(&_serverCmdOpts.oauthCallbackStateFile, "oauth-state-file", "", "File to stash callback parameters")
 	serverCmd.Flags().StringVar(&_serverCmdOpts.smartthingsClientid, "smartthings-clientid", "", "oauth Client ID from Smartthings cloud connector 'App Credentials'")
@@ -71,14 +80,50 @@ func init() {
 	errPanic(viper.GetViper().BindPFlag("https.read-timeout", serverCmd.Flags().Lookup("read-timeout")))
 	errPanic(viper.GetViper().BindPFlag("https.write-timeout", serverCmd.Flags().Lookup("write-timeout")))
 	errPanic(viper.GetViper().BindPFlag("google.device-access.api-timeout", serverCmd.Flags().Lookup("googleapi-timeout")))
+	errPanic(viper.GetViper().BindPFlag("google.device-access.stream-max-duration", serverCmd.Flags().Lookup("stream-max-duration")))
+	errPanic(viper.GetViper().BindPFlag("google.device-access.fake-fixtures", serverCmd.Flags().Lookup("sdm-fixtures")))
 	errPanic(viper.GetViper().BindPFlag("logging.log-requests", serverCmd.Flags().Lookup("log-requests")))
 	errPanic(viper.GetViper().BindPFlag("smartthings.oauth-param-file", serverCmd.Flags().Lookup("oauth-state-file")))
 	errPanic(viper.GetViper().BindPFlag("smartthings.client-id", serverCmd.Flags().Lookup("smartthings-clientid")))
 	errPanic(viper.GetViper().BindPFlag("smartthings.client-secret", serverCmd.Flags().Lookup("smartthings-clientsecret")))
 
+	viper.SetDefault("smartthings.device-profiles.thermostat", discovery.StNestThermostatDeviceProfileID)
+	viper.SetDefault("smartthings.fan-timer.default-duration", sdmapi.DefaultFanTimerDuration)
+	viper.SetDefault("smartthings.command-cache.size", 1000)
+	viper.SetDefault("smartthings.command-cache.ttl", time.Minute*10)
+	viper.SetDefault("smartthings.signature.verify", true)
+	viper.SetDefault("smartthings.signature.key-url", "https://key.smartthings.com")
+	viper.SetDefault("smartthings.signature.key-cache-ttl", time.Hour*24)
+	viper.SetDefault("smartthings.signature.clock-skew", middlewares.DefaultSignatureClockSkew)
+
 	rootCmd.AddCommand(serverCmd)
 }
 
+// Build the middleware that verifies the signatures of Smartthings requests,
+// or nil if verification is disabled
+func signatureMwFromConfig() (mux.MiddlewareFunc, error) {
+	if !viper.GetBool("smartthings.signature.verify") {
+		return nil, nil
+	}
+
+	var keys middlewares.KeySource
+	if keyFile := viper.GetString("smartthings.signature.key-file"); keyFile != "" {
+		fileKeys, err := middlewares.NewFileKeySource(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = fileKeys
+	} else {
+		urlKeys, err := middlewares.NewURLKeySource(viper.GetString("smartthings.signature.key-url"), viper.GetDuration("smartthings.signature.key-cache-ttl"))
+		if err != nil {
+			return nil, err
+		}
+		keys = urlKeys
+	}
+
+	return middlewares.NewSignatureMw(keys, viper.GetDuration("smartthings.signature.clock-skew")), nil
+}
+
 func checkRequiredFlags(needFlags ...string) error {
 	missingFlags := []string{}
 
@@ -99,6 +144,107 @@ func checkRequiredFlags(needFlags ...string) error {
 	return nil
 }
 
+// Read the Smartthings device profile ID for each supported Google device type
+func deviceProfilesFromConfig() map[string]string {
+	deviceTypes := map[string]string{
+		"thermostat": sdmapi.DeviceTypeThermostat,
+		"camera":     sdmapi.DeviceTypeCamera,
+		"doorbell":   sdmapi.DeviceTypeDoorbell,
+		"display":    sdmapi.DeviceTypeDisplay,
+	}
+
+	profiles := make(map[string]string)
+	for name, deviceType := range deviceTypes {
+		if profileID := viper.GetString("smartthings.device-profiles." + name); profileID != "" {
+			profiles[deviceType] = profileID
+		}
+	}
+
+	return profiles
+}
+
+// Read the device mappings, followed by a mapping for each configured device
+// profile, and check that they are usable
+func deviceMappingsFromConfig() ([]discovery.Mapping, error) {
+	var mappings []discovery.Mapping
+	if err := viper.UnmarshalKey("smartthings.device-mappings", &mappings); err != nil {
+		return nil, errors.Wrap(err, "reading device mappings")
+	}
+
+	mappings = append(mappings, discovery.DefaultMappings(deviceProfilesFromConfig())...)
+
+	if err := discovery.ValidateMappings(mappings); err != nil {
+		return nil, err
+	}
+
+	return mappings, nil
+}
+
+// Read the filters that choose which devices are offered to Smartthings
+func deviceFiltersFromConfig() (discovery.Filters, error) {
+	var filters discovery.Filters
+	if err := viper.UnmarshalKey("smartthings.device-filters", &filters); err != nil {
+		return nil, errors.Wrap(err, "reading device filters")
+	}
+
+	if err := filters.Validate(); err != nil {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+// Read the fan timer durations, by device
+func fanTimerDurationsFromConfig() (sdmapi.FanTimerDurations, error) {
+	var devices []struct {
+		DeviceID string        `mapstructure:"device-id"`
+		Duration time.Duration `mapstructure:"duration"`
+	}
+	if err := viper.UnmarshalKey("smartthings.fan-timer.devices", &devices); err != nil {
+		return sdmapi.FanTimerDurations{}, errors.Wrap(err, "reading fan timer durations")
+	}
+
+	durations := sdmapi.FanTimerDurations{
+		Default: viper.GetDuration("smartthings.fan-timer.default-duration"),
+		Devices: make(map[string]time.Duration),
+	}
+	for _, d := range devices {
+		durations.Devices[d.DeviceID] = d.Duration
+	}
+
+	if err := durations.Validate(); err != nil {
+		return sdmapi.FanTimerDurations{}, err
+	}
+
+	return durations, nil
+}
+
+// Tell Smartthings that a camera's live stream has ended, when it ends without
+// a stopStream command
+func streamEndedCallback(tenants *stoauth.Tenants, tokens *stoauth.TokenManager) func(string) {
+	return func(deviceID string) {
+		tenantID, ok := tenants.ForEvent("", deviceID)
+		if !ok {
+			logging.Logger(nil).Warnf("no tenant for device %s, not sending end of live stream", deviceID)
+			return
+		}
+
+		deviceInfo := models.DeviceState{
+			ExternalDeviceID: deviceID,
+			States: []*models.DeviceStateStatesItems0{{
+				Component:  "main",
+				Capability: "st.videoStream",
+				Attribute:  "stream",
+				Value:      map[string]string{},
+			}},
+		}
+
+		if err := executeDeviceStateCallback(tokens, tenantID, deviceInfo); err != nil {
+			logging.Logger(nil).WithError(err).Errorf("executing Smartthings device callback for end of live stream for %s", deviceID)
+		}
+	}
+}
+
 func doServer() error {
 	wait := viper.GetDuration("https.graceful-timeout")
 	port := viper.GetUint("https.port")
@@ -106,7 +252,8 @@ func doServer() error {
 	keyFile := viper.GetString("https.key")
 	proj := viper.GetString("google.device-access.project")
 	apiTimeout := viper.GetDuration("google.device-access.api-timeout")
-	oauthFile := viper.GetString("smartthings.oauth-param-file")
+	streamMaxDuration := viper.GetDuration("google.device-access.stream-max-duration")
+	fixturesFile := viper.GetString("google.device-access.fake-fixtures")
 	stClientID := viper.GetString("smartthings.client-id")
 	stClientSecret := viper.GetString("smartthings.client-secret")
 
@@ -119,14 +266,91 @@ func doServer() error {
 		}
 	}
 
-	nh := handlers.NewNestHandler(sdmapi.NewLiveClient(proj).WithTimeout(apiTimeout), oauthFile, stClientID, stClientSecret)
+	temperatureScale, err := sdmapi.ParseTemperatureScale(viper.GetString("smartthings.temperature-scale"))
+	if err != nil {
+		return err
+	}
+
+	fanTimers, err := fanTimerDurationsFromConfig()
+	if err != nil {
+		return err
+	}
+
+	transport, err := googleTransport("sdm")
+	if err != nil {
+		return err
+	}
+
+	var sdmClient sdmapi.SmartDeviceManagement = sdmapi.NewLiveClient(proj).WithTransport(transport).WithTimeout(apiTimeout)
+	if fixturesFile != "" {
+		logging.Logger(nil).Warnf("Using simulated Smart Device Management API, seeded from %s", fixturesFile)
+
+		fake := sdmapi.NewFakeClient(proj).WithSimulation(1.0)
+		if err := fake.LoadFile(fixturesFile); err != nil {
+			return err
+		}
+		sdmClient = fake
+	}
+
+	mappings, err := deviceMappingsFromConfig()
+	if err != nil {
+		return err
+	}
+
+	filters, err := deviceFiltersFromConfig()
+	if err != nil {
+		return err
+	}
+
+	store, err := tokenStoreFromConfig()
+	if err != nil {
+		return err
+	}
+
+	tenants := stoauth.NewTenants(store).WithClientSecret(stClientSecret)
+	if err := tenants.Load(); err != nil {
+		return err
+	}
+
+	streams := livestream.NewManager().
+		WithMaxDuration(streamMaxDuration).
+		WithEndedFunc(streamEndedCallback(tenants, stoauth.NewTokenManager(tenants)))
+	defer streams.StopAll()
+
+	recordGoogleTokens := googleTokensStorable()
+	if !recordGoogleTokens {
+		logging.Logger(nil).Warn("Not saving Google access tokens in the plain text token store, the pubsub service won't find devices that are added or removed")
+	}
+
+	nh := handlers.NewNestHandler(sdmClient, tenants, stClientID, stClientSecret).
+		WithDeviceMappings(mappings).
+		WithDeviceFilters(filters).
+		WithStreamManager(streams).
+		WithCustomCapabilityNamespace(viper.GetString("smartthings.custom-capability-namespace")).
+		WithTemperatureScale(temperatureScale).
+		WithFanTimerDurations(fanTimers).
+		WithMaxConcurrency(viper.GetInt("google.device-access.max-concurrent-requests")).
+		WithCommandCache(viper.GetInt("smartthings.command-cache.size"), viper.GetDuration("smartthings.command-cache.ttl")).
+		WithGoogleTokenRecording(recordGoogleTokens)
 	oh := handlers.NewOauthHandler(proj)
 
+	signatureMw, err := signatureMwFromConfig()
+	if err != nil {
+		return err
+	}
+
+	var nestHandler http.Handler = &nh
+	if signatureMw != nil {
+		nestHandler = signatureMw(nestHandler)
+	} else {
+		logging.Logger(nil).Warn("Not verifying the signatures of Smartthings requests, smartthings.signature.verify is false")
+	}
+
 	r := mux.NewRouter()
 	r.Use(middlewares.NewLoggingMw(logRequests))
 	r.Use(middlewares.NewRecoveryMw())
 	r.Use(middlewares.NewCorrelationMw("X-Correlation-ID"))
-	r.Handle("/nest", &nh).Methods(http.MethodPost)
+	r.Handle("/nest", nestHandler).Methods(http.MethodPost)
 	r.Handle("/oauth", &oh).Methods(http.MethodGet)
 	r.PathPrefix("/").Handler(http.DefaultServeMux)
 
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+)
+
+var _tenantsCmdOpts struct {
+	oauthCallbackStateFile string
+}
+
+var tenantsCmd = &cobra.Command{
+	Use:   "tenants",
+	Short: "Manage the installations linked to the integration",
+}
+
+var tenantsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the linked installations",
+	Args:  cobra.NoArgs,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doTenantsList()
+	},
+
+	PreRunE: tenantsPreRun,
+}
+
+var tenantsRemoveCmd = &cobra.Command{
+	Use:   "remove TENANT-ID",
+	Short: "Remove a linked installation",
+	Args:  cobra.ExactArgs(1),
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doTenantsRemove(args[0])
+	},
+
+	PreRunE: tenantsPreRun,
+}
+
+func init() {
+	tenantsCmd.PersistentFlags().StringVar(&_tenantsCmdOpts.oauthCallbackStateFile, "oauth-state-file", "", "File to stash callback parameters")
+
+	tenantsCmd.AddCommand(tenantsListCmd)
+	tenantsCmd.AddCommand(tenantsRemoveCmd)
+	rootCmd.AddCommand(tenantsCmd)
+}
+
+// The flag is bound when the command runs, so that it doesn't replace the
+// binding of the same config item to the server and pubsub flags
+func tenantsPreRun(cmd *cobra.Command, args []string) error {
+	errPanic(viper.GetViper().BindPFlag("smartthings.oauth-param-file", tenantsCmd.PersistentFlags().Lookup("oauth-state-file")))
+
+	return nil
+}
+
+func loadTenants() (*stoauth.Tenants, error) {
+	store, err := tokenStoreFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := stoauth.NewTenants(store)
+	if err := tenants.Load(); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+func doTenantsList() error {
+	tenants, err := loadTenants()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tSTATUS\tUSERS\tDEVICES\tCALLBACK URL")
+	for _, tenant := range tenants.List() {
+		status := "linked"
+		if tenant.NeedsRelink {
+			status = "needs-relink"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", tenant.ID, status, strings.Join(tenant.UserIDs, ","), len(tenant.DeviceIDs), tenant.State.StateCallbackURL)
+	}
+
+	return w.Flush()
+}
+
+func doTenantsRemove(id string) error {
+	tenants, err := loadTenants()
+	if err != nil {
+		return err
+	}
+
+	if err := tenants.Remove(id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed tenant %s\n", id)
+	return nil
+}
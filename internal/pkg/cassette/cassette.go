@@ -0,0 +1,306 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Record and replay HTTP interactions with Google APIs.
+ *
+ * In record mode, every request and response passing through the transport
+ * is written to a cassette file on disk, with tokens redacted.  In replay mode,
+ * the recorded responses are served back without contacting the network, so
+ * that problems seen in production can be reproduced deterministically.
+ */
+
+type Mode int
+
+const (
+	ModeLive Mode = iota
+	ModeRecord
+	ModeReplay
+)
+
+// ParseMode converts a mode name from the config to a Mode
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "", "live":
+		return ModeLive, nil
+	case "record":
+		return ModeRecord, nil
+	case "replay":
+		return ModeReplay, nil
+	}
+
+	return ModeLive, fmt.Errorf("unknown HTTP mode [%s], expected live, record or replay", s)
+}
+
+const redacted = "REDACTED"
+
+// Headers that are never written to a cassette
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Goog-Api-Key"}
+
+// JSON fields and query parameters holding tokens
+var (
+	redactedJSONFields  = regexp.MustCompile(`("(?:access_?[tT]oken|refresh_?[tT]oken|id_?[tT]oken|stream[A-Za-z]*[tT]oken)"\s*:\s*")[^"]*(")`)
+	redactedQueryParams = regexp.MustCompile(`([?&](?:access_token|key)=)[^&]*`)
+	redactedStreamAuth  = regexp.MustCompile(`(\?auth=)[^"&]*`)
+)
+
+type recordedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	StatusCode int         `json:"status-code"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+type Interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Load reads a cassette from disk
+func Load(fileName string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading cassette %s", fileName)
+	}
+
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrapf(err, "decoding cassette %s", fileName)
+	}
+
+	return c, nil
+}
+
+// Save writes a cassette to disk
+func (c *Cassette) Save(fileName string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding cassette")
+	}
+
+	if err := ioutil.WriteFile(fileName, data, 0640); err != nil {
+		return errors.Wrapf(err, "writing cassette %s", fileName)
+	}
+
+	return nil
+}
+
+func redactString(s string) string {
+	s = redactedJSONFields.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	s = redactedQueryParams.ReplaceAllString(s, "${1}"+redacted)
+	s = redactedStreamAuth.ReplaceAllString(s, "${1}"+redacted)
+	return s
+}
+
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range redactedHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, redacted)
+		}
+	}
+
+	return out
+}
+
+// Read a body and replace it so that it can be read again
+func readBody(body *io.ReadCloser) (string, error) {
+	if *body == nil || *body == http.NoBody {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return "", err
+	}
+
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return string(data), nil
+}
+
+func newRecordedRequest(r *http.Request) (recordedRequest, error) {
+	body, err := readBody(&r.Body)
+	if err != nil {
+		return recordedRequest{}, errors.Wrap(err, "reading request body")
+	}
+
+	return recordedRequest{
+		Method:  r.Method,
+		URL:     redactString(r.URL.String()),
+		Headers: redactHeaders(r.Header),
+		Body:    redactString(body),
+	}, nil
+}
+
+func (r recordedRequest) matches(other recordedRequest) bool {
+	return r.Method == other.Method && r.URL == other.URL && r.Body == other.Body
+}
+
+/*
+ *  Recorder
+ */
+
+type Recorder struct {
+	base     http.RoundTripper
+	fileName string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a transport that passes requests to base (or the default
+// transport if nil) and writes every interaction to fileName
+func NewRecorder(fileName string, base http.RoundTripper) *Recorder {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Recorder{
+		base:     base,
+		fileName: fileName,
+	}
+}
+
+func (t *Recorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	req, err := newRecordedRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response body")
+	}
+
+	// Redaction may change the length of the body
+	headers := redactHeaders(resp.Header)
+	headers.Del("Content-Length")
+
+	interaction := Interaction{
+		Request: req,
+		Response: recordedResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    headers,
+			Body:       redactString(body),
+		},
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cassette.Interactions = append(t.cassette.Interactions, interaction)
+	if err := t.cassette.Save(t.fileName); err != nil {
+		logging.Logger(r.Context()).WithError(err).Warn("recording HTTP interaction")
+	}
+
+	return resp, nil
+}
+
+/*
+ *  Replayer
+ */
+
+type Replayer struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+// NewReplayer returns a transport that serves the responses recorded in
+// fileName.  Each recorded interaction is served once, in recording order.
+func NewReplayer(fileName string) (*Replayer, error) {
+	c, err := Load(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReplayerFromCassette(c), nil
+}
+
+func NewReplayerFromCassette(c *Cassette) *Replayer {
+	return &Replayer{
+		cassette: c,
+		used:     make([]bool, len(c.Interactions)),
+	}
+}
+
+func (t *Replayer) RoundTrip(r *http.Request) (*http.Response, error) {
+	req, err := newRecordedRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, interaction := range t.cassette.Interactions {
+		if t.used[i] || !interaction.Request.matches(req) {
+			continue
+		}
+
+		t.used[i] = true
+		logging.Logger(r.Context()).Debugf("replaying HTTP interaction %d: %s %s", i, req.Method, req.URL)
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Headers.Clone(),
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       r,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no recorded HTTP interaction for %s %s", req.Method, req.URL)
+}
+
+// NewTransport returns the transport for a mode, or nil in live mode
+func NewTransport(mode Mode, fileName string) (http.RoundTripper, error) {
+	switch mode {
+	case ModeRecord:
+		logging.Logger(nil).Warnf("Recording HTTP interactions to %s", fileName)
+		return NewRecorder(fileName, nil), nil
+	case ModeReplay:
+		logging.Logger(nil).Warnf("Replaying HTTP interactions from %s", fileName)
+		replayer, err := NewReplayer(fileName)
+		if err != nil {
+			return nil, err
+		}
+		return replayer, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,215 @@
+package cassette
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A base transport that answers every request with a function
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+const (
+	testCommandURL = "https://smartdevicemanagement.googleapis.com/v1/enterprises/project/devices/camera1:executeCommand"
+
+	testRequestBody  = `{"command": "sdm.devices.commands.CameraLiveStream.GenerateRtspStream", "refresh_token": "secret-refresh"}`
+	testResponseBody = `{"access_token": "secret-access", "results": {"streamUrls": {"rtspUrl": "rtsps://stream.example.com/camera1?auth=secret-auth"}, "streamToken": "secret-stream", "streamExtensionToken": "secret-extension"}}`
+)
+
+var testSecrets = []string{"secret-header", "secret-query", "secret-refresh", "secret-access", "secret-auth", "secret-stream", "secret-extension", "secret-cookie"}
+
+func newTestRequest(t *testing.T, url string, body string) *http.Request {
+	r, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer secret-header")
+	r.Header.Set("Content-Type", "application/json")
+
+	return r
+}
+
+func stubTransport(body string) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type":   {"application/json"},
+				"Content-Length": {"999"},
+				"Set-Cookie":     {"session=secret-cookie"},
+			},
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+			Request: r,
+		}, nil
+	}
+}
+
+func readResponse(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+
+	return string(data)
+}
+
+func TestRecorderRedactsTokens(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sdm.json")
+	recorder := NewRecorder(fileName, stubTransport(testResponseBody))
+
+	resp, err := recorder.RoundTrip(newTestRequest(t, testCommandURL+"?access_token=secret-query", testRequestBody))
+	if err != nil {
+		t.Fatalf("recording request: %v", err)
+	}
+
+	// The caller still gets the real response
+	if body := readResponse(t, resp); body != testResponseBody {
+		t.Errorf("got response %s, want the unredacted response", body)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("reading cassette: %v", err)
+	}
+	for _, secret := range testSecrets {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %s", secret)
+		}
+	}
+
+	c, err := Load(fileName)
+	if err != nil {
+		t.Fatalf("loading cassette: %v", err)
+	}
+	if len(c.Interactions) != 1 {
+		t.Fatalf("cassette has %d interactions, want 1", len(c.Interactions))
+	}
+
+	i := c.Interactions[0]
+	if i.Request.URL != testCommandURL+"?access_token="+redacted {
+		t.Errorf("recorded URL %s, want the access token redacted", i.Request.URL)
+	}
+	if i.Request.Headers.Get("Authorization") != redacted {
+		t.Errorf("recorded Authorization %q, want it redacted", i.Request.Headers.Get("Authorization"))
+	}
+	if i.Response.Headers.Get("Content-Length") != "" {
+		t.Error("recorded a Content-Length for the redacted body")
+	}
+	if !strings.Contains(i.Response.Body, "?auth="+redacted) || !strings.Contains(i.Response.Body, `"streamToken": "`+redacted+`"`) {
+		t.Errorf("recorded response %s, want the stream tokens redacted", i.Response.Body)
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "sdm.json")
+	recorder := NewRecorder(fileName, stubTransport(testResponseBody))
+
+	resp, err := recorder.RoundTrip(newTestRequest(t, testCommandURL, testRequestBody))
+	if err != nil {
+		t.Fatalf("recording request: %v", err)
+	}
+	readResponse(t, resp)
+
+	replayer, err := NewReplayer(fileName)
+	if err != nil {
+		t.Fatalf("loading cassette: %v", err)
+	}
+
+	// Tokens in the request differ between runs, and are redacted before
+	// matching
+	resp, err = replayer.RoundTrip(newTestRequest(t, testCommandURL, strings.Replace(testRequestBody, "secret-refresh", "another-refresh", 1)))
+	if err != nil {
+		t.Fatalf("replaying request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	if body := readResponse(t, resp); !strings.Contains(body, `"streamToken": "`+redacted+`"`) {
+		t.Errorf("got response %s, want the recorded response", body)
+	}
+}
+
+func testInteraction(method string, url string, status int, body string) Interaction {
+	return Interaction{
+		Request:  recordedRequest{Method: method, URL: url},
+		Response: recordedResponse{StatusCode: status, Body: body},
+	}
+}
+
+func TestReplayerServesInOrderOnce(t *testing.T) {
+	devicesURL := "https://smartdevicemanagement.googleapis.com/v1/enterprises/project/devices"
+	structuresURL := "https://smartdevicemanagement.googleapis.com/v1/enterprises/project/structures"
+
+	replayer := NewReplayerFromCassette(&Cassette{
+		Interactions: []Interaction{
+			testInteraction(http.MethodGet, devicesURL, http.StatusOK, `{"devices": [1]}`),
+			testInteraction(http.MethodGet, structuresURL, http.StatusOK, `{"structures": []}`),
+			testInteraction(http.MethodGet, devicesURL, http.StatusServiceUnavailable, `{"devices": [2]}`),
+		},
+	})
+
+	get := func(url string) (*http.Response, error) {
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("building request: %v", err)
+		}
+		return replayer.RoundTrip(r)
+	}
+
+	want := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{devicesURL, http.StatusOK, `{"devices": [1]}`},
+		{devicesURL, http.StatusServiceUnavailable, `{"devices": [2]}`},
+		{structuresURL, http.StatusOK, `{"structures": []}`},
+	}
+
+	for _, w := range want {
+		resp, err := get(w.url)
+		if err != nil {
+			t.Fatalf("replaying %s: %v", w.url, err)
+		}
+		if resp.StatusCode != w.status {
+			t.Errorf("%s: got status %d, want %d", w.url, resp.StatusCode, w.status)
+		}
+		if body := readResponse(t, resp); body != w.body {
+			t.Errorf("%s: got %s, want %s", w.url, body, w.body)
+		}
+	}
+
+	// Every interaction has been served
+	if _, err := get(devicesURL); err == nil || !strings.Contains(err.Error(), "no recorded HTTP interaction") {
+		t.Errorf("got error %v, want no recorded interaction", err)
+	}
+}
+
+func TestReplayerNoMatch(t *testing.T) {
+	replayer := NewReplayerFromCassette(&Cassette{
+		Interactions: []Interaction{
+			{
+				Request:  recordedRequest{Method: http.MethodPost, URL: testCommandURL, Body: `{"command": "a"}`},
+				Response: recordedResponse{StatusCode: http.StatusOK},
+			},
+		},
+	})
+
+	for _, r := range []*http.Request{
+		newTestRequest(t, testCommandURL, `{"command": "b"}`),
+		newTestRequest(t, testCommandURL+"x", `{"command": "a"}`),
+	} {
+		if _, err := replayer.RoundTrip(r); err == nil {
+			t.Errorf("replayed an unrecorded request to %s", r.URL)
+		}
+	}
+}
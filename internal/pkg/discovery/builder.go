@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"sync"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+/*
+ * Builder describes Nest devices to Smartthings, both in the web service's
+ * discovery responses and in the discovery callbacks that the pubsub service
+ * sends when devices are added.  The built in profile is used for
+ * thermostats unless device mappings or profiles are configured.
+ */
+
+const (
+	StNestThermostatDeviceProfileID string = "bd2e8c4a-0e4b-475f-b8ff-273fb5f5cef5"
+)
+
+// Model names reported to Smartthings for each Google device type
+var deviceModelNames = map[string]string{
+	sdmapi.DeviceTypeThermostat: "Nest Thermostat",
+	sdmapi.DeviceTypeCamera:     "Nest Cam",
+	sdmapi.DeviceTypeDoorbell:   "Nest Doorbell",
+	sdmapi.DeviceTypeDisplay:    "Nest Hub",
+}
+
+type Builder struct {
+	mappings []Mapping
+
+	// Devices whose profile migration has been logged
+	migrations sync.Map
+}
+
+// NewBuilder returns a builder that describes each Nest device using the
+// first of the mappings that matches it.  Devices that no mapping matches are
+// not offered to Smartthings.
+func NewBuilder(mappings []Mapping) *Builder {
+	return &Builder{
+		mappings: mappings,
+	}
+}
+
+// DefaultDeviceProfiles returns the device profiles used when none are
+// configured
+func DefaultDeviceProfiles() map[string]string {
+	return map[string]string{
+		sdmapi.DeviceTypeThermostat: StNestThermostatDeviceProfileID,
+	}
+}
+
+// Mapping returns the mapping that applies to a Nest device, or false if
+// there isn't one
+func (b *Builder) Mapping(nestDevice sdmapi.Device) (Mapping, bool) {
+	for _, m := range b.mappings {
+		if m.Matches(nestDevice) {
+			return m, true
+		}
+	}
+
+	return Mapping{}, false
+}
+
+// Device returns the Smartthings description of a Nest device, or false if
+// the device should not be offered to Smartthings.  The device is named after
+// its custom name or its room, and put in a group named after its home if
+// homes is set.
+func (b *Builder) Device(nestDevice sdmapi.Device, homes *Homes) (*models.Device, bool) {
+	m, ok := b.Mapping(nestDevice)
+	if !ok {
+		logging.Logger(nil).Warnf("Ignoring device %s, no Smartthings device mapping for type %s", nestDevice.ID, nestDevice.DeviceType)
+		return nil, false
+	}
+
+	manufacturer := m.manufacturer()
+	model := m.model(nestDevice.DeviceType)
+
+	stDevice := models.Device{
+		DeviceHandlerType: m.ProfileID,
+		DeviceUniqueID:    nestDevice.ID,
+		ExternalDeviceID:  nestDevice.ID,
+		ManufacturerInfo: &models.Manufacturer{
+			ManufacturerName: &manufacturer,
+			ModelName:        &model,
+		},
+		DeviceCookie: newDeviceCookie(m, nestDevice).Cookie(),
+	}
+
+	roomName, structureName := homes.location(nestDevice)
+
+	if info := nestDevice.Traits.Info(); info != nil && info.CustomName != "" {
+		stDevice.FriendlyName = truncateName(info.CustomName)
+	} else {
+		stDevice.FriendlyName = roomName
+	}
+
+	if roomName != "" {
+		groups := []string{}
+		if structureName != "" {
+			groups = append(groups, structureName)
+		}
+
+		stDevice.DeviceContext = &models.DeviceContext{
+			RoomName:   &roomName,
+			Groups:     groups,
+			Categories: []string{},
+		}
+	}
+
+	return &stDevice, true
+}
+
+// Devices returns the Smartthings description of the Nest devices that
+// should be offered to Smartthings
+func (b *Builder) Devices(nestDevices []sdmapi.Device, homes *Homes) []*models.Device {
+	var stDevices []*models.Device
+	for _, nestDevice := range nestDevices {
+		if stDevice, ok := b.Device(nestDevice, homes); ok {
+			stDevices = append(stDevices, stDevice)
+		}
+	}
+
+	return stDevices
+}
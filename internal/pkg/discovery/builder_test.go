@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+const (
+	testProfileID      = "11111111-2222-3333-4444-555555555555"
+	testOtherProfileID = "66666666-7777-8888-9999-000000000000"
+
+	testStructure = "enterprises/my-project-id/structures/home"
+	testRoom      = testStructure + "/rooms/hallway"
+)
+
+// A device in the hallway of the test home, with the given traits
+func newTestDevice(t *testing.T, id string, deviceType string, traits string) sdmapi.Device {
+	t.Helper()
+
+	nestDevice := sdmapi.Device{
+		ID:              id,
+		DeviceType:      deviceType,
+		Traits:          sdmapi.NewTraits(),
+		ParentRelations: []sdmapi.ParentRelation{{Parent: testRoom, DisplayName: "Hallway"}},
+	}
+
+	if err := nestDevice.Traits.Parse([]byte(traits)); err != nil {
+		t.Fatalf("parsing traits of %s: %v", id, err)
+	}
+
+	return nestDevice
+}
+
+func newTestHomes() *Homes {
+	return &Homes{structureNames: map[string]string{testStructure: "Home"}}
+}
+
+func TestBuilderDevice(t *testing.T) {
+	named := newTestDevice(t, "thermostat1", sdmapi.DeviceTypeThermostat, `{"sdm.devices.traits.Info": {"customName": "Living room"}}`)
+	unnamed := newTestDevice(t, "thermostat2", sdmapi.DeviceTypeThermostat, `{}`)
+	camera := newTestDevice(t, "camera1", sdmapi.DeviceTypeCamera, `{}`)
+
+	thermostats := Mapping{Name: "thermostats", Match: Match{DeviceType: sdmapi.DeviceTypeThermostat}, ProfileID: testProfileID}
+	branded := Mapping{Name: "branded", ProfileID: testOtherProfileID, Manufacturer: "Acme", Model: "Thermo"}
+
+	tests := []struct {
+		name     string
+		mappings []Mapping
+		device   sdmapi.Device
+		homes    *Homes
+
+		wantOK      bool
+		wantName    string
+		wantProfile string
+		wantModel   string
+		wantMaker   string
+		wantGroups  []string
+		wantMapping string
+	}{
+		{
+			name: "custom name", mappings: []Mapping{thermostats}, device: named, homes: newTestHomes(),
+			wantOK: true, wantName: "Living room", wantProfile: testProfileID, wantModel: "Nest Thermostat", wantMaker: "Google",
+			wantGroups: []string{"Home"}, wantMapping: "thermostats",
+		},
+		{
+			name: "named after its room", mappings: []Mapping{thermostats}, device: unnamed, homes: newTestHomes(),
+			wantOK: true, wantName: "Hallway", wantProfile: testProfileID, wantModel: "Nest Thermostat", wantMaker: "Google",
+			wantGroups: []string{"Home"}, wantMapping: "thermostats",
+		},
+		{
+			name: "without homes", mappings: []Mapping{thermostats}, device: named,
+			wantOK: true, wantName: "Living room", wantProfile: testProfileID, wantModel: "Nest Thermostat", wantMaker: "Google",
+			wantGroups: []string{}, wantMapping: "thermostats",
+		},
+		{
+			name: "first matching mapping", mappings: []Mapping{thermostats, branded}, device: named, homes: newTestHomes(),
+			wantOK: true, wantName: "Living room", wantProfile: testProfileID, wantModel: "Nest Thermostat", wantMaker: "Google",
+			wantGroups: []string{"Home"}, wantMapping: "thermostats",
+		},
+		{
+			name: "manufacturer and model", mappings: []Mapping{branded}, device: named, homes: newTestHomes(),
+			wantOK: true, wantName: "Living room", wantProfile: testOtherProfileID, wantModel: "Thermo", wantMaker: "Acme",
+			wantGroups: []string{"Home"}, wantMapping: "branded",
+		},
+		{
+			name: "no mapping", mappings: []Mapping{thermostats}, device: camera, homes: newTestHomes(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stDevice, ok := NewBuilder(tt.mappings).Device(tt.device, tt.homes)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %t, want %t", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			if stDevice.ExternalDeviceID != tt.device.ID || stDevice.DeviceUniqueID != tt.device.ID {
+				t.Errorf("got device IDs %s and %s, want %s", stDevice.ExternalDeviceID, stDevice.DeviceUniqueID, tt.device.ID)
+			}
+			if stDevice.FriendlyName != tt.wantName {
+				t.Errorf("got name %q, want %q", stDevice.FriendlyName, tt.wantName)
+			}
+			if stDevice.DeviceHandlerType != tt.wantProfile {
+				t.Errorf("got profile %s, want %s", stDevice.DeviceHandlerType, tt.wantProfile)
+			}
+			if *stDevice.ManufacturerInfo.ManufacturerName != tt.wantMaker || *stDevice.ManufacturerInfo.ModelName != tt.wantModel {
+				t.Errorf("got %s %s, want %s %s", *stDevice.ManufacturerInfo.ManufacturerName, *stDevice.ManufacturerInfo.ModelName, tt.wantMaker, tt.wantModel)
+			}
+
+			if stDevice.DeviceContext == nil || *stDevice.DeviceContext.RoomName != "Hallway" {
+				t.Errorf("got context %+v, want the hallway", stDevice.DeviceContext)
+			} else if !sameStrings(stDevice.DeviceContext.Groups, tt.wantGroups) {
+				t.Errorf("got groups %v, want %v", stDevice.DeviceContext.Groups, tt.wantGroups)
+			}
+
+			cookie, ok := ParseCookie(stDevice.DeviceCookie)
+			if !ok || cookie.Mapping != tt.wantMapping || cookie.ProfileID != tt.wantProfile || cookie.Structure != "home" {
+				t.Errorf("got cookie %+v, want mapping %s with profile %s in home", cookie, tt.wantMapping, tt.wantProfile)
+			}
+		})
+	}
+}
+
+func TestBuilderDevices(t *testing.T) {
+	nestDevices := []sdmapi.Device{
+		newTestDevice(t, "thermostat1", sdmapi.DeviceTypeThermostat, `{}`),
+		newTestDevice(t, "camera1", sdmapi.DeviceTypeCamera, `{}`),
+		newTestDevice(t, "thermostat2", sdmapi.DeviceTypeThermostat, `{}`),
+	}
+
+	b := NewBuilder(DefaultMappings(DefaultDeviceProfiles()))
+	stDevices := b.Devices(nestDevices, nil)
+
+	var ids []string
+	for _, stDevice := range stDevices {
+		ids = append(ids, stDevice.ExternalDeviceID)
+	}
+	if !sameStrings(ids, []string{"thermostat1", "thermostat2"}) {
+		t.Errorf("got devices %v, want only the thermostats", ids)
+	}
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
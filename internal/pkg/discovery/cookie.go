@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"path"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+/*
+ * Smartthings keeps the cookie that is sent with a device at discovery, and
+ * sends it back with every state refresh and command for the device.  The
+ * cookie records the mapping and device profile the device was discovered
+ * with, so that a device whose mapping has since changed is still described
+ * by the profile that Smartthings has for it, until it is discovered again.
+ */
+
+// Version of the cookie contents, changed when they change incompatibly
+const CookieVersion = "1"
+
+const (
+	cookieVersionKey   = "version"
+	cookieMappingKey   = "mapping"
+	cookieProfileKey   = "profile-id"
+	cookieStructureKey = "structure"
+)
+
+type DeviceCookie struct {
+	Version string
+
+	// The name of the mapping, and the device profile, used at discovery
+	Mapping   string
+	ProfileID string
+
+	// ID of the Nest structure the device was in
+	Structure string
+}
+
+func newDeviceCookie(m Mapping, nestDevice sdmapi.Device) DeviceCookie {
+	c := DeviceCookie{
+		Version:   CookieVersion,
+		Mapping:   m.Name,
+		ProfileID: m.ProfileID,
+	}
+
+	if len(nestDevice.ParentRelations) > 0 {
+		c.Structure = path.Base(nestDevice.ParentRelations[0].StructureID())
+	}
+
+	return c
+}
+
+// Cookie returns the cookie as sent to Smartthings
+func (c DeviceCookie) Cookie() models.Cookie {
+	cookie := models.Cookie{
+		cookieVersionKey: c.Version,
+		cookieMappingKey: c.Mapping,
+		cookieProfileKey: c.ProfileID,
+	}
+
+	if c.Structure != "" {
+		cookie[cookieStructureKey] = c.Structure
+	}
+
+	return cookie
+}
+
+// ParseCookie reads a cookie sent by Smartthings, or returns false if there
+// is no cookie or it has another version
+func ParseCookie(cookie models.Cookie) (DeviceCookie, bool) {
+	if cookie[cookieVersionKey] != CookieVersion {
+		return DeviceCookie{}, false
+	}
+
+	return DeviceCookie{
+		Version:   cookie[cookieVersionKey],
+		Mapping:   cookie[cookieMappingKey],
+		ProfileID: cookie[cookieProfileKey],
+		Structure: cookie[cookieStructureKey],
+	}, true
+}
+
+// Cookie returns the cookie for a device discovered now, or false if no
+// mapping applies to it
+func (b *Builder) Cookie(nestDevice sdmapi.Device) (models.Cookie, bool) {
+	m, ok := b.Mapping(nestDevice)
+	if !ok {
+		return nil, false
+	}
+
+	return newDeviceCookie(m, nestDevice).Cookie(), true
+}
+
+// DiscoveredMapping returns the mapping that a device was discovered with,
+// according to its cookie, or the mapping that applies to it now if there is
+// no usable cookie.  A device whose profile has changed keeps the profile it
+// was discovered with in Smartthings until it is discovered again.
+func (b *Builder) DiscoveredMapping(nestDevice sdmapi.Device, cookie models.Cookie) (Mapping, bool) {
+	current, ok := b.Mapping(nestDevice)
+
+	c, found := ParseCookie(cookie)
+	if !found || (ok && current.ProfileID == c.ProfileID) {
+		return current, ok
+	}
+
+	if _, logged := b.migrations.LoadOrStore(nestDevice.ID, true); !logged {
+		if ok {
+			logging.Logger(nil).Warnf("Device %s was discovered with mapping %s (profile %s) and now maps to %s (profile %s), it keeps its profile until it is discovered again",
+				nestDevice.ID, c.Mapping, c.ProfileID, current.Name, current.ProfileID)
+		} else {
+			logging.Logger(nil).Warnf("Device %s was discovered with mapping %s (profile %s) and no longer has a mapping", nestDevice.ID, c.Mapping, c.ProfileID)
+		}
+	}
+
+	// Prefer the mapping of the same name, in case several use the profile
+	var discovered *Mapping
+	for i, m := range b.mappings {
+		if m.ProfileID == c.ProfileID && (discovered == nil || m.Name == c.Mapping) {
+			discovered = &b.mappings[i]
+		}
+	}
+	if discovered != nil {
+		return *discovered, true
+	}
+
+	// The mapping is gone, so only the profile is known
+	return Mapping{Name: c.Mapping, ProfileID: c.ProfileID}, true
+}
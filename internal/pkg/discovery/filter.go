@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"path"
+	"strings"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Filters choose which Nest devices are offered to Smartthings, so that eg.
+ * the devices of a holiday home can be kept out.  The first filter that
+ * matches a device decides whether it is included or excluded.  Devices that
+ * no filter matches are included, unless the tenant has an include filter.
+ */
+
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+)
+
+type Filter struct {
+	// The tenant the filter applies to, or every tenant if empty
+	Tenant string `mapstructure:"tenant"`
+
+	// include or exclude
+	Action string `mapstructure:"action"`
+
+	// Every criterion that is set must match
+	DeviceType string `mapstructure:"device-type"`
+	DeviceID   string `mapstructure:"device-id"`
+
+	// Shell pattern matched against the custom name of the device
+	CustomName string `mapstructure:"custom-name"`
+
+	// Name or ID of the structure or room that the device is in
+	Structure string `mapstructure:"structure"`
+	Room      string `mapstructure:"room"`
+}
+
+type Filters []Filter
+
+// Validate checks that a filter can be used
+func (f Filter) Validate() error {
+	if f.Action != FilterInclude && f.Action != FilterExclude {
+		return errors.Errorf("device filter: action must be %s or %s, not %q", FilterInclude, FilterExclude, f.Action)
+	}
+
+	if f.DeviceType == "" && f.DeviceID == "" && f.CustomName == "" && f.Structure == "" && f.Room == "" {
+		return errors.New("device filter: needs at least one of device-type, device-id, custom-name, structure or room")
+	}
+
+	if f.DeviceType != "" && !strings.HasPrefix(f.DeviceType, "sdm.devices.types.") {
+		return errors.Errorf("device filter: invalid device-type %q", f.DeviceType)
+	}
+
+	if _, err := path.Match(f.CustomName, ""); err != nil {
+		return errors.Wrapf(err, "device filter: invalid custom-name pattern %q", f.CustomName)
+	}
+
+	return nil
+}
+
+// Validate checks every filter
+func (filters Filters) Validate() error {
+	for _, f := range filters {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A name matches a resource if it is the custom name, the full resource name
+// or its last element
+func matchesResource(name string, resourceName string, customName string) bool {
+	return name == customName || name == resourceName || name == path.Base(resourceName)
+}
+
+func (f Filter) matches(nestDevice sdmapi.Device, homes *Homes) bool {
+	if f.DeviceType != "" && f.DeviceType != nestDevice.DeviceType {
+		return false
+	}
+
+	if f.DeviceID != "" && f.DeviceID != nestDevice.ID {
+		return false
+	}
+
+	if f.CustomName != "" {
+		var customName string
+		if info := nestDevice.Traits.Info(); info != nil {
+			customName = info.CustomName
+		}
+
+		if ok, _ := path.Match(f.CustomName, customName); !ok {
+			return false
+		}
+	}
+
+	if f.Structure != "" {
+		found := false
+		for _, r := range nestDevice.ParentRelations {
+			structureID := r.StructureID()
+			if matchesResource(f.Structure, structureID, homes.StructureName(structureID)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Room != "" {
+		found := false
+		for _, r := range nestDevice.ParentRelations {
+			if r.IsRoom() && matchesResource(f.Room, r.Parent, r.DisplayName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Allows tells whether a device of a tenant is offered to Smartthings.
+// Filters on structure names need homes.
+func (filters Filters) Allows(tenantID string, nestDevice sdmapi.Device, homes *Homes) bool {
+	hasInclude := false
+
+	for _, f := range filters {
+		if f.Tenant != "" && f.Tenant != tenantID {
+			continue
+		}
+
+		if f.matches(nestDevice, homes) {
+			return f.Action == FilterInclude
+		}
+
+		if f.Action == FilterInclude {
+			hasInclude = true
+		}
+	}
+
+	return !hasInclude
+}
+
+// Split returns the devices of a tenant that are offered to Smartthings, and
+// the IDs of the devices that are excluded
+func (filters Filters) Split(tenantID string, nestDevices []sdmapi.Device, homes *Homes) ([]sdmapi.Device, []string) {
+	var allowed []sdmapi.Device
+	var excluded []string
+
+	for _, nestDevice := range nestDevices {
+		if filters.Allows(tenantID, nestDevice, homes) {
+			allowed = append(allowed, nestDevice)
+		} else {
+			excluded = append(excluded, nestDevice.ID)
+		}
+	}
+
+	return allowed, excluded
+}
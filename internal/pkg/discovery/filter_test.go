@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		wantErr bool
+	}{
+		{name: "include", filter: Filter{Action: FilterInclude, DeviceID: "thermostat1"}},
+		{name: "exclude", filter: Filter{Action: FilterExclude, Structure: "Holiday Cottage"}},
+		{name: "no action", filter: Filter{DeviceID: "thermostat1"}, wantErr: true},
+		{name: "other action", filter: Filter{Action: "ignore", DeviceID: "thermostat1"}, wantErr: true},
+		{name: "no criteria", filter: Filter{Action: FilterExclude, Tenant: "home"}, wantErr: true},
+		{name: "invalid device type", filter: Filter{Action: FilterExclude, DeviceType: "CAMERA"}, wantErr: true},
+		{name: "invalid pattern", filter: Filter{Action: FilterExclude, CustomName: "[a"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFiltersAllows(t *testing.T) {
+	thermostat := newTestDevice(t, "thermostat1", sdmapi.DeviceTypeThermostat, `{"sdm.devices.traits.Info": {"customName": "Upstairs"}}`)
+	camera := newTestDevice(t, "camera1", sdmapi.DeviceTypeCamera, `{}`)
+
+	tests := []struct {
+		name    string
+		filters Filters
+		tenant  string
+		device  sdmapi.Device
+		homes   *Homes
+		want    bool
+	}{
+		{name: "no filters", device: thermostat, want: true},
+		{
+			name:    "excluded by ID",
+			filters: Filters{{Action: FilterExclude, DeviceID: "thermostat1"}},
+			device:  thermostat,
+		},
+		{
+			name:    "not excluded",
+			filters: Filters{{Action: FilterExclude, DeviceID: "thermostat1"}},
+			device:  camera,
+			want:    true,
+		},
+		{
+			name:    "included by type",
+			filters: Filters{{Action: FilterInclude, DeviceType: sdmapi.DeviceTypeThermostat}},
+			device:  thermostat,
+			want:    true,
+		},
+		{
+			name:    "not included",
+			filters: Filters{{Action: FilterInclude, DeviceType: sdmapi.DeviceTypeThermostat}},
+			device:  camera,
+		},
+		{
+			name:    "excluded by custom name",
+			filters: Filters{{Action: FilterExclude, CustomName: "Up*"}},
+			device:  thermostat,
+		},
+		{
+			name:    "excluded by home name",
+			filters: Filters{{Action: FilterExclude, Structure: "Home"}},
+			device:  thermostat,
+			homes:   newTestHomes(),
+		},
+		{
+			name:    "home name needs homes",
+			filters: Filters{{Action: FilterExclude, Structure: "Home"}},
+			device:  thermostat,
+			want:    true,
+		},
+		{
+			name:    "excluded by home ID",
+			filters: Filters{{Action: FilterExclude, Structure: "home"}},
+			device:  thermostat,
+		},
+		{
+			name:    "excluded by room name",
+			filters: Filters{{Action: FilterExclude, Room: "Hallway"}},
+			device:  thermostat,
+		},
+		{
+			name:    "other room",
+			filters: Filters{{Action: FilterExclude, Room: "Kitchen"}},
+			device:  thermostat,
+			want:    true,
+		},
+		{
+			name:    "every criterion must match",
+			filters: Filters{{Action: FilterExclude, DeviceType: sdmapi.DeviceTypeCamera, Room: "Hallway"}},
+			device:  thermostat,
+			want:    true,
+		},
+		{
+			name: "first match decides",
+			filters: Filters{
+				{Action: FilterInclude, DeviceID: "thermostat1"},
+				{Action: FilterExclude, Room: "Hallway"},
+			},
+			device: thermostat,
+			want:   true,
+		},
+		{
+			name:    "filter of the tenant",
+			filters: Filters{{Tenant: "home", Action: FilterExclude, DeviceID: "thermostat1"}},
+			tenant:  "home",
+			device:  thermostat,
+		},
+		{
+			name:    "filter of another tenant",
+			filters: Filters{{Tenant: "cottage", Action: FilterExclude, DeviceID: "thermostat1"}},
+			tenant:  "home",
+			device:  thermostat,
+			want:    true,
+		},
+		{
+			name:    "include filter of another tenant",
+			filters: Filters{{Tenant: "cottage", Action: FilterInclude, DeviceID: "camera1"}},
+			tenant:  "home",
+			device:  thermostat,
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filters.Allows(tt.tenant, tt.device, tt.homes); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFiltersSplit(t *testing.T) {
+	nestDevices := []sdmapi.Device{
+		newTestDevice(t, "thermostat1", sdmapi.DeviceTypeThermostat, `{}`),
+		newTestDevice(t, "camera1", sdmapi.DeviceTypeCamera, `{}`),
+		newTestDevice(t, "camera2", sdmapi.DeviceTypeCamera, `{}`),
+	}
+	filters := Filters{{Action: FilterExclude, DeviceType: sdmapi.DeviceTypeCamera}}
+
+	allowed, excluded := filters.Split("home", nestDevices, nil)
+
+	if len(allowed) != 1 || allowed[0].ID != "thermostat1" {
+		t.Errorf("got %d allowed devices, want only thermostat1", len(allowed))
+	}
+	if !sameStrings(excluded, []string{"camera1", "camera2"}) {
+		t.Errorf("got excluded devices %v, want the cameras", excluded)
+	}
+}
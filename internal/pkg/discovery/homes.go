@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Homes holds the names of the Nest structures, so that devices can be put
+ * into a group named after the home they are in.  The room names come with
+ * each device, in its parent relations.
+ */
+
+// Smartthings limits names to 100 characters
+const maxNameLength = 100
+
+type Homes struct {
+	structureNames map[string]string
+}
+
+// LoadHomes fetches the names of the structures the client can see
+func LoadHomes(c sdmapi.SmartDeviceManagement) (*Homes, error) {
+	structures, err := c.Structures()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading homes")
+	}
+
+	h := &Homes{
+		structureNames: make(map[string]string),
+	}
+	for _, s := range structures {
+		if s.CustomName != "" {
+			h.structureNames[s.ID] = s.CustomName
+		}
+	}
+
+	return h, nil
+}
+
+// StructureName returns the name of a structure, or an empty string if it
+// isn't known
+func (h *Homes) StructureName(structureID string) string {
+	if h == nil {
+		return ""
+	}
+
+	return h.structureNames[structureID]
+}
+
+// The room that a device is in, and the name of its structure
+func (h *Homes) location(nestDevice sdmapi.Device) (roomName string, structureName string) {
+	for _, r := range nestDevice.ParentRelations {
+		if r.IsRoom() && roomName == "" {
+			roomName = r.DisplayName
+		}
+
+		if structureName == "" {
+			structureName = h.StructureName(r.StructureID())
+		}
+	}
+
+	return truncateName(roomName), truncateName(structureName)
+}
+
+func truncateName(name string) string {
+	runes := []rune(name)
+	if len(runes) > maxNameLength {
+		return string(runes[:maxNameLength])
+	}
+
+	return name
+}
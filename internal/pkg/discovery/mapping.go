@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/pkg/errors"
+)
+
+/*
+ * A Mapping chooses how a Nest device is described to Smartthings : the
+ * device profile, the manufacturer and model names, and which capabilities'
+ * states are sent.  The first mapping that matches a device is used.
+ */
+
+const defaultManufacturer = "Google"
+
+// Which devices a mapping applies to.  Every criterion that is set must match.
+type Match struct {
+	// The Google device type, eg. sdm.devices.types.THERMOSTAT
+	DeviceType string `mapstructure:"device-type"`
+
+	// SDM traits that the device must have, eg. sdm.devices.traits.Fan
+	Traits []string `mapstructure:"traits"`
+
+	// SDM traits that the device must not have
+	MissingTraits []string `mapstructure:"missing-traits"`
+
+	// Shell pattern matched against the custom name of the device
+	CustomName string `mapstructure:"custom-name"`
+}
+
+type Mapping struct {
+	Name  string `mapstructure:"name"`
+	Match Match  `mapstructure:"match"`
+
+	ProfileID    string `mapstructure:"profile-id"`
+	Manufacturer string `mapstructure:"manufacturer"`
+	Model        string `mapstructure:"model"`
+
+	// Capabilities whose states are sent to Smartthings, eg. thermostatMode
+	// or yournamespace.ecoMode, or empty to send every state.  Capabilities
+	// without a namespace are in the st namespace.
+	Capabilities []string `mapstructure:"capabilities"`
+}
+
+// DefaultMappings returns a mapping for each Google device type that has a
+// device profile, using the default manufacturer and model names
+func DefaultMappings(deviceProfiles map[string]string) []Mapping {
+	mappings := make([]Mapping, 0, len(deviceProfiles))
+	for deviceType, profileID := range deviceProfiles {
+		mappings = append(mappings, Mapping{
+			Name:      deviceType,
+			Match:     Match{DeviceType: deviceType},
+			ProfileID: profileID,
+		})
+	}
+
+	return mappings
+}
+
+// Validate checks that a mapping can be used
+func (m Mapping) Validate() error {
+	if _, err := uuid.Parse(m.ProfileID); err != nil {
+		return errors.Wrapf(err, "device mapping %s: invalid profile-id %q", m.Name, m.ProfileID)
+	}
+
+	if m.Match.DeviceType != "" && !strings.HasPrefix(m.Match.DeviceType, "sdm.devices.types.") {
+		return errors.Errorf("device mapping %s: invalid device-type %q", m.Name, m.Match.DeviceType)
+	}
+
+	for _, trait := range append(m.Match.Traits, m.Match.MissingTraits...) {
+		if !strings.HasPrefix(trait, "sdm.devices.traits.") {
+			return errors.Errorf("device mapping %s: invalid trait %q", m.Name, trait)
+		}
+	}
+
+	if _, err := path.Match(m.Match.CustomName, ""); err != nil {
+		return errors.Wrapf(err, "device mapping %s: invalid custom-name pattern %q", m.Name, m.Match.CustomName)
+	}
+
+	for _, capability := range m.Capabilities {
+		if capability == "" || strings.HasPrefix(capability, ".") || strings.HasSuffix(capability, ".") {
+			return errors.Errorf("device mapping %s: invalid capability %q", m.Name, capability)
+		}
+	}
+
+	return nil
+}
+
+// ValidateMappings checks a list of mappings, naming any that are unnamed
+func ValidateMappings(mappings []Mapping) error {
+	for i := range mappings {
+		if mappings[i].Name == "" {
+			mappings[i].Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if err := mappings[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Matches tells whether a mapping applies to a Nest device
+func (m Mapping) Matches(nestDevice sdmapi.Device) bool {
+	if m.Match.DeviceType != "" && m.Match.DeviceType != nestDevice.DeviceType {
+		return false
+	}
+
+	for _, trait := range m.Match.Traits {
+		if !nestDevice.Traits.HasTrait(trait) {
+			return false
+		}
+	}
+
+	for _, trait := range m.Match.MissingTraits {
+		if nestDevice.Traits.HasTrait(trait) {
+			return false
+		}
+	}
+
+	if m.Match.CustomName != "" {
+		var customName string
+		if info := nestDevice.Traits.Info(); info != nil {
+			customName = info.CustomName
+		}
+
+		if ok, _ := path.Match(m.Match.CustomName, customName); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m Mapping) manufacturer() string {
+	if m.Manufacturer != "" {
+		return m.Manufacturer
+	}
+
+	return defaultManufacturer
+}
+
+func (m Mapping) model(deviceType string) string {
+	if m.Model != "" {
+		return m.Model
+	}
+
+	if model, ok := deviceModelNames[deviceType]; ok {
+		return model
+	}
+
+	return "Nest Device"
+}
+
+// FilterStates drops the states of capabilities that the mapping doesn't
+// expose.  The health check is always kept, as every device profile has it.
+func (m Mapping) FilterStates(states []*models.DeviceStateStatesItems0) []*models.DeviceStateStatesItems0 {
+	if len(m.Capabilities) == 0 {
+		return states
+	}
+
+	exposed := make(map[string]bool)
+	for _, capability := range m.Capabilities {
+		if !strings.Contains(capability, ".") {
+			capability = "st." + capability
+		}
+		exposed[strings.ToLower(capability)] = true
+	}
+
+	filtered := make([]*models.DeviceStateStatesItems0, 0, len(states))
+	for _, state := range states {
+		capability := strings.ToLower(state.Capability)
+		if capability == "st.healthcheck" || exposed[capability] {
+			filtered = append(filtered, state)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+func TestMappingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping Mapping
+		wantErr bool
+	}{
+		{name: "profile only", mapping: Mapping{ProfileID: testProfileID}},
+		{
+			name: "every criterion",
+			mapping: Mapping{
+				ProfileID: testProfileID,
+				Match: Match{
+					DeviceType:    sdmapi.DeviceTypeThermostat,
+					Traits:        []string{"sdm.devices.traits.Fan"},
+					MissingTraits: []string{"sdm.devices.traits.ThermostatEco"},
+					CustomName:    "Upstairs*",
+				},
+				Capabilities: []string{"thermostatMode", "yournamespace.ecoMode"},
+			},
+		},
+		{name: "invalid profile", mapping: Mapping{ProfileID: "thermostat"}, wantErr: true},
+		{name: "invalid device type", mapping: Mapping{ProfileID: testProfileID, Match: Match{DeviceType: "THERMOSTAT"}}, wantErr: true},
+		{name: "invalid trait", mapping: Mapping{ProfileID: testProfileID, Match: Match{Traits: []string{"Fan"}}}, wantErr: true},
+		{name: "invalid missing trait", mapping: Mapping{ProfileID: testProfileID, Match: Match{MissingTraits: []string{"Fan"}}}, wantErr: true},
+		{name: "invalid pattern", mapping: Mapping{ProfileID: testProfileID, Match: Match{CustomName: "[a"}}, wantErr: true},
+		{name: "empty capability", mapping: Mapping{ProfileID: testProfileID, Capabilities: []string{""}}, wantErr: true},
+		{name: "capability without a name", mapping: Mapping{ProfileID: testProfileID, Capabilities: []string{"yournamespace."}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.mapping.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMappingsNamesMappings(t *testing.T) {
+	mappings := []Mapping{{Name: "thermostats", ProfileID: testProfileID}, {ProfileID: testProfileID}}
+
+	if err := ValidateMappings(mappings); err != nil {
+		t.Fatalf("validating mappings: %v", err)
+	}
+	if mappings[0].Name != "thermostats" || mappings[1].Name != "#2" {
+		t.Errorf("got names %s and %s, want thermostats and #2", mappings[0].Name, mappings[1].Name)
+	}
+}
+
+func TestMappingMatches(t *testing.T) {
+	fan := newTestDevice(t, "thermostat1", sdmapi.DeviceTypeThermostat, `{
+		"sdm.devices.traits.Info": {"customName": "Upstairs landing"},
+		"sdm.devices.traits.Fan": {"timerMode": "OFF"}
+	}`)
+	plain := newTestDevice(t, "thermostat2", sdmapi.DeviceTypeThermostat, `{}`)
+	camera := newTestDevice(t, "camera1", sdmapi.DeviceTypeCamera, `{}`)
+
+	tests := []struct {
+		name   string
+		match  Match
+		device sdmapi.Device
+		want   bool
+	}{
+		{name: "everything", device: camera, want: true},
+		{name: "device type", match: Match{DeviceType: sdmapi.DeviceTypeThermostat}, device: plain, want: true},
+		{name: "other device type", match: Match{DeviceType: sdmapi.DeviceTypeThermostat}, device: camera},
+		{name: "trait", match: Match{Traits: []string{"sdm.devices.traits.Fan"}}, device: fan, want: true},
+		{name: "without trait", match: Match{Traits: []string{"sdm.devices.traits.Fan"}}, device: plain},
+		{name: "missing trait", match: Match{MissingTraits: []string{"sdm.devices.traits.Fan"}}, device: plain, want: true},
+		{name: "unwanted trait", match: Match{MissingTraits: []string{"sdm.devices.traits.Fan"}}, device: fan},
+		{name: "custom name", match: Match{CustomName: "Upstairs*"}, device: fan, want: true},
+		{name: "other custom name", match: Match{CustomName: "Downstairs*"}, device: fan},
+		{name: "no custom name", match: Match{CustomName: "*landing"}, device: plain},
+		{
+			name:   "every criterion",
+			match:  Match{DeviceType: sdmapi.DeviceTypeThermostat, Traits: []string{"sdm.devices.traits.Fan"}, CustomName: "Upstairs*"},
+			device: fan,
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Mapping{Name: tt.name, Match: tt.match, ProfileID: testProfileID}
+			if got := m.Matches(tt.device); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappingFilterStates(t *testing.T) {
+	var states []*models.DeviceStateStatesItems0
+	for _, capability := range []string{"st.thermostatMode", "st.thermostatCoolingSetpoint", "yournamespace.ecoMode", "st.healthCheck"} {
+		states = append(states, &models.DeviceStateStatesItems0{Component: "main", Capability: capability})
+	}
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		want         []string
+	}{
+		{
+			name: "every state",
+			want: []string{"st.thermostatMode", "st.thermostatCoolingSetpoint", "yournamespace.ecoMode", "st.healthCheck"},
+		},
+		{
+			name:         "st namespace",
+			capabilities: []string{"thermostatMode"},
+			want:         []string{"st.thermostatMode", "st.healthCheck"},
+		},
+		{
+			name:         "custom namespace",
+			capabilities: []string{"yournamespace.ecoMode"},
+			want:         []string{"yournamespace.ecoMode", "st.healthCheck"},
+		},
+		{
+			name:         "any case",
+			capabilities: []string{"ThermostatCoolingSetpoint", "st.THERMOSTATMODE"},
+			want:         []string{"st.thermostatMode", "st.thermostatCoolingSetpoint", "st.healthCheck"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Mapping{Name: tt.name, ProfileID: testProfileID, Capabilities: tt.capabilities}
+
+			var got []string
+			for _, s := range m.FilterStates(states) {
+				got = append(got, s.Capability)
+			}
+			if !sameStrings(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+)
+
+/*
+ * Smartthings retries a commandRequest when it doesn't get a response in
+ * time, with the same request ID.  Sending the commands to Google again would
+ * nudge a setpoint twice or restart a fan timer, so the response to each
+ * request is kept for a while and a retry is answered from it.  A retry that
+ * arrives while the original is still running waits for its response.
+ *
+ * Responses are keyed by the request ID and a hash of the access token, so
+ * that one user cannot be given another's response.  Requests that fail with
+ * a global error aren't remembered, and are executed again when retried.
+ * Each response records its tenant, so that the responses of a tenant can be
+ * forgotten when its integration is deleted.
+ */
+
+const (
+	defaultCommandCacheSize = 1000
+	defaultCommandCacheTTL  = time.Minute * 10
+)
+
+type commandResult struct {
+	key     string
+	tenant  string
+	done    chan struct{}
+	resp    *models.CommandResponse
+	expires time.Time
+}
+
+type commandResponses struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	results map[string]*list.Element
+	order   *list.List
+}
+
+func newCommandResponses(size int, ttl time.Duration) *commandResponses {
+	return &commandResponses{
+		size:    size,
+		ttl:     ttl,
+		results: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Remove expired results and, if there are too many, the oldest ones
+func (c *commandResponses) evict() {
+	now := time.Now()
+
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		result := e.Value.(*commandResult)
+
+		if c.order.Len() <= c.size && now.Before(result.expires) {
+			break
+		}
+
+		// Results that are still running are removed when they finish
+		select {
+		case <-result.done:
+			c.order.Remove(e)
+			delete(c.results, result.key)
+		default:
+		}
+
+		e = next
+	}
+}
+
+// begin returns the response to an earlier attempt at a request, if there
+// was one.  Otherwise the caller executes the request and must call the
+// returned function with the tenant and the response, or nil if it failed.
+// Waiting for an attempt that is still running is abandoned with the
+// context's error when the context is done.
+func (c *commandResponses) begin(ctx context.Context, requestID string, token string) (*models.CommandResponse, func(string, *models.CommandResponse), error) {
+	key := requestID + "/" + hashToken(token)
+	noop := func(string, *models.CommandResponse) {}
+
+	c.mu.Lock()
+	c.evict()
+
+	if e, ok := c.results[key]; ok {
+		result := e.Value.(*commandResult)
+		c.mu.Unlock()
+
+		select {
+		case <-result.done:
+		case <-ctx.Done():
+			return nil, noop, ctx.Err()
+		}
+		if result.resp != nil {
+			return result.resp, noop, nil
+		}
+
+		// The earlier attempt failed, so this one is executed, but only the
+		// first attempt is remembered
+		return nil, noop, nil
+	}
+
+	result := &commandResult{
+		key:     key,
+		done:    make(chan struct{}),
+		expires: time.Now().Add(c.ttl),
+	}
+	c.results[key] = c.order.PushBack(result)
+	c.mu.Unlock()
+
+	finish := func(tenant string, resp *models.CommandResponse) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		result.tenant = tenant
+		result.resp = resp
+		close(result.done)
+
+		if resp == nil {
+			if e, ok := c.results[key]; ok && e.Value == result {
+				c.order.Remove(e)
+				delete(c.results, key)
+			}
+		}
+	}
+
+	return nil, finish, nil
+}
+
+// Forget the responses of a tenant.  Requests that are still running when
+// their tenant is forgotten aren't remembered when they finish.
+func (c *commandResponses) forgetTenant(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		result := e.Value.(*commandResult)
+
+		select {
+		case <-result.done:
+			if result.tenant != tenant {
+				break
+			}
+			c.order.Remove(e)
+			delete(c.results, result.key)
+		default:
+			c.order.Remove(e)
+			delete(c.results, result.key)
+		}
+
+		e = next
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+)
+
+func TestCommandResponsesRetry(t *testing.T) {
+	c := newCommandResponses(defaultCommandCacheSize, defaultCommandCacheTTL)
+
+	cached, finish, err := c.begin(context.Background(), "request-1", "google-token")
+	if cached != nil || err != nil {
+		t.Fatalf("got %v, %v for a new request, want it to be executed", cached, err)
+	}
+
+	// A retry waits for the first attempt
+	want := &models.CommandResponse{}
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		finish("home", want)
+	}()
+
+	cached, _, err = c.begin(context.Background(), "request-1", "google-token")
+	if cached != want || err != nil {
+		t.Errorf("got %v, %v for a retry, want the first response", cached, err)
+	}
+
+	// Another user's request with the same ID is executed
+	if cached, _, _ := c.begin(context.Background(), "request-1", "other-token"); cached != nil {
+		t.Error("answered another user's request from the first response")
+	}
+}
+
+func TestCommandResponsesRetryGivesUp(t *testing.T) {
+	c := newCommandResponses(defaultCommandCacheSize, defaultCommandCacheTTL)
+
+	// The first attempt never finishes
+	if _, _, err := c.begin(context.Background(), "request-1", "google-token"); err != nil {
+		t.Fatalf("beginning request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if _, _, err := c.begin(ctx, "request-1", "google-token"); err != context.DeadlineExceeded {
+		t.Errorf("got %v waiting for the first attempt, want the context's error", err)
+	}
+}
@@ -46,6 +46,15 @@ func NewCommandResponse(req models.SmartthingsRequest) models.CommandResponse {
 	}
 }
 
+// The acknowledgement of an integrationDeleted request echoes its headers
+func newIntegrationDeletedResponse(req models.SmartthingsRequest) models.InteractionResult {
+	var h models.Headers = *req.Headers
+
+	return models.InteractionResult{
+		Headers: &h,
+	}
+}
+
 func NewGlobalErrorResponse(req models.SmartthingsRequest, errEnum string, detail string) models.InteractionResult {
 	var h models.Headers = *req.Headers
 	h.InteractionType = responseTypeFromRequestType(h.InteractionType)
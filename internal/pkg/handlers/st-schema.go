@@ -1,36 +1,170 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/livestream"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+	"github.com/korovkin/limiter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/api/googleapi"
 )
 
-const (
-	StNestThermostatDeviceProfileID string = "bd2e8c4a-0e4b-475f-b8ff-273fb5f5cef5"
-)
+const defaultMaxConcurrency = 4
 
 type NestHandler struct {
 	sdmClient      sdmapi.SmartDeviceManagement
-	oauthStateFile string
+	tenants        *stoauth.Tenants
 	stClientID     string
 	stClientSecret string
+	discovery      *discovery.Builder
+	filters        discovery.Filters
+	streams        *livestream.Manager
+
+	// The tenant of the latest Google access token seen from each tenant
+	tokenTenants *tokenTenants
+
+	// Whether Google access tokens are saved with the tenants, for the
+	// pubsub service
+	recordGoogleTokens bool
+
+	// Namespace of the custom capabilities that unknown traits are
+	// forwarded as, empty to drop unknown traits
+	customNamespace string
+
+	// Overrides the temperature scale of every device if set
+	temperatureScale *sdmapi.TemperatureScale
+
+	// How long the fan runs for when the timer is started without a duration
+	fanTimers sdmapi.FanTimerDurations
+
+	// Maximum number of devices fetched from Google at once
+	maxConcurrency int
+
+	// Responses to recent command requests, nil to execute every retry
+	commandResponses *commandResponses
 }
 
-func NewNestHandler(cli sdmapi.SmartDeviceManagement, oauthStateFile string, clientID string, clientSecret string) NestHandler {
+func NewNestHandler(cli sdmapi.SmartDeviceManagement, tenants *stoauth.Tenants, clientID string, clientSecret string) NestHandler {
 	return NestHandler{
 		sdmClient:      cli,
-		oauthStateFile: oauthStateFile,
+		tenants:        tenants,
 		stClientID:     clientID,
 		stClientSecret: clientSecret,
+		discovery:      discovery.NewBuilder(discovery.DefaultMappings(discovery.DefaultDeviceProfiles())),
+		tokenTenants:   newTokenTenants(),
+		maxConcurrency: defaultMaxConcurrency,
+
+		commandResponses: newCommandResponses(defaultCommandCacheSize, defaultCommandCacheTTL),
+	}
+}
+
+// WithDeviceMappings sets how Nest devices are described to Smartthings
+// during discovery, and which of their states are sent.  Devices that no
+// mapping matches are not offered to Smartthings.
+func (h NestHandler) WithDeviceMappings(mappings []discovery.Mapping) NestHandler {
+	h.discovery = discovery.NewBuilder(mappings)
+	return h
+}
+
+// WithDeviceFilters sets which Nest devices are offered to Smartthings
+func (h NestHandler) WithDeviceFilters(filters discovery.Filters) NestHandler {
+	h.filters = filters
+	return h
+}
+
+// WithStreamManager enables the Smartthings videoStream capability for cameras
+func (h NestHandler) WithStreamManager(m *livestream.Manager) NestHandler {
+	h.streams = m
+	return h
+}
+
+// WithCustomCapabilityNamespace forwards traits that we don't know about to
+// Smartthings as custom capabilities in the given namespace
+func (h NestHandler) WithCustomCapabilityNamespace(namespace string) NestHandler {
+	h.customNamespace = namespace
+	return h
+}
+
+// WithTemperatureScale presents temperatures to Smartthings in the given scale
+// instead of the scale configured on each device
+func (h NestHandler) WithTemperatureScale(scale *sdmapi.TemperatureScale) NestHandler {
+	h.temperatureScale = scale
+	return h
+}
+
+// WithFanTimerDurations sets how long the fan runs for when the timer is
+// started without a duration, by device
+func (h NestHandler) WithFanTimerDurations(durations sdmapi.FanTimerDurations) NestHandler {
+	h.fanTimers = durations
+	return h
+}
+
+// WithMaxConcurrency sets the maximum number of devices fetched from Google
+// at once during a state refresh
+func (h NestHandler) WithMaxConcurrency(n int) NestHandler {
+	if n > 0 {
+		h.maxConcurrency = n
 	}
+	return h
+}
+
+// WithCommandCache sets how many command responses are kept, and for how
+// long, to answer retried command requests.  A size of zero executes every
+// retry.
+func (h NestHandler) WithCommandCache(size int, ttl time.Duration) NestHandler {
+	if size > 0 && ttl > 0 {
+		h.commandResponses = newCommandResponses(size, ttl)
+	} else {
+		h.commandResponses = nil
+	}
+	return h
+}
+
+// WithGoogleTokenRecording saves the Google access token of each tenant with
+// its Smartthings callback information, so that the pubsub service can look
+// up devices that are added or removed.  The tokens give access to the
+// user's devices, so should only be saved in an encrypted store.
+func (h NestHandler) WithGoogleTokenRecording(enabled bool) NestHandler {
+	h.recordGoogleTokens = enabled
+	return h
+}
+
+// Fetch a device from Google, applying the temperature scale override and
+// the fan timer duration
+func (h *NestHandler) getDevice(c sdmapi.SmartDeviceManagement, deviceID string) (*sdmapi.Device, error) {
+	nestDevice, err := c.GetDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.temperatureScale != nil {
+		nestDevice.Traits.SetTemperatureScale(h.temperatureScale)
+	}
+	nestDevice.Traits.SetFanTimerDuration(h.fanTimers.For(deviceID))
+
+	return nestDevice, nil
+}
+
+// States of the custom capabilities, if a custom capability namespace is set
+func (h *NestHandler) customStates(nestDevice *sdmapi.Device) []*models.DeviceStateStatesItems0 {
+	if h.customNamespace == "" {
+		return nil
+	}
+
+	return nestDevice.Traits.CustomToSmartthingsStates(h.customNamespace)
 }
 
 func (h *NestHandler) sendJSONResponse(w http.ResponseWriter, r *http.Request, d interface{}) {
@@ -52,38 +186,67 @@ func googleApiErrorIs(err *googleapi.Error, reason string) bool {
 	return false
 }
 
+// The canonical status of a Google API error, eg. NOT_FOUND, from the
+// response body, or from the HTTP status code if the body doesn't have one
+func googleApiErrorStatus(err *googleapi.Error) string {
+	var body struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(err.Body), &body) == nil && body.Error.Status != "" {
+		return body.Error.Status
+	}
+
+	switch err.Code {
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	}
+
+	return ""
+}
+
+// Is an error from Google a problem with the request as a whole, rather than
+// with one device ?  Only token and authorization failures are global for
+// requests about devices.
 func googleApiErrorIsGlobal(err error, requestWasForDevice bool) bool {
-	switch v := err.(type) {
-	case *googleapi.Error:
+	if !requestWasForDevice {
+		return true
+	}
+
+	if v, ok := errors.Cause(err).(*googleapi.Error); ok {
 		switch v.Code {
-		case 401:
-			return true
-		case 400:
-			if requestWasForDevice {
-				return false
-			} else {
-				return true
-			}
-		default:
+		case http.StatusUnauthorized, http.StatusForbidden:
 			return true
 		}
 	}
 
-	return true
+	return false
 }
 
 func makeDeviceError(err error) models.DeviceStateDeviceErrorItems0 {
 	errEnum := "DEVICE-UNAVAILABLE"
 	errDetail := "device unavailable"
 
-	switch v := err.(type) {
+	switch v := errors.Cause(err).(type) {
 	case *googleapi.Error:
 		errDetail = v.Message
 
-		switch {
-		case googleApiErrorIs(v, "failedPrecondition"):
+		switch status := googleApiErrorStatus(v); {
+		case status == "NOT_FOUND":
+			errEnum = "DEVICE-DELETED"
+		case status == "FAILED_PRECONDITION", googleApiErrorIs(v, "failedPrecondition"):
 			errEnum = "RESOURCE-CONSTRAINT-VIOLATION"
 		}
+	case *sdmapi.ConstraintError:
+		errDetail = v.Error()
+		errEnum = "RESOURCE-CONSTRAINT-VIOLATION"
 	}
 
 	deviceError := models.DeviceStateDeviceErrorItems0{
@@ -98,12 +261,16 @@ func (h *NestHandler) sendAPIErrorResponse(w http.ResponseWriter, r *http.Reques
 	logging.Logger(r.Context()).WithError(err).Errorf("querying Google SDM API : %s", err)
 
 	//lint:
-	switch v := err.(type) {
+	switch v := errors.Cause(err).(type) {
 	case *googleapi.Error:
-		if v.Code == 401 {
+		switch v.Code {
+		case http.StatusUnauthorized:
 			// Assume token has expired, we can't tell..
 			h.sendJSONResponse(w, r, NewGlobalErrorResponse(req, models.GlobalErrorErrorEnumTOKENEXPIRED, "token error"))
 			return
+		case http.StatusForbidden:
+			h.sendJSONResponse(w, r, NewGlobalErrorResponse(req, models.GlobalErrorErrorEnumINVALIDTOKEN, "permission denied"))
+			return
 		}
 	}
 	http.Error(w, "Down-stream API error", http.StatusBadGateway)
@@ -126,6 +293,20 @@ func (h *NestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Let the pubsub service use the user's Google token to discover devices.
+	// Command requests record it when they work out their tenant, and a
+	// token that is already known has been recorded.
+	if req.Headers.InteractionType == models.InteractionTypeStateRefreshRequest && h.recordGoogleTokens {
+		if _, known := h.tokenTenants.get(*req.Authentication.Token); !known {
+			// The request context is cancelled once the response has been sent
+			ctx, cancel := context.WithTimeout(logging.Detached(r.Context()), recordGoogleTokenTimeout)
+			go func() {
+				defer cancel()
+				h.recordGoogleToken(ctx, *req.Authentication.Token)
+			}()
+		}
+	}
+
 	switch req.Headers.InteractionType {
 	case models.InteractionTypeDiscoveryRequest:
 		h.HandleDiscoveryRequest(w, r, req)
@@ -136,10 +317,7 @@ func (h *NestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case models.InteractionTypeGrantCallbackAccess:
 		h.HandleGrantCallbackAccess(w, r, req)
 	case models.InteractionTypeIntegrationDeleted:
-		ctxLogger.Warnf("unimplemented request type: %s", req.Headers.InteractionType)
-		h.sendJSONResponse(w, r,
-			NewGlobalErrorResponse(req, models.GlobalErrorErrorEnumINVALIDINTERACTIONTYPE, "Unimplemented Interaction Type"),
-		)
+		h.HandleIntegrationDeleted(w, r, req)
 	case models.InteractionTypeInteractionResult:
 		h.HandleInteractionResult(w, r, req)
 	default:
@@ -185,12 +363,45 @@ func (h *NestHandler) HandleInteractionResult(w http.ResponseWriter, r *http.Req
 	)
 }
 
+// The tenant ID of an installation is the lowest ID of the structures that
+// the user shared with us, so that it doesn't depend on the order in which
+// Google lists them
+func tenantID(c sdmapi.SmartDeviceManagement) (string, error) {
+	structures, err := c.Structures()
+	if err != nil {
+		return "", err
+	}
+
+	if len(structures) == 0 {
+		return "", errors.New("no structures shared by the user")
+	}
+
+	ids := make([]string, 0, len(structures))
+	for _, structure := range structures {
+		ids = append(ids, path.Base(structure.ID))
+	}
+	sort.Strings(ids)
+
+	return ids[0], nil
+}
+
 // The GrantCallbackAccess request provides us with the information that we need to
 // request an access and refresh token from the Smartthings token service
 func (h *NestHandler) HandleGrantCallbackAccess(w http.ResponseWriter, r *http.Request, req models.SmartthingsRequest) {
 	ctxLogger := logging.Logger(r.Context())
 
-	// New oauth state, will overwrite any existing state on disk
+	// Work out which installation is being linked
+	c := h.sdmClient.WithAccessToken(*req.Authentication.Token)
+	tenant := stoauth.Tenant{}
+	var err error
+	tenant.ID, err = tenantID(c)
+	if err != nil {
+		ctxLogger.WithError(err).Error("identifying tenant")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// New oauth state, will replace any existing state for the tenant
 	state := stoauth.NewState().WithContext(r.Context()).WithClientSecret(h.stClientSecret)
 	state.ClientID = req.CallbackAuthentication.ClientID
 	state.Scope = req.CallbackAuthentication.Scope
@@ -203,12 +414,82 @@ func (h *NestHandler) HandleGrantCallbackAccess(w http.ResponseWriter, r *http.R
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	ctxLogger.Infof("Smartthings oauth state: %+v", state)
+	ctxLogger.Infof("Smartthings oauth state for tenant %s: %+v", tenant.ID, state)
+
+	// Record the devices so that events can be routed to the tenant
+	if nestDevices, err := c.Devices(); err == nil {
+		for _, nestDevice := range nestDevices {
+			tenant.DeviceIDs = append(tenant.DeviceIDs, nestDevice.ID)
+		}
+	} else {
+		ctxLogger.WithError(err).Warnf("listing devices for tenant %s", tenant.ID)
+	}
 
 	// Save state for future uses..
-	if err := state.Save(h.oauthStateFile); err != nil {
+	tenant.State = state
+	if h.recordGoogleTokens {
+		tenant.GoogleToken = *req.Authentication.Token
+		tenant.GoogleTokenSeen = time.Now()
+	}
+	if err := h.tenants.Put(tenant); err != nil {
+		ctxLogger.WithError(err).Error("saving smartthings tenant")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	h.tokenTenants.put(*req.Authentication.Token, tenant.ID)
+}
+
+// The integrationDeleted request tells us that the user has removed the
+// integration from Smartthings, so forget everything we know about the
+// installation.  Smartthings doesn't retry, so the request is acknowledged
+// even if the installation can't be identified.
+func (h *NestHandler) HandleIntegrationDeleted(w http.ResponseWriter, r *http.Request, req models.SmartthingsRequest) {
+	ctxLogger := logging.Logger(r.Context())
+
+	c := h.sdmClient.WithAccessToken(*req.Authentication.Token)
+	id, err := h.tenantForToken(c, *req.Authentication.Token)
+	if err != nil {
+		ctxLogger.WithError(err).Error("identifying tenant of deleted integration")
+		logging.Audit(r.Context()).WithField("action", "integration-deleted").Warn("integration deleted, tenant unknown")
+		h.sendJSONResponse(w, r, newIntegrationDeletedResponse(req))
+		return
+	}
+
+	tenant, ok := h.tenants.Get(id)
+	if !ok {
+		ctxLogger.Warnf("integration deleted for unknown tenant %s", id)
+	}
+
+	// Stop streams that nobody will be able to stop any more
+	if h.streams != nil {
+		for _, deviceID := range tenant.DeviceIDs {
+			if err := h.streams.Stop(deviceID); err != nil {
+				ctxLogger.WithError(err).Warnf("stopping live stream for %s", deviceID)
+			}
+		}
+	}
+
+	// Purge the tokens, which also stops the pubsub service from forwarding
+	// events for the tenant's devices
+	h.tokenTenants.forget(id)
+	if h.commandResponses != nil {
+		h.commandResponses.forgetTenant(id)
+	}
+	if ok {
+		if err := h.tenants.Remove(id); err != nil {
+			ctxLogger.WithError(err).Errorf("removing tenant %s", id)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	logging.Audit(r.Context()).WithFields(logrus.Fields{
+		"action":  "integration-deleted",
+		"tenant":  id,
+		"devices": len(tenant.DeviceIDs),
+	}).Info("integration deleted, tenant removed")
+
+	h.sendJSONResponse(w, r, newIntegrationDeletedResponse(req))
 }
 
 func (h *NestHandler) HandleDiscoveryRequest(w http.ResponseWriter, r *http.Request, req models.SmartthingsRequest) {
@@ -222,22 +503,34 @@ func (h *NestHandler) HandleDiscoveryRequest(w http.ResponseWriter, r *http.Requ
 	}
 	ctxLogger.Infof("Devices: %+v", nestDevices)
 
-	manufacturer := "Google"
-	model := "Nest Thermostat"
-
-	var stDevices []*models.Device
-	for _, nestDevice := range nestDevices {
-		stDevice := models.Device{
-			DeviceHandlerType: StNestThermostatDeviceProfileID,
-			DeviceUniqueID:    nestDevice.ID,
-			ExternalDeviceID:  nestDevice.ID,
-			ManufacturerInfo: &models.Manufacturer{
-				ManufacturerName: &manufacturer,
-				ModelName:        &model,
-			},
-		}
+	// Devices are still offered without their homes if they can't be named
+	homes, err := discovery.LoadHomes(c)
+	if err != nil {
+		ctxLogger.WithError(err).Warn("fetching the names of homes")
+	}
 
-		stDevices = append(stDevices, &stDevice)
+	// Filters for every tenant still apply if the tenant isn't known
+	id, err := h.tenantForToken(c, *req.Authentication.Token)
+	if err != nil {
+		ctxLogger.WithError(err).Warn("identifying tenant")
+	}
+
+	allowed, excluded := h.filters.Split(id, nestDevices, homes)
+	if len(excluded) > 0 {
+		ctxLogger.Infof("Devices excluded by the device filters: %v", excluded)
+	}
+
+	stDevices := h.discovery.Devices(allowed, homes)
+
+	// Keep the devices of the tenant up to date for routing events
+	if err == nil {
+		deviceIDs := make([]string, 0, len(nestDevices))
+		for _, nestDevice := range nestDevices {
+			deviceIDs = append(deviceIDs, nestDevice.ID)
+		}
+		if err := h.tenants.SetDevices(id, deviceIDs, excluded); err != nil {
+			ctxLogger.WithError(err).Warnf("updating devices of tenant %s", id)
+		}
 	}
 
 	resp := newDiscoveryResponse(req)
@@ -246,42 +539,91 @@ func (h *NestHandler) HandleDiscoveryRequest(w http.ResponseWriter, r *http.Requ
 	h.sendJSONResponse(w, r, resp)
 }
 
+// The Smartthings states of a Nest device, for the profile it was discovered
+// with according to its cookie
+func (h *NestHandler) deviceStates(ctx context.Context, nestDevice *sdmapi.Device, cookie models.Cookie) []*models.DeviceStateStatesItems0 {
+	nestTraits := nestDevice.Traits.TraitIDs()
+	states := make([]*models.DeviceStateStatesItems0, 0, len(nestTraits))
+
+	for _, nestTraitID := range nestTraits {
+		// Does the trait know how to expose itself to Smartthings?
+		i := nestDevice.Traits.StCapability(nestTraitID)
+		if i == nil {
+			logging.Logger(ctx).Debugf("Ignoring Nest trait %s, no Smartthings adapter", nestTraitID.Name())
+			continue
+		}
+
+		stStates := i.ToSmartthingsState(nestDevice.Traits)
+		states = append(states, stStates...)
+	}
+
+	states = append(states, h.customStates(nestDevice)...)
+
+	if nestDevice.Traits.CameraLiveStream() != nil {
+		states = append(states, h.videoStreamStates(nestDevice.ID)...)
+	}
+
+	if m, ok := h.discovery.DiscoveredMapping(*nestDevice, cookie); ok {
+		states = m.FilterStates(states)
+	}
+
+	return states
+}
+
+// A cookie to send back for a device that was discovered without one, eg.
+// before cookies were used, or nil if Smartthings already has one
+func (h *NestHandler) missingCookie(nestDevice *sdmapi.Device, cookie models.Cookie) models.Cookie {
+	if _, ok := discovery.ParseCookie(cookie); ok {
+		return nil
+	}
+
+	newCookie, _ := h.discovery.Cookie(*nestDevice)
+	return newCookie
+}
+
+// Devices are fetched concurrently.  A device that can't be fetched gets a
+// device error, unless the failure means the whole request will fail.
 func (h *NestHandler) HandleStateRefreshRequest(w http.ResponseWriter, r *http.Request, req models.SmartthingsRequest) {
 	ctxLogger := logging.Logger(r.Context())
 	c := h.sdmClient.WithAccessToken(*req.Authentication.Token)
 
-	var states []*models.DeviceState
-
-	for _, reqDevice := range req.Devices {
-		deviceInfo := models.DeviceState{}
+	states := make([]*models.DeviceState, len(req.Devices))
+	errs := make([]error, len(req.Devices))
 
-		// Ask Google for the Nest device info
-		nestDevice, err := c.GetDevice(*reqDevice.ExternalDeviceID)
-		if err != nil {
-			h.sendAPIErrorResponse(w, r, req, err)
-			return
-		}
+	limit := limiter.NewConcurrencyLimiter(h.maxConcurrency)
+	for i, reqDevice := range req.Devices {
+		i, deviceID, cookie := i, *reqDevice.ExternalDeviceID, reqDevice.DeviceCookie
 
-		nestTraits := nestDevice.Traits.TraitIDs()
-
-		deviceInfo.ExternalDeviceID = nestDevice.ID
-		deviceInfo.States = make([]*models.DeviceStateStatesItems0, 0, len(nestTraits))
+		limit.Execute(func() {
+			deviceInfo := models.DeviceState{
+				ExternalDeviceID: deviceID,
+			}
 
-		for _, nestTraitID := range nestTraits {
-			nestTrait := nestDevice.Traits.Trait(nestTraitID)
+			// Ask Google for the Nest device info
+			nestDevice, err := h.getDevice(c, deviceID)
+			if err != nil {
+				ctxLogger.WithError(err).Warnf("fetching device %s", deviceID)
+				errs[i] = err
 
-			// Does the trait know how to expose itself to Smartthings?
-			i, ok := nestTrait.(sdmapi.StCapability)
-			if !ok {
-				ctxLogger.Debugf("Ignoring Nest trait %s, no Smartthings adapter", nestTraitID.Name())
-				continue
+				deviceError := makeDeviceError(err)
+				deviceInfo.States = []*models.DeviceStateStatesItems0{}
+				deviceInfo.DeviceError = []*models.DeviceStateDeviceErrorItems0{&deviceError}
+			} else {
+				deviceInfo.ExternalDeviceID = nestDevice.ID
+				deviceInfo.States = h.deviceStates(r.Context(), nestDevice, cookie)
+				deviceInfo.DeviceCookie = h.missingCookie(nestDevice, cookie)
 			}
 
-			stStates := i.ToSmartthingsState(nestDevice.Traits)
-			deviceInfo.States = append(deviceInfo.States, stStates...)
-		}
+			states[i] = &deviceInfo
+		})
+	}
+	limit.Wait()
 
-		states = append(states, &deviceInfo)
+	for _, err := range errs {
+		if err != nil && googleApiErrorIsGlobal(err, true) {
+			h.sendAPIErrorResponse(w, r, req, err)
+			return
+		}
 	}
 
 	resp := NewDeviceStateResponse(req)
@@ -294,6 +636,29 @@ func (h *NestHandler) HandleCommandRequest(w http.ResponseWriter, r *http.Reques
 	ctxLogger := logging.Logger(r.Context())
 	c := h.sdmClient.WithAccessToken(*req.Authentication.Token)
 
+	// The response, if the commands are executed without a global error
+	var resp *models.CommandResponse
+
+	// Identify the tenant before running the commands, which also records
+	// the token for the pubsub service
+	tenant := h.commandTenant(c, *req.Authentication.Token)
+
+	if h.commandResponses != nil {
+		cached, finish, err := h.commandResponses.begin(r.Context(), *req.Headers.RequestID, *req.Authentication.Token)
+		if err != nil {
+			ctxLogger.WithError(err).Warnf("waiting for the earlier attempt at command request %s", *req.Headers.RequestID)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if cached != nil {
+			ctxLogger.Infof("answering retried command request %s from the earlier response", *req.Headers.RequestID)
+			h.sendJSONResponse(w, r, cached)
+			return
+		}
+
+		defer func() { finish(tenant, resp) }()
+	}
+
 	var states []*models.DeviceState
 
 	for _, device := range req.Devices {
@@ -301,8 +666,53 @@ func (h *NestHandler) HandleCommandRequest(w http.ResponseWriter, r *http.Reques
 			ExternalDeviceID: *device.ExternalDeviceID,
 		}
 
+		// The current state of the device, fetched before the first command
+		// that needs it and updated by each command the device accepts
+		var currentDevice *sdmapi.Device
+
 		for _, command := range device.Commands {
-			sdmCommands, err := sdmapi.StCommandToSdmCommands(command)
+			if *command.Capability == stCapabilityVideoStream && h.streams != nil {
+				if err := h.handleVideoStreamCommand(c, *device.ExternalDeviceID, command); err != nil {
+					ctxLogger.WithError(err).Error("executing videoStream command")
+
+					cause := errors.Cause(err)
+					if _, ok := cause.(*googleapi.Error); ok && googleApiErrorIsGlobal(cause, true) {
+						h.sendAPIErrorResponse(w, r, req, cause)
+						return
+					}
+					deviceError := makeDeviceError(cause)
+					deviceInfo.DeviceError = []*models.DeviceStateDeviceErrorItems0{&deviceError}
+				}
+				continue
+			}
+
+			if currentDevice == nil {
+				var err error
+				currentDevice, err = h.getDevice(c, *device.ExternalDeviceID)
+				if err != nil {
+					if googleApiErrorIsGlobal(err, true) {
+						h.sendAPIErrorResponse(w, r, req, err)
+						return
+					}
+					deviceError := makeDeviceError(err)
+					deviceInfo.DeviceError = []*models.DeviceStateDeviceErrorItems0{&deviceError}
+					break
+				}
+			}
+
+			var sdmCommands []sdmapi.Command
+			var err error
+			if h.customNamespace != "" && *command.Capability == sdmapi.FanTimerCapability(h.customNamespace) {
+				sdmCommands, err = sdmapi.FanTimerCommandToSdmCommands(command, currentDevice.Traits)
+			} else {
+				sdmCommands, err = sdmapi.StCommandToSdmCommands(command, currentDevice.Traits)
+			}
+			if constraintErr, ok := errors.Cause(err).(*sdmapi.ConstraintError); ok {
+				ctxLogger.WithError(err).Info("command not valid in the current device state")
+				deviceError := makeDeviceError(constraintErr)
+				deviceInfo.DeviceError = []*models.DeviceStateDeviceErrorItems0{&deviceError}
+				break
+			}
 			if err != nil {
 				ctxLogger.WithError(err).Error("converting stcommand to sdmcommand")
 				http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -321,7 +731,7 @@ func (h *NestHandler) HandleCommandRequest(w http.ResponseWriter, r *http.Reques
 			}
 
 			for _, sdmCommand := range sdmCommands {
-				if err := c.SendCommand(*device.ExternalDeviceID, sdmCommand); err != nil {
+				if _, err := c.SendCommand(*device.ExternalDeviceID, sdmCommand); err != nil {
 					if googleApiErrorIsGlobal(err, true) {
 						h.sendAPIErrorResponse(w, r, req, err)
 						return
@@ -329,43 +739,31 @@ func (h *NestHandler) HandleCommandRequest(w http.ResponseWriter, r *http.Reques
 						deviceError := makeDeviceError(err)
 						deviceInfo.DeviceError = []*models.DeviceStateDeviceErrorItems0{&deviceError}
 					}
+					continue
 				}
+				currentDevice.Traits.ApplyCommand(sdmCommand)
 			}
 		}
 
 		if deviceInfo.DeviceError == nil {
 			// Ask Google for the Nest device info
-			nestDevice, err := c.GetDevice(*device.ExternalDeviceID)
+			nestDevice, err := h.getDevice(c, *device.ExternalDeviceID)
 			if err != nil {
 				continue
 			}
 
-			nestTraits := nestDevice.Traits.TraitIDs()
-
 			deviceInfo.ExternalDeviceID = nestDevice.ID
-			deviceInfo.States = make([]*models.DeviceStateStatesItems0, 0, len(nestTraits))
-
-			for _, nestTraitID := range nestTraits {
-				nestTrait := nestDevice.Traits.Trait(nestTraitID)
-
-				// Does the trait know how to expose itself to Smartthings?
-				i, ok := nestTrait.(sdmapi.StCapability)
-				if !ok {
-					ctxLogger.Debugf("Ignoring Nest trait %s, no Smartthings adapter", nestTraitID.Name())
-					continue
-				}
-
-				stStates := i.ToSmartthingsState(nestDevice.Traits)
-				deviceInfo.States = append(deviceInfo.States, stStates...)
-			}
+			deviceInfo.States = h.deviceStates(r.Context(), nestDevice, device.DeviceCookie)
+			deviceInfo.DeviceCookie = h.missingCookie(nestDevice, device.DeviceCookie)
 		}
 
 		states = append(states, &deviceInfo)
 
 	}
 
-	resp := NewCommandResponse(req)
-	resp.DeviceState = states
+	commandResp := NewCommandResponse(req)
+	commandResp.DeviceState = states
+	resp = &commandResp
 
 	h.sendJSONResponse(w, r, resp)
 
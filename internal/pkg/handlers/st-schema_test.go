@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/discovery"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/stoauth"
+	"github.com/pkg/errors"
+)
+
+const testFixtures = "../../../sample-sdm-fixtures.json"
+
+// A token store that keeps the tenants in memory
+type memStore struct {
+	mu     sync.Mutex
+	data   []byte
+	writes int
+}
+
+func (s *memStore) Read() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data == nil {
+		return nil, stoauth.ErrNotStored
+	}
+	return s.data, nil
+}
+
+func (s *memStore) Write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = data
+	s.writes++
+	return nil
+}
+
+func (s *memStore) String() string {
+	return "memory"
+}
+
+func (s *memStore) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes
+}
+
+func newTestFake(t *testing.T) *sdmapi.Fake {
+	fake := sdmapi.NewFakeClient("my-project-id")
+	if err := fake.LoadFile(testFixtures); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+
+	return fake
+}
+
+func newTestHandler(c sdmapi.SmartDeviceManagement) *NestHandler {
+	h := NewNestHandler(c, stoauth.NewTenants(&memStore{}), "client-id", "client-secret")
+	return &h
+}
+
+type testState struct {
+	Capability string      `json:"capability"`
+	Attribute  string      `json:"attribute"`
+	Value      interface{} `json:"value"`
+	Unit       string      `json:"unit"`
+}
+
+type testDeviceState struct {
+	ExternalDeviceID string            `json:"externalDeviceId"`
+	DeviceCookie     map[string]string `json:"deviceCookie"`
+	States           []testState       `json:"states"`
+	DeviceError      []struct {
+		ErrorEnum string `json:"errorEnum"`
+		Detail    string `json:"detail"`
+	} `json:"deviceError"`
+}
+
+// The state of an attribute, or nil if it wasn't sent
+func (d testDeviceState) state(capability string, attribute string) *testState {
+	for i, s := range d.States {
+		if s.Capability == capability && s.Attribute == attribute {
+			return &d.States[i]
+		}
+	}
+
+	return nil
+}
+
+func (d testDeviceState) errorEnum() string {
+	if len(d.DeviceError) == 0 {
+		return ""
+	}
+
+	return d.DeviceError[0].ErrorEnum
+}
+
+// Send a Smartthings request to the handler and return the device states in
+// the response, by device ID
+func serveRequest(t *testing.T, h *NestHandler, interactionType string, devices string) map[string]testDeviceState {
+	t.Helper()
+
+	// Request IDs are limited to letters, digits and -+.
+	requestID := strings.NewReplacer("/", "-", "_", "-").Replace(t.Name())
+
+	body := fmt.Sprintf(`{
+		"headers": {"schema": "st-schema", "version": "1.0", "interactionType": %q, "requestId": "request-%s"},
+		"authentication": {"tokenType": "Bearer", "token": "google-token"},
+		"devices": %s
+	}`, interactionType, requestID, devices)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/nest", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		DeviceState []testDeviceState `json:"deviceState"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %s: %v", w.Body, err)
+	}
+
+	states := make(map[string]testDeviceState)
+	for _, d := range resp.DeviceState {
+		states[d.ExternalDeviceID] = d
+	}
+
+	return states
+}
+
+// Change the thermostat as if it was changed on the device itself
+func setThermostat(t *testing.T, fake *sdmapi.Fake, mode string, setpoints map[string]interface{}) {
+	t.Helper()
+
+	err := fake.SetTrait("thermostat1", "sdm.devices.traits.ThermostatMode", map[string]interface{}{
+		"availableModes": []interface{}{"HEAT", "COOL", "HEATCOOL", "OFF"},
+		"mode":           mode,
+	})
+	if err == nil {
+		err = fake.SetTrait("thermostat1", "sdm.devices.traits.ThermostatTemperatureSetpoint", setpoints)
+	}
+	if err != nil {
+		t.Fatalf("changing the thermostat: %v", err)
+	}
+}
+
+func setHeatingSetpoint(deviceID string, value float64) string {
+	return fmt.Sprintf(`[{"externalDeviceId": %q, "commands": [
+		{"component": "main", "capability": "st.thermostatHeatingSetpoint", "command": "setHeatingSetpoint", "arguments": [%g]}
+	]}]`, deviceID, value)
+}
+
+func TestStateRefresh(t *testing.T) {
+	h := newTestHandler(newTestFake(t))
+
+	states := serveRequest(t, h, "stateRefreshRequest", `[{"externalDeviceId": "thermostat1"}, {"externalDeviceId": "gone"}]`)
+
+	thermostat := states["thermostat1"]
+	if s := thermostat.state("st.temperatureMeasurement", "temperature"); s == nil || s.Value != 18.5 || s.Unit != "C" {
+		t.Errorf("got temperature %+v, want 18.5 C", s)
+	}
+	if s := thermostat.state("st.thermostatHeatingSetpoint", "heatingSetpoint"); s == nil || s.Value != 20.0 {
+		t.Errorf("got heating setpoint %+v, want 20", s)
+	}
+	if s := thermostat.state("st.thermostatMode", "thermostatMode"); s == nil || s.Value != "heat" {
+		t.Errorf("got thermostat mode %+v, want heat", s)
+	}
+	if s := thermostat.state("st.healthCheck", "healthStatus"); s == nil || s.Value != "online" {
+		t.Errorf("got health %+v, want online", s)
+	}
+
+	if e := states["gone"].errorEnum(); e != "DEVICE-DELETED" {
+		t.Errorf("got error %q for a missing device, want DEVICE-DELETED", e)
+	}
+}
+
+func TestStateRefreshFiltersByMapping(t *testing.T) {
+	fake := newTestFake(t)
+	setThermostat(t, fake, "HEATCOOL", map[string]interface{}{"heatCelsius": 19.0, "coolCelsius": 25.0})
+
+	h := newTestHandler(fake)
+	*h = h.WithDeviceMappings([]discovery.Mapping{{
+		Name:         "heat-only",
+		Match:        discovery.Match{DeviceType: "sdm.devices.types.THERMOSTAT"},
+		ProfileID:    discovery.StNestThermostatDeviceProfileID,
+		Capabilities: []string{"temperatureMeasurement", "thermostatHeatingSetpoint", "thermostatMode"},
+	}})
+
+	thermostat := serveRequest(t, h, "stateRefreshRequest", `[{"externalDeviceId": "thermostat1"}]`)["thermostat1"]
+
+	if s := thermostat.state("st.thermostatHeatingSetpoint", "heatingSetpoint"); s == nil || s.Value != 19.0 {
+		t.Errorf("got heating setpoint %+v, want 19", s)
+	}
+	if s := thermostat.state("st.thermostatCoolingSetpoint", "coolingSetpoint"); s != nil {
+		t.Errorf("got cooling setpoint %+v from a heat-only mapping", s)
+	}
+	if s := thermostat.state("st.relativeHumidityMeasurement", "humidity"); s != nil {
+		t.Errorf("got humidity %+v from a heat-only mapping", s)
+	}
+}
+
+func TestCommandSetHeat(t *testing.T) {
+	fake := newTestFake(t)
+	h := newTestHandler(fake)
+
+	thermostat := serveRequest(t, h, "commandRequest", setHeatingSetpoint("thermostat1", 21.5))["thermostat1"]
+
+	if e := thermostat.errorEnum(); e != "" {
+		t.Fatalf("got error %s", e)
+	}
+	if s := thermostat.state("st.thermostatHeatingSetpoint", "heatingSetpoint"); s == nil || s.Value != 21.5 {
+		t.Errorf("got heating setpoint %+v, want 21.5", s)
+	}
+
+	// The setpoint was changed on the device
+	thermostat = serveRequest(t, h, "stateRefreshRequest", `[{"externalDeviceId": "thermostat1"}]`)["thermostat1"]
+	if s := thermostat.state("st.thermostatHeatingSetpoint", "heatingSetpoint"); s == nil || s.Value != 21.5 {
+		t.Errorf("got heating setpoint %+v after the command, want 21.5", s)
+	}
+}
+
+// Switch the thermostat to heat and then set the heating setpoint, in one
+// request
+const heatThenSetpoint = `[{"externalDeviceId": "thermostat1", "commands": [
+	{"component": "main", "capability": "st.thermostatMode", "command": "setThermostatMode", "arguments": ["heat"]},
+	{"component": "main", "capability": "st.thermostatHeatingSetpoint", "command": "setHeatingSetpoint", "arguments": [21]}
+]}]`
+
+func TestCommandModeThenSetpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, fake *sdmapi.Fake)
+	}{
+		{
+			name: "off",
+			setup: func(t *testing.T, fake *sdmapi.Fake) {
+				setThermostat(t, fake, "OFF", map[string]interface{}{})
+			},
+		},
+		{
+			name: "manual eco",
+			setup: func(t *testing.T, fake *sdmapi.Fake) {
+				err := fake.SetTrait("thermostat1", "sdm.devices.traits.ThermostatEco", map[string]interface{}{
+					"availableModes": []interface{}{"OFF", "MANUAL_ECO"},
+					"mode":           "MANUAL_ECO",
+					"heatCelsius":    12.0,
+					"coolCelsius":    28.0,
+				})
+				if err != nil {
+					t.Fatalf("turning eco on: %v", err)
+				}
+				setThermostat(t, fake, "HEAT", map[string]interface{}{})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newTestFake(t)
+			tt.setup(t, fake)
+			h := newTestHandler(fake)
+
+			// The setpoint is checked against the mode set by the first command
+			thermostat := serveRequest(t, h, "commandRequest", heatThenSetpoint)["thermostat1"]
+
+			if len(thermostat.DeviceError) > 0 {
+				t.Fatalf("got error %+v", thermostat.DeviceError)
+			}
+			if s := thermostat.state("st.thermostatMode", "thermostatMode"); s == nil || s.Value != "heat" {
+				t.Errorf("got thermostat mode %+v, want heat", s)
+			}
+			if s := thermostat.state("st.thermostatHeatingSetpoint", "heatingSetpoint"); s == nil || s.Value != 21.0 {
+				t.Errorf("got heating setpoint %+v, want 21", s)
+			}
+		})
+	}
+}
+
+func TestCommandSetHeatInCoolMode(t *testing.T) {
+	fake := newTestFake(t)
+	setThermostat(t, fake, "COOL", map[string]interface{}{"coolCelsius": 24.0})
+	h := newTestHandler(fake)
+
+	thermostat := serveRequest(t, h, "commandRequest", setHeatingSetpoint("thermostat1", 21))["thermostat1"]
+
+	if e := thermostat.errorEnum(); e != "RESOURCE-CONSTRAINT-VIOLATION" {
+		t.Errorf("got error %q, want RESOURCE-CONSTRAINT-VIOLATION", e)
+	}
+}
+
+// Switches the thermostat to COOL mode just before each command, as if the
+// user changed the mode on the device after the handler read it
+type modeChangingClient struct {
+	sdmapi.SmartDeviceManagement
+	t    *testing.T
+	fake *sdmapi.Fake
+}
+
+func (c modeChangingClient) WithAccessToken(token string) sdmapi.SmartDeviceManagement {
+	c.SmartDeviceManagement = c.SmartDeviceManagement.WithAccessToken(token)
+	return c
+}
+
+func (c modeChangingClient) SendCommand(deviceID string, command sdmapi.Command) (interface{}, error) {
+	setThermostat(c.t, c.fake, "COOL", map[string]interface{}{"coolCelsius": 24.0})
+	return c.SmartDeviceManagement.SendCommand(deviceID, command)
+}
+
+func TestCommandSetHeatRejectedByGoogle(t *testing.T) {
+	fake := newTestFake(t)
+	h := newTestHandler(modeChangingClient{SmartDeviceManagement: fake, t: t, fake: fake})
+
+	// The fake rejects the command with a failedPrecondition error
+	thermostat := serveRequest(t, h, "commandRequest", setHeatingSetpoint("thermostat1", 21))["thermostat1"]
+
+	if e := thermostat.errorEnum(); e != "RESOURCE-CONSTRAINT-VIOLATION" {
+		t.Errorf("got error %q, want RESOURCE-CONSTRAINT-VIOLATION", e)
+	}
+	if len(thermostat.DeviceError) > 0 && !strings.Contains(thermostat.DeviceError[0].Detail, "COOL mode") {
+		t.Errorf("got detail %q, want the message from Google", thermostat.DeviceError[0].Detail)
+	}
+}
+
+func TestCommandUnknownMode(t *testing.T) {
+	h := newTestHandler(newTestFake(t))
+
+	devices := `[{"externalDeviceId": "thermostat1", "commands": [
+		{"component": "main", "capability": "st.thermostatMode", "command": "setThermostatMode", "arguments": ["emergency heat"]}
+	]}]`
+	thermostat := serveRequest(t, h, "commandRequest", devices)["thermostat1"]
+
+	// A device error rather than failing the whole request
+	if e := thermostat.errorEnum(); e != "RESOURCE-CONSTRAINT-VIOLATION" {
+		t.Errorf("got error %q, want RESOURCE-CONSTRAINT-VIOLATION", e)
+	}
+}
+
+func TestCommandUnsupported(t *testing.T) {
+	h := newTestHandler(newTestFake(t))
+
+	devices := `[{"externalDeviceId": "thermostat1", "commands": [
+		{"component": "main", "capability": "st.switch", "command": "on", "arguments": []}
+	]}]`
+	thermostat := serveRequest(t, h, "commandRequest", devices)["thermostat1"]
+
+	if e := thermostat.errorEnum(); e != "CAPABILITY-NOT-SUPPORTED" {
+		t.Errorf("got error %q, want CAPABILITY-NOT-SUPPORTED", e)
+	}
+}
+
+func TestMakeDeviceError(t *testing.T) {
+	fake := newTestFake(t)
+
+	_, notFound := fake.GetDevice("gone")
+	_, precondition := fake.SendCommand("thermostat1", sdmapi.NewThermostatTemperatureSetpointCoolCommand(25))
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "not found", err: notFound, want: "DEVICE-DELETED"},
+		{name: "failed precondition", err: precondition, want: "RESOURCE-CONSTRAINT-VIOLATION"},
+		{name: "other", err: errors.New("connection reset"), want: "DEVICE-UNAVAILABLE"},
+	}
+
+	for _, tt := range tests {
+		if tt.err == nil {
+			t.Fatalf("%s: the fake returned no error", tt.name)
+		}
+		if got := makeDeviceError(errors.Wrap(tt.err, "sending command")); *got.ErrorEnum != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, *got.ErrorEnum, tt.want)
+		}
+	}
+}
+
+// Lists the structures of the user in a fixed order
+type structuresClient struct {
+	sdmapi.SmartDeviceManagement
+	ids []string
+}
+
+func (c structuresClient) Structures() ([]sdmapi.Structure, error) {
+	structures := make([]sdmapi.Structure, 0, len(c.ids))
+	for _, id := range c.ids {
+		structures = append(structures, sdmapi.Structure{ID: "enterprises/my-project-id/structures/" + id})
+	}
+
+	return structures, nil
+}
+
+func TestTenantIDIgnoresStructureOrder(t *testing.T) {
+	for _, ids := range [][]string{{"home", "cottage"}, {"cottage", "home"}} {
+		id, err := tenantID(structuresClient{ids: ids})
+		if err != nil {
+			t.Fatalf("identifying tenant of %v: %v", ids, err)
+		}
+		if id != "cottage" {
+			t.Errorf("got tenant %s for structures %v, want cottage", id, ids)
+		}
+	}
+
+	if _, err := tenantID(structuresClient{}); err == nil {
+		t.Error("identified a tenant without any structures")
+	}
+}
+
+// Counts the calls to list the user's structures
+type countingClient struct {
+	sdmapi.SmartDeviceManagement
+	mu         *sync.Mutex
+	structures *int
+}
+
+func (c countingClient) WithAccessToken(token string) sdmapi.SmartDeviceManagement {
+	c.SmartDeviceManagement = c.SmartDeviceManagement.WithAccessToken(token)
+	return c
+}
+
+func (c countingClient) Structures() ([]sdmapi.Structure, error) {
+	c.mu.Lock()
+	*c.structures++
+	c.mu.Unlock()
+
+	return c.SmartDeviceManagement.Structures()
+}
+
+func TestCommandTenantLookedUpOnce(t *testing.T) {
+	var structures int
+	h := newTestHandler(countingClient{SmartDeviceManagement: newTestFake(t), mu: &sync.Mutex{}, structures: &structures})
+
+	// Each request has its own ID, so neither is answered from the cache
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			serveRequest(t, h, "commandRequest", setHeatingSetpoint("thermostat1", 21))
+		})
+	}
+
+	if structures != 1 {
+		t.Errorf("listed the structures %d times, want once for the token", structures)
+	}
+}
+
+func TestGoogleTokenRecording(t *testing.T) {
+	for _, record := range []bool{false, true} {
+		t.Run(fmt.Sprintf("record-%t", record), func(t *testing.T) {
+			store := &memStore{}
+			tenants := stoauth.NewTenants(store)
+			if err := tenants.Put(stoauth.Tenant{ID: "home", State: stoauth.NewState()}); err != nil {
+				t.Fatalf("adding tenant: %v", err)
+			}
+
+			h := NewNestHandler(newTestFake(t), tenants, "client-id", "client-secret").WithGoogleTokenRecording(record)
+			linked := store.written()
+
+			// Each request has its own ID, so neither is answered from the cache
+			for _, name := range []string{"first", "second"} {
+				t.Run(name, func(t *testing.T) {
+					serveRequest(t, &h, "commandRequest", setHeatingSetpoint("thermostat1", 21))
+				})
+			}
+
+			tenant, _ := tenants.Get("home")
+			if record && (tenant.GoogleToken != "google-token" || store.written() != linked+1) {
+				t.Errorf("saved token %q in %d writes, want it saved once", tenant.GoogleToken, store.written()-linked)
+			}
+			if !record && (tenant.GoogleToken != "" || store.written() != linked) {
+				t.Errorf("saved token %q in %d writes, want it not saved", tenant.GoogleToken, store.written()-linked)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+/*
+ * The pubsub service has no Google credentials of its own for the Smart
+ * Device Management API, so the web service records the latest Google access
+ * token that Smartthings sent on behalf of each tenant.  The pubsub service
+ * uses it to discover devices that have been added or removed.  The tokens
+ * give access to the user's devices, so they are only recorded when the
+ * handler is told that the store is safe to keep them in.
+ *
+ * Working out the tenant of a token costs an API call and a store write, so
+ * the tenant of the latest token of each tenant is remembered, and a token
+ * is only looked up and written the first time it is seen.  Only hashes of
+ * the tokens are kept in memory.
+ */
+
+// How long recording a token may take, after the request has been answered
+const recordGoogleTokenTimeout = time.Second * 30
+
+type tokenTenants struct {
+	mu       sync.Mutex
+	byHash   map[string]string
+	byTenant map[string]string
+
+	// Hashes of the tokens that are being looked up
+	pending map[string]bool
+}
+
+func newTokenTenants() *tokenTenants {
+	return &tokenTenants{
+		byHash:   make(map[string]string),
+		byTenant: make(map[string]string),
+		pending:  make(map[string]bool),
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *tokenTenants) get(token string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := t.byHash[hashToken(token)]
+	return id, ok
+}
+
+// Remember the tenant of a token, forgetting the tenant's previous token
+func (t *tokenTenants) put(token string, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hash := hashToken(token)
+	if old, ok := t.byTenant[id]; ok && old != hash {
+		delete(t.byHash, old)
+	}
+
+	t.byHash[hash] = id
+	t.byTenant[id] = hash
+}
+
+// Claim the lookup of a token, returning false if it is already known or
+// another request is looking it up
+func (t *tokenTenants) claim(token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hash := hashToken(token)
+	if _, ok := t.byHash[hash]; ok || t.pending[hash] {
+		return false
+	}
+
+	t.pending[hash] = true
+	return true
+}
+
+func (t *tokenTenants) release(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, hashToken(token))
+}
+
+func (t *tokenTenants) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if hash, ok := t.byTenant[id]; ok {
+		delete(t.byHash, hash)
+		delete(t.byTenant, id)
+	}
+}
+
+// Return the tenant that a Google access token belongs to, recording the
+// token against the tenant the first time it is seen if tokens are recorded
+func (h *NestHandler) tenantForToken(c sdmapi.SmartDeviceManagement, token string) (string, error) {
+	if id, ok := h.tokenTenants.get(token); ok {
+		return id, nil
+	}
+
+	id, err := tenantID(c)
+	if err != nil {
+		return "", err
+	}
+	h.tokenTenants.put(token, id)
+
+	// The tenant isn't known until the account has been linked
+	if h.recordGoogleTokens {
+		if err := h.tenants.SetGoogleToken(id, token); err != nil {
+			logging.Logger(nil).WithError(err).Debugf("recording google access token for tenant %s", id)
+		}
+	}
+
+	return id, nil
+}
+
+// The tenant that a command request was for, or an empty string if it isn't
+// known
+func (h *NestHandler) commandTenant(c sdmapi.SmartDeviceManagement, token string) string {
+	id, err := h.tenantForToken(c, token)
+	if err != nil {
+		logging.Logger(nil).WithError(err).Debug("identifying tenant of command request")
+		return ""
+	}
+
+	return id
+}
+
+// Record a Google access token against its tenant, within the deadline of
+// the context
+func (h *NestHandler) recordGoogleToken(ctx context.Context, token string) {
+	if !h.tokenTenants.claim(token) {
+		return
+	}
+	defer h.tokenTenants.release(token)
+
+	c := h.sdmClient.WithAccessToken(token)
+	if deadline, ok := ctx.Deadline(); ok {
+		c = c.WithTimeout(time.Until(deadline))
+	}
+
+	if _, err := h.tenantForToken(c, token); err != nil {
+		logging.Logger(ctx).WithError(err).Warn("identifying tenant of google access token")
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+/*
+ * The Smartthings videoStream capability is backed by the live stream manager
+ * rather than by a single SDM command, as streams need extending for as long
+ * as they are being watched.
+ */
+
+const stCapabilityVideoStream = "st.videoStream"
+
+func (h *NestHandler) handleVideoStreamCommand(c sdmapi.SmartDeviceManagement, deviceID string, command *models.Command) error {
+	switch *command.Command {
+	case "startStream":
+		_, err := h.streams.Attach(c, deviceID)
+		return err
+	case "stopStream":
+		return h.streams.Detach(deviceID)
+	}
+
+	return fmt.Errorf("unsupported videoStream command: %s", *command.Command)
+}
+
+// The stream attribute describes the active stream, if any
+func (h *NestHandler) videoStreamStates(deviceID string) []*models.DeviceStateStatesItems0 {
+	if h.streams == nil {
+		return nil
+	}
+
+	stream := map[string]string{}
+	if rtsp, ok := h.streams.Stream(deviceID); ok {
+		stream["InHomeURL"] = rtsp.URL
+		stream["OutHomeURL"] = rtsp.URL
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: stCapabilityVideoStream,
+		Attribute:  "stream",
+		Value:      stream,
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
@@ -0,0 +1,364 @@
+package livestream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Manager keeps track of the RTSP live streams that are active for each camera.
+ *
+ * A stream is generated when the first consumer attaches to a device, and is
+ * shared by later consumers.  Google expires stream tokens after a few minutes,
+ * so the manager extends the stream shortly before each expiry for as long as
+ * any consumer remains attached.  The stream is stopped when the last consumer
+ * detaches, or when it reaches the maximum duration or can't be extended, in
+ * which case the consumers are told through the ended function.
+ *
+ * The API calls are made without holding the lock, so that a slow call for one
+ * device doesn't hold up the others.  A stream is taken out of the map before
+ * it is stopped, and the result of an extension is only applied if the stream
+ * is still active when the call returns.
+ */
+
+const (
+	defaultExtendBefore = time.Second * 30
+	defaultMaxDuration  = time.Minute * 30
+
+	// Don't hammer the API if Google returns a short or missing expiry time
+	minExtendInterval = time.Second * 10
+)
+
+type stream struct {
+	deviceID  string
+	client    sdmapi.SmartDeviceManagement
+	rtsp      sdmapi.RtspStream
+	consumers int
+	started   time.Time
+	timer     *time.Timer
+
+	// Closed once the stream has been generated, or generating it failed
+	ready chan struct{}
+	err   error
+}
+
+type Manager struct {
+	extendBefore time.Duration
+	maxDuration  time.Duration
+
+	// Called when a stream ends without being stopped by its consumers
+	ended func(deviceID string)
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		extendBefore: defaultExtendBefore,
+		maxDuration:  defaultMaxDuration,
+		streams:      make(map[string]*stream),
+	}
+}
+
+// WithExtendBefore sets how long before the expiry of a stream token to extend it
+func (m *Manager) WithExtendBefore(d time.Duration) *Manager {
+	m.extendBefore = d
+	return m
+}
+
+// WithMaxDuration sets the maximum time a stream is kept alive, regardless of
+// the number of consumers.  Zero means no limit.
+func (m *Manager) WithMaxDuration(d time.Duration) *Manager {
+	m.maxDuration = d
+	return m
+}
+
+// WithEndedFunc sets a function that is called, without the lock held, when
+// a stream ends because it reached its maximum duration or couldn't be
+// extended
+func (m *Manager) WithEndedFunc(f func(deviceID string)) *Manager {
+	m.ended = f
+	return m
+}
+
+// Attach a consumer to the live stream of a device, generating the stream
+// if it is not already active.  The client is used to extend and stop the
+// stream later, so it should carry a valid access token.
+func (m *Manager) Attach(client sdmapi.SmartDeviceManagement, deviceID string) (sdmapi.RtspStream, error) {
+	m.mu.Lock()
+
+	if s, ok := m.streams[deviceID]; ok {
+		s.consumers++
+		s.client = client
+		logging.Logger(nil).Debugf("live stream for %s: %d consumers", deviceID, s.consumers)
+		m.mu.Unlock()
+
+		// Wait for the stream if another consumer is still generating it
+		<-s.ready
+		if s.err != nil {
+			return sdmapi.RtspStream{}, s.err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return s.rtsp, nil
+	}
+
+	s := &stream{
+		deviceID:  deviceID,
+		client:    client,
+		consumers: 1,
+		ready:     make(chan struct{}),
+	}
+	m.streams[deviceID] = s
+	m.mu.Unlock()
+
+	rtsp, err := generate(client, deviceID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		if m.streams[deviceID] == s {
+			delete(m.streams, deviceID)
+		}
+		s.err = err
+		close(s.ready)
+		return sdmapi.RtspStream{}, err
+	}
+
+	s.rtsp = rtsp
+	s.started = time.Now()
+	close(s.ready)
+
+	// Every consumer detached, or the stream was stopped, while it was being
+	// generated
+	if m.streams[deviceID] != s {
+		go m.sendStop(s)
+		return rtsp, nil
+	}
+
+	m.scheduleExtension(s)
+
+	logging.Logger(nil).Infof("started live stream for %s, expires %s", deviceID, s.rtsp.ExpiresAt)
+	return s.rtsp, nil
+}
+
+func generate(client sdmapi.SmartDeviceManagement, deviceID string) (sdmapi.RtspStream, error) {
+	results, err := client.SendCommand(deviceID, sdmapi.NewGenerateRtspStreamCommand())
+	if err != nil {
+		return sdmapi.RtspStream{}, errors.Wrap(err, "generating RTSP stream")
+	}
+
+	rtsp, ok := results.(*sdmapi.RtspStream)
+	if !ok || rtsp.URL == "" {
+		return sdmapi.RtspStream{}, fmt.Errorf("no RTSP stream returned for device %s", deviceID)
+	}
+
+	return *rtsp, nil
+}
+
+// Detach a consumer from the live stream of a device, stopping the stream
+// if there are no consumers left
+func (m *Manager) Detach(deviceID string) error {
+	m.mu.Lock()
+
+	s, ok := m.streams[deviceID]
+	if !ok {
+		m.mu.Unlock()
+		return nil
+	}
+
+	s.consumers--
+	if s.consumers > 0 {
+		logging.Logger(nil).Debugf("live stream for %s: %d consumers", deviceID, s.consumers)
+		m.mu.Unlock()
+		return nil
+	}
+
+	ready := m.remove(s)
+	m.mu.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return m.sendStop(s)
+}
+
+// Stop stops the live stream of a device regardless of its consumers, eg.
+// when the device is removed
+func (m *Manager) Stop(deviceID string) error {
+	m.mu.Lock()
+
+	s, ok := m.streams[deviceID]
+	if !ok {
+		m.mu.Unlock()
+		return nil
+	}
+
+	ready := m.remove(s)
+	m.mu.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return m.sendStop(s)
+}
+
+// Stream returns the active live stream for a device, if there is one
+func (m *Manager) Stream(deviceID string) (sdmapi.RtspStream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[deviceID]
+	if !ok || !isReady(s) {
+		return sdmapi.RtspStream{}, false
+	}
+
+	return s.rtsp, true
+}
+
+// StopAll stops every active stream, eg. at shutdown
+func (m *Manager) StopAll() {
+	var stopping []*stream
+
+	m.mu.Lock()
+	for _, s := range m.streams {
+		if m.remove(s) {
+			stopping = append(stopping, s)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, s := range stopping {
+		if err := m.sendStop(s); err != nil {
+			logging.Logger(nil).WithError(err).Warnf("stopping live stream for %s", s.deviceID)
+		}
+	}
+}
+
+func isReady(s *stream) bool {
+	select {
+	case <-s.ready:
+		return s.err == nil
+	default:
+		return false
+	}
+}
+
+// Take a stream out of the map, returning whether it has been generated and
+// so needs stopping.  A stream that is still being generated is stopped by
+// Attach once it is.  Call with the lock held.
+func (m *Manager) remove(s *stream) bool {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(m.streams, s.deviceID)
+
+	return isReady(s)
+}
+
+// Call without the lock held, after the stream has been removed
+func (m *Manager) sendStop(s *stream) error {
+	logging.Logger(nil).Infof("stopping live stream for %s", s.deviceID)
+	if _, err := s.client.SendCommand(s.deviceID, sdmapi.NewStopRtspStreamCommand(s.rtsp.ExtensionToken)); err != nil {
+		return errors.Wrap(err, "stopping RTSP stream")
+	}
+
+	return nil
+}
+
+// call with the lock held
+func (m *Manager) scheduleExtension(s *stream) {
+	wait := time.Until(s.rtsp.ExpiresAt) - m.extendBefore
+	if wait < minExtendInterval {
+		wait = minExtendInterval
+	}
+
+	s.timer = time.AfterFunc(wait, func() {
+		m.extend(s)
+	})
+}
+
+func (m *Manager) extend(s *stream) {
+	m.mu.Lock()
+
+	// Stopped or replaced while we were waiting for the lock
+	if m.streams[s.deviceID] != s {
+		m.mu.Unlock()
+		return
+	}
+
+	if m.maxDuration > 0 && time.Since(s.started) >= m.maxDuration {
+		logging.Logger(nil).Warnf("live stream for %s reached maximum duration %s", s.deviceID, m.maxDuration)
+		m.remove(s)
+		m.mu.Unlock()
+
+		m.end(s)
+		return
+	}
+
+	client := s.client
+	extensionToken := s.rtsp.ExtensionToken
+	m.mu.Unlock()
+
+	results, err := client.SendCommand(s.deviceID, sdmapi.NewExtendRtspStreamCommand(extensionToken))
+
+	m.mu.Lock()
+
+	if err != nil {
+		logging.Logger(nil).WithError(err).Errorf("extending live stream for %s, dropping stream", s.deviceID)
+
+		// Already stopped by a consumer while it was being extended
+		if m.streams[s.deviceID] != s {
+			m.mu.Unlock()
+			return
+		}
+		m.remove(s)
+		m.mu.Unlock()
+
+		m.end(s)
+		return
+	}
+	defer m.mu.Unlock()
+
+	rtsp, ok := results.(*sdmapi.RtspStream)
+
+	// Stopped while it was being extended, with the old extension token, so
+	// stop it again with the new one
+	if m.streams[s.deviceID] != s {
+		if ok {
+			stopped := *s
+			stopped.rtsp.ExtensionToken = rtsp.ExtensionToken
+			go m.sendStop(&stopped)
+		}
+		return
+	}
+
+	if ok {
+		s.rtsp.SetToken(rtsp.Token)
+		s.rtsp.ExtensionToken = rtsp.ExtensionToken
+		s.rtsp.ExpiresAt = rtsp.ExpiresAt
+	}
+
+	logging.Logger(nil).Debugf("extended live stream for %s, expires %s", s.deviceID, s.rtsp.ExpiresAt)
+	m.scheduleExtension(s)
+}
+
+// Stop a stream that ended without its consumers, and tell them.  Call
+// without the lock held, after the stream has been removed.
+func (m *Manager) end(s *stream) {
+	if err := m.sendStop(s); err != nil {
+		logging.Logger(nil).WithError(err).Warnf("stopping live stream for %s", s.deviceID)
+	}
+
+	if m.ended != nil {
+		m.ended(s.deviceID)
+	}
+}
@@ -0,0 +1,121 @@
+package livestream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
+)
+
+// Counts the commands sent to the fake, and fails them once told to
+type failingClient struct {
+	sdmapi.SmartDeviceManagement
+
+	mu       sync.Mutex
+	commands int
+	failing  bool
+}
+
+func (c *failingClient) SendCommand(deviceID string, command sdmapi.Command) (interface{}, error) {
+	c.mu.Lock()
+	c.commands++
+	failing := c.failing
+	c.mu.Unlock()
+
+	if failing {
+		return nil, errors.New("stream not found")
+	}
+	return c.SmartDeviceManagement.SendCommand(deviceID, command)
+}
+
+func (c *failingClient) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failing = true
+}
+
+func (c *failingClient) sent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.commands
+}
+
+func newTestClient(t *testing.T) *failingClient {
+	fake := sdmapi.NewFakeClient("my-project-id")
+	if err := fake.LoadFile("../../../sample-sdm-fixtures.json"); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+
+	return &failingClient{SmartDeviceManagement: fake}
+}
+
+// The active stream of a device, as the extension timer would find it
+func (m *Manager) testStream(deviceID string) *stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.streams[deviceID]
+}
+
+func TestManagerExtend(t *testing.T) {
+	client := newTestClient(t)
+	m := NewManager()
+	defer m.StopAll()
+
+	rtsp, err := m.Attach(client, "doorbell1")
+	if err != nil {
+		t.Fatalf("attaching: %v", err)
+	}
+
+	m.extend(m.testStream("doorbell1"))
+
+	extended, ok := m.Stream("doorbell1")
+	if !ok {
+		t.Fatal("stream dropped after extending it")
+	}
+	if extended.ExtensionToken == rtsp.ExtensionToken {
+		t.Error("kept the old extension token")
+	}
+	if extended.URL == rtsp.URL {
+		t.Error("kept the old stream token in the URL")
+	}
+	if extended.ExpiresAt.Before(rtsp.ExpiresAt) {
+		t.Errorf("extended stream expires at %s, before %s", extended.ExpiresAt, rtsp.ExpiresAt)
+	}
+}
+
+func TestManagerExtendFails(t *testing.T) {
+	client := newTestClient(t)
+
+	var ended []string
+	m := NewManager().WithEndedFunc(func(deviceID string) {
+		ended = append(ended, deviceID)
+	})
+
+	if _, err := m.Attach(client, "doorbell1"); err != nil {
+		t.Fatalf("attaching: %v", err)
+	}
+
+	client.fail()
+	m.extend(m.testStream("doorbell1"))
+
+	if _, ok := m.Stream("doorbell1"); ok {
+		t.Error("kept a stream that couldn't be extended")
+	}
+	if len(ended) != 1 || ended[0] != "doorbell1" {
+		t.Errorf("told consumers that %v ended, want doorbell1", ended)
+	}
+
+	// Generated, extended and stopped
+	if n := client.sent(); n != 3 {
+		t.Errorf("sent %d commands, want the stream to be stopped", n)
+	}
+
+	// The last consumer detaching has nothing left to stop
+	if err := m.Detach("doorbell1"); err != nil || client.sent() != 3 {
+		t.Errorf("detaching from the dropped stream: %v, %d commands", err, client.sent())
+	}
+}
@@ -28,6 +28,16 @@ func WithTxnID(ctx context.Context, txnID string) context.Context {
 	return context.WithValue(ctx, txnIDKey, txnID)
 }
 
+// Detached returns a context that carries the transaction ID of ctx but
+// not its deadline or cancellation, for work that outlives a request
+func Detached(ctx context.Context) context.Context {
+	if txnID, ok := ctx.Value(txnIDKey).(string); ok {
+		return WithTxnID(context.Background(), txnID)
+	}
+
+	return context.Background()
+}
+
 type logger struct {
 	logger  *logrus.Entry
 	logFile *os.File
@@ -52,6 +62,11 @@ func Logger(ctx context.Context) *logrus.Entry {
 	return gLogger.logger
 }
 
+// Audit returns the logger for audit log entries
+func Audit(ctx context.Context) *logrus.Entry {
+	return Logger(ctx).WithField("entrytype", "audit")
+}
+
 func init() {
 	// Viper defaults
 	viper.SetDefault("logging.location", "stderr")
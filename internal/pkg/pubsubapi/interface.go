@@ -7,11 +7,36 @@ import (
 	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
 )
 
+// Types of relation update
+type RelationType string
+
+const (
+	RelationCreated RelationType = "CREATED"
+	RelationDeleted RelationType = "DELETED"
+	RelationUpdated RelationType = "UPDATED"
+)
+
+// A change to the relation between a device and a structure or room, eg.
+// a device added to or removed from a home.  The subject is the long name of
+// the structure or room, the device is the DeviceID of the event.
+type RelationUpdate struct {
+	Type    RelationType
+	Subject string
+}
+
+// A message received from the SDM topic.  Trait updates populate Traits,
+// device events (motion, chime etc.) populate Events and the thread details,
+// and relation updates populate Relation.
 type SdmEvent struct {
-	AckID     string
-	DeviceID  string
-	Timestamp time.Time
-	Traits    sdmapi.Traits
+	AckID       string
+	DeviceID    string
+	UserID      string
+	Timestamp   time.Time
+	Traits      sdmapi.Traits
+	Events      []sdmapi.DeviceEvent
+	ThreadID    string
+	ThreadState sdmapi.EventThreadState
+	Relation    *RelationUpdate
 }
 
 type PubSub interface {
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/sdmapi"
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	apioption "google.golang.org/api/option"
 	pubsubv1 "google.golang.org/api/pubsub/v1"
 )
@@ -23,6 +27,7 @@ type Live struct {
 	maxMessageAge  time.Duration
 	logMessages    bool
 	ctx            context.Context
+	transport      http.RoundTripper
 }
 
 func NewLiveClient(sdmProjectID string, gcpProjectID string, subscriptionID string) *Live {
@@ -65,8 +70,47 @@ func (c *Live) WithLogMessages() *Live {
 	return &nc
 }
 
+// WithTransport sends API requests through the given transport, eg. to
+// record or replay them.  With a transport and no credentials file, requests
+// are sent without valid credentials, which is only useful for replay.
+func (c *Live) WithTransport(rt http.RoundTripper) *Live {
+	nc := *c
+	nc.transport = rt
+	return &nc
+}
+
+func (c *Live) tokenSource() (oauth2.TokenSource, error) {
+	if c.credsFile == "" {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "none"}), nil
+	}
+
+	data, err := ioutil.ReadFile(c.credsFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading credentials file %s", c.credsFile)
+	}
+
+	creds, err := google.CredentialsFromJSON(context.TODO(), data, pubsubv1.PubsubScope)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing credentials")
+	}
+
+	return creds.TokenSource, nil
+}
+
 func (c *Live) api() (*pubsubv1.Service, error) {
-	pubsub, err := pubsubv1.NewService(context.TODO(), apioption.WithCredentialsFile(c.credsFile))
+	opt := apioption.WithCredentialsFile(c.credsFile)
+	if c.transport != nil {
+		ts, err := c.tokenSource()
+		if err != nil {
+			return nil, err
+		}
+
+		opt = apioption.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: c.transport},
+		})
+	}
+
+	pubsub, err := pubsubv1.NewService(context.TODO(), opt)
 	if err != nil {
 		return nil, err
 	}
@@ -100,18 +144,60 @@ func (c *Live) MakeContext() (context.Context, context.CancelFunc) {
 	},
 	"userId": "AVPHwEuBfnPOnTqzVFT4IONX2Qqhu9EJ4ubO-bNnQ-yi"
 }
+
+  Message format for device events:
+
+{
+	"eventId" : "8cbd2c8a-0e0e-4bcd-b2ec-9fd3c7f9bc47",
+	"timestamp" : "2019-01-01T00:00:01Z",
+	"resourceUpdate" : {
+	  "name" : "enterprises/project-id/devices/device-id",
+	  "events" : {
+		"sdm.devices.events.CameraMotion.Motion" : {
+		  "eventSessionId" : "CjY5Y3VKaTZwR3o4Y19YbTVfMF...",
+		  "eventId" : "n:1"
+		}
+	  }
+	},
+	"userId": "AVPHwEuBfnPOnTqzVFT4IONX2Qqhu9EJ4ubO-bNnQ-yi",
+	"eventThreadId" : "d67cd3f7-86a7-425e-8bb3-462f92ec9f59",
+	"eventThreadState" : "STARTED"
+}
+
+  Message format for relation updates:
+
+{
+	"eventId" : "0120ecc7-3b57-4eb4-9941-91609f189fb4",
+	"timestamp" : "2019-01-01T00:00:01Z",
+	"relationUpdate" : {
+	  "type" : "CREATED",
+	  "subject" : "enterprises/project-id/structures/structure-id",
+	  "object" : "enterprises/project-id/devices/device-id"
+	},
+	"userId": "AVPHwEuBfnPOnTqzVFT4IONX2Qqhu9EJ4ubO-bNnQ-yi"
+}
 */
 
 type sdmResourceUpdate struct {
 	Name   string          `json:"name"`
-	Traits json.RawMessage `json:"traits"`
+	Traits json.RawMessage `json:"traits,omitempty"`
+	Events json.RawMessage `json:"events,omitempty"`
+}
+
+type sdmRelationUpdate struct {
+	Type    string `json:"type"`
+	Subject string `json:"subject"`
+	Object  string `json:"object"`
 }
 
 type sdmEvent struct {
-	EventID        string             `json:"eventID"`
-	Timestamp      time.Time          `json:"timestamp"`
-	ResourceUpdate *sdmResourceUpdate `json:"resourceUpdate,omitempty"`
-	UserID         string             `json:"userId"`
+	EventID          string             `json:"eventID"`
+	Timestamp        time.Time          `json:"timestamp"`
+	ResourceUpdate   *sdmResourceUpdate `json:"resourceUpdate,omitempty"`
+	RelationUpdate   *sdmRelationUpdate `json:"relationUpdate,omitempty"`
+	UserID           string             `json:"userId"`
+	EventThreadID    string             `json:"eventThreadId,omitempty"`
+	EventThreadState string             `json:"eventThreadState,omitempty"`
 }
 
 func (c *Live) AckMessages(ackIDs []string) error {
@@ -171,23 +257,54 @@ func (c *Live) parseReceivedMessages(messages []*pubsubv1.ReceivedMessage) (toAc
 			continue
 		}
 
+		if event.RelationUpdate != nil {
+			parsedEvent := SdmEvent{
+				AckID:     message.AckId,
+				Timestamp: event.Timestamp,
+				DeviceID:  c.shortDeviceName(event.RelationUpdate.Object),
+				UserID:    event.UserID,
+				Traits:    sdmapi.NewTraits(),
+				Relation: &RelationUpdate{
+					Type:    RelationType(event.RelationUpdate.Type),
+					Subject: event.RelationUpdate.Subject,
+				},
+			}
+			events = append(events, parsedEvent)
+			continue
+		}
+
 		if event.ResourceUpdate == nil {
-			logging.Logger(nil).Warnf("ignoring message ID %s, not a resource update (%s)", message.Message.MessageId, message.Message.Data)
+			logging.Logger(nil).Warnf("ignoring message ID %s, not a resource or relation update (%s)", message.Message.MessageId, message.Message.Data)
 			toAck = append(toAck, message.AckId)
 			continue
 		}
 
 		t := sdmapi.NewTraits()
-		if err := t.Parse(event.ResourceUpdate.Traits); err != nil {
-			logging.Logger(nil).WithError(err).Error("parsing device traits")
-			continue
+		if len(event.ResourceUpdate.Traits) > 0 {
+			if err := t.Parse(event.ResourceUpdate.Traits); err != nil {
+				logging.Logger(nil).WithError(err).Error("parsing device traits")
+				continue
+			}
+		}
+
+		var deviceEvents []sdmapi.DeviceEvent
+		if len(event.ResourceUpdate.Events) > 0 {
+			deviceEvents, err = sdmapi.ParseEvents(event.ResourceUpdate.Events)
+			if err != nil {
+				logging.Logger(nil).WithError(err).Error("parsing device events")
+				continue
+			}
 		}
 
 		parsedEvent := SdmEvent{
-			AckID:     message.AckId,
-			Timestamp: event.Timestamp,
-			DeviceID:  c.shortDeviceName(event.ResourceUpdate.Name),
-			Traits:    t,
+			AckID:       message.AckId,
+			Timestamp:   event.Timestamp,
+			DeviceID:    c.shortDeviceName(event.ResourceUpdate.Name),
+			UserID:      event.UserID,
+			Traits:      t,
+			Events:      deviceEvents,
+			ThreadID:    event.EventThreadID,
+			ThreadState: sdmapi.EventThreadState(event.EventThreadState),
 		}
 		events = append(events, parsedEvent)
 	}
@@ -1,6 +1,10 @@
 package sdmapi
 
 import (
+	"encoding/json"
+	"sort"
+	"strings"
+
 	"github.com/jake-scott/smartthings-nest/generated/models"
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 )
@@ -84,32 +88,40 @@ func (t DeviceHumidityTraits) ToSmartthingsState(traits Traits) []*models.Device
 }
 
 func (t DeviceTemperatureTraits) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	scale := traits.TemperatureScale()
+
 	model := models.DeviceStateStatesItems0{
 		Component:  "main",
 		Capability: "st.temperatureMeasurement",
 		Attribute:  "temperature",
-		Value:      t.AmbientTemperatureCelsius,
+		Value:      scale.FromCelsius(t.AmbientTemperatureCelsius),
 		DeviceStateStatesItems0AdditionalProperties: make(map[string]interface{}),
 	}
 
-	model.DeviceStateStatesItems0AdditionalProperties["unit"] = "C"
+	model.DeviceStateStatesItems0AdditionalProperties["unit"] = scale.Unit()
 
 	return []*models.DeviceStateStatesItems0{&model}
 }
 
-func (t DeviceThermostatMode) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
-	var mode string
-	switch t.mode {
-	case thermostatModeOff:
-		mode = "off"
+// The Smartthings name of a thermostat mode
+func (m thermostatMode) stMode() string {
+	switch m {
 	case thermostatModeHeat:
-		mode = "heat"
+		return "heat"
 	case thermostatModeCool:
-		mode = "cool"
+		return "cool"
 	case thermostatModeHeatCool:
-		mode = "auto"
+		return "auto"
+	case thermostatModeEco:
+		return "eco"
 	}
 
+	return "off"
+}
+
+func (t DeviceThermostatMode) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	mode := t.mode.stMode()
+
 	// Express mode as 'eco' if Nest is in Eco mode
 	ecoTrait := traits.Trait(sdmDevicesTraitsThermostatEco)
 	if ecoTrait != nil && ecoTrait.(*DeviceThermostatEco).Enabled {
@@ -124,11 +136,22 @@ func (t DeviceThermostatMode) ToSmartthingsState(traits Traits) []*models.Device
 		Value:      mode,
 	}
 
+	// Only advertise the modes that the device supports
+	supportedModes := make([]string, 0, 5)
+	for _, m := range []thermostatMode{thermostatModeOff, thermostatModeHeat, thermostatModeCool, thermostatModeHeatCool} {
+		if t.Supports(m) {
+			supportedModes = append(supportedModes, m.stMode())
+		}
+	}
+	if ecoTrait != nil && ecoTrait.(*DeviceThermostatEco).ManualAvailable {
+		supportedModes = append(supportedModes, thermostatModeEco.stMode())
+	}
+
 	model2 := models.DeviceStateStatesItems0{
 		Component:  "main",
 		Capability: "st.thermostatMode",
 		Attribute:  "supportedThermostatModes",
-		Value:      []string{"off", "heat", "cool", "auto", "eco"},
+		Value:      supportedModes,
 	}
 
 	return []*models.DeviceStateStatesItems0{&model1, &model2}
@@ -178,15 +201,17 @@ func (t DeviceThermostatTemperatureSetpoint) ToSmartthingsState(traits Traits) [
 		heatPoint = t.HeatCelsius
 	}
 
+	scale := traits.TemperatureScale()
+
 	if coolPoint > 0 {
 		model := models.DeviceStateStatesItems0{
 			Component:  "main",
 			Capability: "st.thermostatCoolingSetpoint",
 			Attribute:  "coolingSetpoint",
-			Value:      coolPoint,
+			Value:      scale.SetpointFromCelsius(coolPoint),
 			DeviceStateStatesItems0AdditionalProperties: make(map[string]interface{}),
 		}
-		model.DeviceStateStatesItems0AdditionalProperties["unit"] = "C"
+		model.DeviceStateStatesItems0AdditionalProperties["unit"] = scale.Unit()
 		modelList = append(modelList, &model)
 	}
 
@@ -195,12 +220,154 @@ func (t DeviceThermostatTemperatureSetpoint) ToSmartthingsState(traits Traits) [
 			Component:  "main",
 			Capability: "st.thermostatHeatingSetpoint",
 			Attribute:  "heatingSetpoint",
-			Value:      heatPoint,
+			Value:      scale.SetpointFromCelsius(heatPoint),
 			DeviceStateStatesItems0AdditionalProperties: make(map[string]interface{}),
 		}
-		model.DeviceStateStatesItems0AdditionalProperties["unit"] = "C"
+		model.DeviceStateStatesItems0AdditionalProperties["unit"] = scale.Unit()
 		modelList = append(modelList, &model)
 	}
 
 	return modelList
 }
+
+// Motion is only ever reported as active by an event, the resting state is inactive
+func (t DeviceCameraMotionTraits) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.motionSensor",
+		Attribute:  "motion",
+		Value:      "inactive",
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+// Person detection is exposed as a motion sensor on its own component so that
+// it can be distinguished from plain motion
+func (t DeviceCameraPersonTraits) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	model := models.DeviceStateStatesItems0{
+		Component:  "person",
+		Capability: "st.motionSensor",
+		Attribute:  "motion",
+		Value:      "inactive",
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+func (t DeviceCameraSoundTraits) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.soundSensor",
+		Attribute:  "sound",
+		Value:      "not detected",
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+// The chime is a single button that can only be pushed
+func (t DeviceDoorbellChimeTraits) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	model1 := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.button",
+		Attribute:  "numberOfButtons",
+		Value:      1,
+	}
+	model2 := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.button",
+		Attribute:  "supportedButtonValues",
+		Value:      []string{"pushed"},
+	}
+
+	return []*models.DeviceStateStatesItems0{&model1, &model2}
+}
+
+// Name of the eco mode capability within the custom capability namespace
+const ecoModeCapabilityName = "ecoMode"
+
+// EcoModeCapability returns the ID of the eco mode capability in a namespace
+func EcoModeCapability(namespace string) string {
+	return namespace + "." + ecoModeCapabilityName
+}
+
+// Convert the eco trait to the state of the eco mode capability, which
+// distinguishes eco turned on by the user from eco turned on by Nest.  Returns
+// nil if the device has no eco trait.
+func (t *Traits) EcoModeToSmartthingsStates(capability string) []*models.DeviceStateStatesItems0 {
+	eco, ok := t.traits[sdmDevicesTraitsThermostatEco].(*DeviceThermostatEco)
+	if !ok {
+		return nil
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: capability,
+		Attribute:  "ecoMode",
+		Value:      eco.Mode.String(),
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+// Convert the traits to the states of every custom capability in a namespace
+func (t *Traits) CustomToSmartthingsStates(namespace string) []*models.DeviceStateStatesItems0 {
+	var states []*models.DeviceStateStatesItems0
+
+	states = append(states, t.FanTimerToSmartthingsStates(FanTimerCapability(namespace))...)
+	states = append(states, t.EcoModeToSmartthingsStates(EcoModeCapability(namespace))...)
+	states = append(states, t.UnknownToSmartthingsStates(namespace)...)
+
+	return states
+}
+
+// Convert the traits that we don't have an adapter for to states of custom
+// capabilities in the given namespace.  The capability is named after the
+// trait, eg. sdm.devices.traits.CameraClipPreview becomes
+// <namespace>.cameraClipPreview, and each field of the trait becomes an
+// attribute of the capability.
+func (t *Traits) UnknownToSmartthingsStates(namespace string) []*models.DeviceStateStatesItems0 {
+	var states []*models.DeviceStateStatesItems0
+
+	for _, traitName := range t.UnknownTraitNames() {
+		capability := customCapabilityName(namespace, traitName)
+		if capability == "" {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(t.unknown[traitName], &fields); err != nil {
+			logging.Logger(nil).WithError(err).Debugf("Ignoring unknown trait %s, not an object", traitName)
+			continue
+		}
+
+		attributes := make([]string, 0, len(fields))
+		for attribute := range fields {
+			attributes = append(attributes, attribute)
+		}
+		sort.Strings(attributes)
+
+		for _, attribute := range attributes {
+			model := models.DeviceStateStatesItems0{
+				Component:  "main",
+				Capability: capability,
+				Attribute:  attribute,
+				Value:      fields[attribute],
+			}
+			states = append(states, &model)
+		}
+	}
+
+	return states
+}
+
+func customCapabilityName(namespace string, traitName string) string {
+	i := strings.LastIndex(traitName, ".")
+	name := traitName[i+1:]
+	if name == "" {
+		return ""
+	}
+
+	return namespace + "." + strings.ToLower(name[:1]) + name[1:]
+}
@@ -29,10 +29,16 @@ type devicesFanCommandParams struct {
 	Duration  string `json:"duration,omitempty"`
 }
 
-func NewFanCommand(timerEnabled bool, duration time.Duration) Command {
+// NewFanCommand starts the fan timer for a duration between 1s and 12h, or
+// stops it.  The duration is ignored when stopping the timer.
+func NewFanCommand(timerEnabled bool, duration time.Duration) (Command, error) {
 	mode := "OFF"
 	var durString string
 	if timerEnabled {
+		if err := checkFanTimerDuration(duration); err != nil {
+			return nil, err
+		}
+
 		mode = "ON"
 		durString = fmt.Sprintf("%.0fs", duration.Seconds())
 	}
@@ -41,7 +47,7 @@ func NewFanCommand(timerEnabled bool, duration time.Duration) Command {
 		command:   newCommand("sdm.devices.commands.Fan.SetTimer"),
 		TimerMode: mode,
 		Duration:  durString,
-	}
+	}, nil
 }
 
 type devicesThermostatEcoCommandParams struct {
@@ -49,15 +55,17 @@ type devicesThermostatEcoCommandParams struct {
 	Mode string `json:"mode"`
 }
 
-func NewThermostatEcoCommand(enabled bool) Command {
-	mode := "OFF"
-	if enabled {
-		mode = "MANUAL_ECO"
+// NewThermostatEcoCommand turns manual eco mode on or off.  Auto eco is
+// controlled by Nest, and can't be selected by a command.
+func NewThermostatEcoCommand(mode EcoMode) Command {
+	modeStr := "OFF"
+	if mode == EcoModeManual {
+		modeStr = "MANUAL_ECO"
 	}
 
 	return devicesThermostatEcoCommandParams{
 		command: newCommand("sdm.devices.commands.ThermostatEco.SetMode"),
-		Mode:    mode,
+		Mode:    modeStr,
 	}
 }
 
@@ -119,7 +127,71 @@ func NewThermostatTemperatureSetpointRangeCommand(heatTemp, coolTemp float32) Co
 	}
 }
 
-func StCommandToSdmCommands(stCommand *models.Command) ([]Command, error) {
+/*
+ *   Camera live stream commands
+ */
+
+type devicesCameraLiveStreamGenerateRtspStreamCommandParams struct {
+	command
+}
+
+func NewGenerateRtspStreamCommand() Command {
+	return devicesCameraLiveStreamGenerateRtspStreamCommandParams{
+		command: newCommand("sdm.devices.commands.CameraLiveStream.GenerateRtspStream"),
+	}
+}
+
+func (c devicesCameraLiveStreamGenerateRtspStreamCommandParams) newResults() resultsReader {
+	return &rtspStreamResults{}
+}
+
+type devicesCameraLiveStreamExtendRtspStreamCommandParams struct {
+	command
+	StreamExtensionToken string `json:"streamExtensionToken"`
+}
+
+func NewExtendRtspStreamCommand(extensionToken string) Command {
+	return devicesCameraLiveStreamExtendRtspStreamCommandParams{
+		command:              newCommand("sdm.devices.commands.CameraLiveStream.ExtendRtspStream"),
+		StreamExtensionToken: extensionToken,
+	}
+}
+
+func (c devicesCameraLiveStreamExtendRtspStreamCommandParams) newResults() resultsReader {
+	return &rtspStreamResults{}
+}
+
+type devicesCameraLiveStreamStopRtspStreamCommandParams struct {
+	command
+	StreamExtensionToken string `json:"streamExtensionToken"`
+}
+
+func NewStopRtspStreamCommand(extensionToken string) Command {
+	return devicesCameraLiveStreamStopRtspStreamCommandParams{
+		command:              newCommand("sdm.devices.commands.CameraLiveStream.StopRtspStream"),
+		StreamExtensionToken: extensionToken,
+	}
+}
+
+type devicesCameraLiveStreamGenerateWebRtcStreamCommandParams struct {
+	command
+	OfferSdp string `json:"offerSdp"`
+}
+
+func NewGenerateWebRtcStreamCommand(offerSdp string) Command {
+	return devicesCameraLiveStreamGenerateWebRtcStreamCommandParams{
+		command:  newCommand("sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream"),
+		OfferSdp: offerSdp,
+	}
+}
+
+func (c devicesCameraLiveStreamGenerateWebRtcStreamCommandParams) newResults() resultsReader {
+	return &webRtcStreamResults{}
+}
+
+// Convert a Smartthings command to SDM commands, given the current traits of
+// the device.  Returns nil if the command isn't supported.
+func StCommandToSdmCommands(stCommand *models.Command, traits Traits) ([]Command, error) {
 	var stArgs stCommandParamsReader
 
 	switch *stCommand.Capability {
@@ -134,7 +206,7 @@ func StCommandToSdmCommands(stCommand *models.Command) ([]Command, error) {
 	}
 
 	if stArgs == nil {
-		logging.Logger(nil).Debugf("Ignoring unimplemented Smartthings capability [%s]", stCommand.Capability)
+		logging.Logger(nil).Debugf("Ignoring unimplemented Smartthings capability [%s]", *stCommand.Capability)
 		return nil, nil
 	}
 
@@ -142,7 +214,7 @@ func StCommandToSdmCommands(stCommand *models.Command) ([]Command, error) {
 		return nil, errors.Wrap(err, "unmarshaling smartthings command arguments")
 	}
 
-	return stArgs.ToSdmCommands(), nil
+	return stArgs.ToSdmCommands(traits)
 }
 
 type stCommandThermostatModeSetMode struct {
@@ -150,7 +222,7 @@ type stCommandThermostatModeSetMode struct {
 }
 
 func (t *stCommandThermostatModeSetMode) Unmarshal(args []interface{}) error {
-	if len(args) > 1 {
+	if len(args) != 1 {
 		return fmt.Errorf("expected 1 argument for CommandThermostatModeSetMode, got %d", len(args))
 	}
 
@@ -170,22 +242,37 @@ func (t *stCommandThermostatModeSetMode) Unmarshal(args []interface{}) error {
 		t.mode = thermostatModeHeatCool
 	case "eco":
 		t.mode = thermostatModeEco
+	default:
+		return newConstraintError("unsupported thermostat mode: %s", stMode)
 	}
 
 	return nil
 }
 
-func (t *stCommandThermostatModeSetMode) ToSdmCommands() []Command {
+func (t *stCommandThermostatModeSetMode) ToSdmCommands(traits Traits) ([]Command, error) {
+	// Reject modes that the device doesn't support
+	if t.mode == thermostatModeEco {
+		if eco, ok := traits.Trait(sdmDevicesTraitsThermostatEco).(*DeviceThermostatEco); !ok || !eco.ManualAvailable {
+			return nil, newConstraintError("the thermostat does not support eco mode")
+		}
+	} else if modeTrait, ok := traits.Trait(sdmDevicesTraitsThermostatMode).(*DeviceThermostatMode); ok && !modeTrait.Supports(t.mode) {
+		return nil, newConstraintError("the thermostat does not support %s mode", t.mode)
+	}
+
 	commands := make([]Command, 0, 2)
 
 	if t.mode == thermostatModeEco {
-		commands = append(commands, NewThermostatEcoCommand(true))
-	} else {
-		commands = append(commands, NewThermostatEcoCommand(false))
-		commands = append(commands, NewThermostatModeCommand(t.mode))
+		commands = append(commands, NewThermostatEcoCommand(EcoModeManual))
+		return commands, nil
+	}
+
+	// Only turn off eco that the user turned on, auto eco is left to Nest
+	if eco, ok := traits.Trait(sdmDevicesTraitsThermostatEco).(*DeviceThermostatEco); ok && eco.Mode == EcoModeManual {
+		commands = append(commands, NewThermostatEcoCommand(EcoModeOff))
 	}
+	commands = append(commands, NewThermostatModeCommand(t.mode))
 
-	return commands
+	return commands, nil
 }
 
 type stCommandThermostatFanModeSetThermostatFanMode struct {
@@ -208,15 +295,20 @@ func (t *stCommandThermostatFanModeSetThermostatFanMode) Unmarshal(args []interf
 	case "auto":
 		t.timerModeEnabled = false
 	default:
-		return fmt.Errorf("unsupported fan mode: %s", stMode)
+		return newConstraintError("unsupported fan mode: %s", stMode)
 	}
 
 	return nil
 }
 
-func (t *stCommandThermostatFanModeSetThermostatFanMode) ToSdmCommands() []Command {
-	// TODO: find a way to let the user choose the duration
-	return []Command{NewFanCommand(t.timerModeEnabled, time.Second*3600)}
+// The fan runs for the duration configured for the device
+func (t *stCommandThermostatFanModeSetThermostatFanMode) ToSdmCommands(traits Traits) ([]Command, error) {
+	command, err := NewFanCommand(t.timerModeEnabled, traits.FanTimerDuration())
+	if err != nil {
+		return nil, err
+	}
+
+	return []Command{command}, nil
 }
 
 type stCommandThermostatHeatingSetpoint struct {
@@ -240,8 +332,10 @@ func (t *stCommandThermostatHeatingSetpoint) Unmarshal(args []interface{}) error
 	return nil
 }
 
-func (t *stCommandThermostatHeatingSetpoint) ToSdmCommands() []Command {
-	return []Command{NewThermostatTemperatureSetpointHeatCommand(t.temperature)}
+// The setpoint is in the scale that we report temperatures to Smartthings in
+func (t *stCommandThermostatHeatingSetpoint) ToSdmCommands(traits Traits) ([]Command, error) {
+	celsius := traits.TemperatureScale().ToCelsius(t.temperature)
+	return setpointCommands(traits, thermostatModeHeat, celsius)
 }
 
 type stCommandThermostatCoolingSetpoint struct {
@@ -265,6 +359,100 @@ func (t *stCommandThermostatCoolingSetpoint) Unmarshal(args []interface{}) error
 	return nil
 }
 
-func (t *stCommandThermostatCoolingSetpoint) ToSdmCommands() []Command {
-	return []Command{NewThermostatTemperatureSetpointCoolCommand(t.temperature)}
+// The setpoint is in the scale that we report temperatures to Smartthings in
+func (t *stCommandThermostatCoolingSetpoint) ToSdmCommands(traits Traits) ([]Command, error) {
+	celsius := traits.TemperatureScale().ToCelsius(t.temperature)
+	return setpointCommands(traits, thermostatModeCool, celsius)
+}
+
+// Minimum gap between the heat and cool setpoints in HEATCOOL mode
+const setpointDeadbandCelsius = 1.5
+
+// Choose the SDM command that changes the heat or cool setpoint (which is
+// given by 'which') in the current mode of the thermostat.  In HEATCOOL mode
+// both setpoints have to be sent, and the other setpoint is moved if needed to
+// keep the minimum gap between them.
+func setpointCommands(traits Traits, which thermostatMode, celsius float32) ([]Command, error) {
+	if eco, ok := traits.Trait(sdmDevicesTraitsThermostatEco).(*DeviceThermostatEco); ok && eco.Enabled {
+		return nil, newConstraintError("setpoints cannot be changed while eco mode is active")
+	}
+
+	// Without a mode trait, assume the setpoint can be set directly
+	mode := which
+	if modeTrait, ok := traits.Trait(sdmDevicesTraitsThermostatMode).(*DeviceThermostatMode); ok {
+		mode = modeTrait.mode
+	}
+
+	switch mode {
+	case thermostatModeHeat, thermostatModeCool:
+		if mode != which {
+			return nil, newConstraintError("the %s setpoint cannot be changed in %s mode", which.String(), mode.String())
+		}
+		if which == thermostatModeHeat {
+			return []Command{NewThermostatTemperatureSetpointHeatCommand(celsius)}, nil
+		}
+		return []Command{NewThermostatTemperatureSetpointCoolCommand(celsius)}, nil
+
+	case thermostatModeHeatCool:
+		var heat, cool float32
+		if setpoint, ok := traits.Trait(sdmDevicesTraitsThermostatTemperatureSetpoint).(*DeviceThermostatTemperatureSetpoint); ok {
+			heat = setpoint.HeatCelsius
+			cool = setpoint.CoolCelsius
+		}
+
+		if which == thermostatModeHeat {
+			heat = celsius
+			if cool-heat < setpointDeadbandCelsius {
+				cool = heat + setpointDeadbandCelsius
+			}
+		} else {
+			cool = celsius
+			if cool-heat < setpointDeadbandCelsius {
+				heat = cool - setpointDeadbandCelsius
+			}
+		}
+
+		return []Command{NewThermostatTemperatureSetpointRangeCommand(heat, cool)}, nil
+	}
+
+	return nil, newConstraintError("setpoints cannot be changed while the thermostat is off")
+}
+
+// ApplyCommand updates the traits for a command that the device has accepted,
+// so that the later commands of a request are converted for the mode the
+// device is now in, rather than the mode it was fetched in
+func (t *Traits) ApplyCommand(command Command) {
+	switch c := command.(type) {
+	case devicesThermostatModeCommandParams:
+		if modeTrait, ok := t.Trait(sdmDevicesTraitsThermostatMode).(*DeviceThermostatMode); ok {
+			if mode, ok := parseThermostatMode(c.Mode); ok {
+				modeTrait.mode = mode
+			}
+		}
+
+	case devicesThermostatEcoCommandParams:
+		if eco, ok := t.Trait(sdmDevicesTraitsThermostatEco).(*DeviceThermostatEco); ok {
+			eco.Enabled = c.Mode == "MANUAL_ECO"
+			eco.Mode = EcoModeOff
+			if eco.Enabled {
+				eco.Mode = EcoModeManual
+			}
+		}
+
+	case devicesThermostatTemperatureSetpointHeatCommandParams:
+		if setpoint, ok := t.Trait(sdmDevicesTraitsThermostatTemperatureSetpoint).(*DeviceThermostatTemperatureSetpoint); ok {
+			setpoint.HeatCelsius = c.HeatCelsius
+		}
+
+	case devicesThermostatTemperatureSetpointCoolCommandParams:
+		if setpoint, ok := t.Trait(sdmDevicesTraitsThermostatTemperatureSetpoint).(*DeviceThermostatTemperatureSetpoint); ok {
+			setpoint.CoolCelsius = c.CoolCelsius
+		}
+
+	case devicesThermostatTemperatureSetpointRangeCommandParams:
+		if setpoint, ok := t.Trait(sdmDevicesTraitsThermostatTemperatureSetpoint).(*DeviceThermostatTemperatureSetpoint); ok {
+			setpoint.HeatCelsius = c.HeatCelsius
+			setpoint.CoolCelsius = c.CoolCelsius
+		}
+	}
 }
@@ -0,0 +1,18 @@
+package sdmapi
+
+import "fmt"
+
+// ConstraintError is returned when a Smartthings command can't be applied to
+// a device in its current state, eg. changing the setpoint of a thermostat
+// that is switched off
+type ConstraintError struct {
+	msg string
+}
+
+func newConstraintError(format string, args ...interface{}) *ConstraintError {
+	return &ConstraintError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *ConstraintError) Error() string {
+	return e.msg
+}
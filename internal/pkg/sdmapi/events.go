@@ -0,0 +1,174 @@
+package sdmapi
+
+import (
+	"encoding/json"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+)
+
+/*
+ *   Supported Google Smart Device Management event names
+ */
+
+var eventNames = map[string]func() DeviceEvent{
+	"sdm.devices.events.CameraMotion.Motion": func() DeviceEvent { return &CameraMotionEvent{} },
+	"sdm.devices.events.CameraPerson.Person": func() DeviceEvent { return &CameraPersonEvent{} },
+	"sdm.devices.events.CameraSound.Sound":   func() DeviceEvent { return &CameraSoundEvent{} },
+	"sdm.devices.events.DoorbellChime.Chime": func() DeviceEvent { return &DoorbellChimeEvent{} },
+}
+
+// State of the event thread that an event belongs to.  Events that were
+// not sent as part of a thread have an empty thread state.
+type EventThreadState string
+
+const (
+	EventThreadStarted EventThreadState = "STARTED"
+	EventThreadUpdated EventThreadState = "UPDATED"
+	EventThreadEnded   EventThreadState = "ENDED"
+)
+
+// A device event, eg. motion detected by a camera
+type DeviceEvent interface {
+	Name() string
+	SessionID() string
+}
+
+// Convert an event to a set of SmartThings device states.  When the thread
+// has ended the states should reflect the device returning to its resting state.
+type StEvent interface {
+	ToSmartthingsEvent(threadState EventThreadState) []*models.DeviceStateStatesItems0
+}
+
+// Common data included with every event
+type deviceEventData struct {
+	EventSessionID string `json:"eventSessionId"`
+	EventID        string `json:"eventId"`
+}
+
+func (e deviceEventData) SessionID() string {
+	return e.EventSessionID
+}
+
+// Parse a set of events from JSON
+func ParseEvents(data []byte) ([]DeviceEvent, error) {
+	logging.Logger(nil).Debugf("Event data: [%s]", data)
+	var allEvents map[string]json.RawMessage
+	if err := json.Unmarshal(data, &allEvents); err != nil {
+		return nil, err
+	}
+
+	var events []DeviceEvent
+	for eventName, v := range allEvents {
+		newEvent, ok := eventNames[eventName]
+		if !ok {
+			logging.Logger(nil).Debugf("Ignoring unimplemented event [%s]", eventName)
+			continue
+		}
+
+		decoded := newEvent()
+		if err := json.Unmarshal(v, decoded); err != nil {
+			return nil, err
+		}
+
+		events = append(events, decoded)
+	}
+
+	return events, nil
+}
+
+type CameraMotionEvent struct {
+	deviceEventData
+}
+
+func (e *CameraMotionEvent) Name() string {
+	return "sdm.devices.events.CameraMotion.Motion"
+}
+
+func (e *CameraMotionEvent) ToSmartthingsEvent(threadState EventThreadState) []*models.DeviceStateStatesItems0 {
+	value := "active"
+	if threadState == EventThreadEnded {
+		value = "inactive"
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.motionSensor",
+		Attribute:  "motion",
+		Value:      value,
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+type CameraPersonEvent struct {
+	deviceEventData
+}
+
+func (e *CameraPersonEvent) Name() string {
+	return "sdm.devices.events.CameraPerson.Person"
+}
+
+func (e *CameraPersonEvent) ToSmartthingsEvent(threadState EventThreadState) []*models.DeviceStateStatesItems0 {
+	value := "active"
+	if threadState == EventThreadEnded {
+		value = "inactive"
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "person",
+		Capability: "st.motionSensor",
+		Attribute:  "motion",
+		Value:      value,
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+type CameraSoundEvent struct {
+	deviceEventData
+}
+
+func (e *CameraSoundEvent) Name() string {
+	return "sdm.devices.events.CameraSound.Sound"
+}
+
+func (e *CameraSoundEvent) ToSmartthingsEvent(threadState EventThreadState) []*models.DeviceStateStatesItems0 {
+	value := "detected"
+	if threadState == EventThreadEnded {
+		value = "not detected"
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.soundSensor",
+		Attribute:  "sound",
+		Value:      value,
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
+
+type DoorbellChimeEvent struct {
+	deviceEventData
+}
+
+func (e *DoorbellChimeEvent) Name() string {
+	return "sdm.devices.events.DoorbellChime.Chime"
+}
+
+// A button push has no resting state, so only the start of a thread is sent
+func (e *DoorbellChimeEvent) ToSmartthingsEvent(threadState EventThreadState) []*models.DeviceStateStatesItems0 {
+	if threadState == EventThreadUpdated || threadState == EventThreadEnded {
+		return nil
+	}
+
+	model := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: "st.button",
+		Attribute:  "button",
+		Value:      "pushed",
+	}
+
+	return []*models.DeviceStateStatesItems0{&model}
+}
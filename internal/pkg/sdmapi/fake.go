@@ -0,0 +1,709 @@
+package sdmapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+ * Fake is an in-memory implementation of the SmartDeviceManagement interface
+ * that can be used in place of the Google API when testing.
+ *
+ * It is seeded from a JSON fixture file containing structures, rooms and
+ * devices in the same format as returned by the SDM API :
+ *
+ * {
+ *   "structures": [ { "name": "enterprises/project-id/structures/s1", "traits": { ... } } ],
+ *   "rooms":      [ { "name": "enterprises/project-id/structures/s1/rooms/r1", "traits": { ... } } ],
+ *   "devices":    [ { "name": "enterprises/project-id/devices/d1", "type": "sdm.devices.types.THERMOSTAT",
+ *                     "traits": { ... }, "parentRelations": [ ... ] } ]
+ * }
+ *
+ * Commands sent to the fake are validated using the same rules as the SDM API
+ * and update the device traits accordingly.  The fake can optionally simulate
+ * the ambient temperature drifting towards the active setpoint.
+ */
+
+const (
+	fakeDefaultHeatCelsius = 20.0
+	fakeDefaultCoolCelsius = 24.0
+
+	// Minimum gap between heat and cool setpoints in HEATCOOL mode
+	fakeMinRangeCelsius = 1.5
+
+	// Fan timer duration limits
+	fakeMaxFanTimerSeconds = 43200
+)
+
+type fakeResource struct {
+	Name            string                            `json:"name"`
+	Type            string                            `json:"type,omitempty"`
+	Traits          map[string]map[string]interface{} `json:"traits"`
+	ParentRelations []ParentRelation                  `json:"parentRelations,omitempty"`
+}
+
+type fakeFixtures struct {
+	Structures []fakeResource `json:"structures"`
+	Rooms      []fakeResource `json:"rooms"`
+	Devices    []fakeResource `json:"devices"`
+}
+
+// Device state that isn't visible in the traits all the time
+type fakeDevice struct {
+	fakeResource
+	heatCelsius float64
+	coolCelsius float64
+}
+
+type fakeState struct {
+	mu sync.Mutex
+
+	structures []fakeResource
+	rooms      []fakeResource
+	devices    []*fakeDevice
+
+	requiredToken string
+
+	// Temperature simulation
+	simulate      bool
+	degreesPerMin float64
+	lastStep      time.Time
+
+	// Added to the wall clock by Advance()
+	clockOffset time.Duration
+}
+
+type Fake struct {
+	sdmProjectID string
+	accessToken  string
+	timeout      time.Duration
+	state        *fakeState
+}
+
+func NewFakeClient(sdmProjectID string) *Fake {
+	return &Fake{
+		sdmProjectID: "enterprises/" + sdmProjectID,
+		state:        &fakeState{},
+	}
+}
+
+func (c *Fake) WithAccessToken(token string) SmartDeviceManagement {
+	nc := *c
+	nc.accessToken = token
+	return &nc
+}
+
+func (c *Fake) WithTimeout(d time.Duration) SmartDeviceManagement {
+	nc := *c
+	nc.timeout = d
+	return &nc
+}
+
+// WithRequiredAccessToken makes the fake reject calls that don't use the
+// given access token, with a 401 error
+func (c *Fake) WithRequiredAccessToken(token string) *Fake {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.requiredToken = token
+	return c
+}
+
+// WithSimulation makes the ambient temperature of thermostats drift towards
+// their setpoint by degreesPerHour, with the HVAC status following along.
+// The simulation is advanced by the wall clock on every call, or explicitly
+// by calling Advance().
+func (c *Fake) WithSimulation(degreesPerHour float64) *Fake {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.simulate = true
+	c.state.degreesPerMin = degreesPerHour / 60
+	c.state.lastStep = c.state.now()
+	return c
+}
+
+// LoadFile seeds the fake from a JSON fixture file
+func (c *Fake) LoadFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "opening SDM fixtures %s", fileName)
+	}
+	defer file.Close()
+
+	return c.Load(file)
+}
+
+// Load seeds the fake from JSON fixtures, replacing any existing data
+func (c *Fake) Load(r io.Reader) error {
+	var fixtures fakeFixtures
+	if err := json.NewDecoder(r).Decode(&fixtures); err != nil {
+		return errors.Wrap(err, "decoding SDM fixtures")
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.structures = fixtures.Structures
+	c.state.rooms = fixtures.Rooms
+	c.state.devices = nil
+
+	for _, r := range fixtures.Devices {
+		if r.Traits == nil {
+			r.Traits = make(map[string]map[string]interface{})
+		}
+
+		d := &fakeDevice{
+			fakeResource: r,
+			heatCelsius:  fakeDefaultHeatCelsius,
+			coolCelsius:  fakeDefaultCoolCelsius,
+		}
+
+		if sp, ok := r.Traits["sdm.devices.traits.ThermostatTemperatureSetpoint"]; ok {
+			if v, ok := sp["heatCelsius"].(float64); ok {
+				d.heatCelsius = v
+			}
+			if v, ok := sp["coolCelsius"].(float64); ok {
+				d.coolCelsius = v
+			}
+		}
+
+		c.state.devices = append(c.state.devices, d)
+	}
+
+	return nil
+}
+
+// Advance moves the fake's clock forward by d, expiring fan timers and
+// advancing the temperature simulation
+func (c *Fake) Advance(d time.Duration) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.clockOffset += d
+	c.state.step(d)
+	c.state.lastStep = c.state.now()
+}
+
+// SetTrait replaces the data of a single device trait, eg. to simulate a
+// change made on the device itself
+func (c *Fake) SetTrait(deviceID string, traitName string, data map[string]interface{}) error {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	d := c.state.device(c.longDeviceName(deviceID))
+	if d == nil {
+		return c.notFound(deviceID)
+	}
+
+	d.Traits[traitName] = data
+	return nil
+}
+
+func (c *Fake) shortDeviceName(longName string) string {
+	return strings.TrimPrefix(longName, c.sdmProjectID+"/devices/")
+}
+
+func (c *Fake) longDeviceName(shortName string) string {
+	return c.sdmProjectID + "/devices/" + shortName
+}
+
+// Common checks and housekeeping for every call, call with the lock held
+func (c *Fake) begin() error {
+	if c.state.requiredToken != "" && c.accessToken != c.state.requiredToken {
+		return &googleapi.Error{
+			Code:    401,
+			Message: "Request had invalid authentication credentials.",
+			Errors:  []googleapi.ErrorItem{{Reason: "authError", Message: "Invalid Credentials"}},
+		}
+	}
+
+	now := c.state.now()
+	var elapsed time.Duration
+	if c.state.simulate {
+		elapsed = now.Sub(c.state.lastStep)
+	}
+	c.state.step(elapsed)
+	c.state.lastStep = now
+
+	return nil
+}
+
+func (c *Fake) notFound(deviceID string) error {
+	return &googleapi.Error{
+		Code:    404,
+		Message: fmt.Sprintf("Device %s not found.", c.longDeviceName(deviceID)),
+		Errors:  []googleapi.ErrorItem{{Reason: "notFound"}},
+	}
+}
+
+func invalidArgument(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return &googleapi.Error{
+		Code:    400,
+		Message: msg,
+		Errors:  []googleapi.ErrorItem{{Reason: "invalidArgument", Message: msg}},
+	}
+}
+
+func failedPrecondition(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return &googleapi.Error{
+		Code:    400,
+		Message: msg,
+		Errors:  []googleapi.ErrorItem{{Reason: "failedPrecondition", Message: msg}},
+	}
+}
+
+func parseFakeTraits(traits map[string]map[string]interface{}) (Traits, error) {
+	t := NewTraits()
+
+	data, err := json.Marshal(traits)
+	if err != nil {
+		return t, err
+	}
+
+	if err := t.Parse(data); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+func (c *Fake) Structures() ([]Structure, error) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if err := c.begin(); err != nil {
+		return nil, errors.Wrap(err, "listing structures")
+	}
+
+	var items []Structure
+	for _, s := range c.state.structures {
+		t, err := parseFakeTraits(s.Traits)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing structure traits")
+		}
+
+		item := Structure{
+			ID:     s.Name,
+			Traits: t,
+		}
+		if info := t.StructureInfo(); info != nil {
+			item.CustomName = info.CustomName
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (c *Fake) Rooms(structureID string) ([]Room, error) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if err := c.begin(); err != nil {
+		return nil, errors.Wrap(err, "listing rooms")
+	}
+
+	var items []Room
+	for _, r := range c.state.rooms {
+		if !strings.HasPrefix(r.Name, structureID+"/rooms/") {
+			continue
+		}
+
+		t, err := parseFakeTraits(r.Traits)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing room traits")
+		}
+
+		item := Room{
+			ID:     r.Name,
+			Traits: t,
+		}
+		if info := t.RoomInfo(); info != nil {
+			item.CustomName = info.CustomName
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (c *Fake) Devices() ([]Device, error) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if err := c.begin(); err != nil {
+		return nil, errors.Wrap(err, "listing devices")
+	}
+
+	var items []Device
+	for _, d := range c.state.devices {
+		t, err := parseFakeTraits(d.Traits)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing device traits")
+		}
+
+		items = append(items, Device{
+			ID:              c.shortDeviceName(d.Name),
+			DeviceType:      d.Type,
+			Traits:          t,
+			ParentRelations: d.ParentRelations,
+		})
+	}
+
+	return items, nil
+}
+
+func (c *Fake) GetDevice(deviceID string) (*Device, error) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if err := c.begin(); err != nil {
+		return nil, errors.Wrap(err, "fetching device details")
+	}
+
+	d := c.state.device(c.longDeviceName(deviceID))
+	if d == nil {
+		return nil, errors.Wrap(c.notFound(deviceID), "fetching device details")
+	}
+
+	t, err := parseFakeTraits(d.Traits)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing device traits")
+	}
+
+	return &Device{
+		ID:              deviceID,
+		DeviceType:      d.Type,
+		Traits:          t,
+		ParentRelations: d.ParentRelations,
+	}, nil
+}
+
+func (c *Fake) SendCommand(deviceID string, command Command) (interface{}, error) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	cmdParams, err := json.Marshal(command)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling command parameters")
+	}
+
+	logging.Logger(nil).Debugf("fake: sending command: %s, params %s", command.commandName(), string(cmdParams))
+
+	if err := c.begin(); err != nil {
+		return nil, errors.Wrapf(err, "executing command: %s, params %s", command.commandName(), string(cmdParams))
+	}
+
+	d := c.state.device(c.longDeviceName(deviceID))
+	if d == nil {
+		return nil, errors.Wrapf(c.notFound(deviceID), "executing command: %s, params %s", command.commandName(), string(cmdParams))
+	}
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(cmdParams, &params); err != nil {
+		return nil, errors.Wrap(err, "decoding command parameters")
+	}
+
+	results, err := c.state.execute(d, command.commandName(), params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "executing command: %s, params %s", command.commandName(), string(cmdParams))
+	}
+
+	if results == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding command results")
+	}
+
+	return parseCommandResults(command, data)
+}
+
+/*
+ *  Fake device state, all methods must be called with the lock held
+ */
+
+func (s *fakeState) now() time.Time {
+	return time.Now().Add(s.clockOffset)
+}
+
+func (s *fakeState) device(name string) *fakeDevice {
+	for _, d := range s.devices {
+		if d.Name == name {
+			return d
+		}
+	}
+
+	return nil
+}
+
+func traitString(d *fakeDevice, trait, field string) string {
+	v, _ := d.Traits[trait][field].(string)
+	return v
+}
+
+func traitFloat(d *fakeDevice, trait, field string) (float64, bool) {
+	v, ok := d.Traits[trait][field].(float64)
+	return v, ok
+}
+
+func traitAllows(d *fakeDevice, trait, value string) bool {
+	modes, ok := d.Traits[trait]["availableModes"].([]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, m := range modes {
+		if m == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *fakeState) execute(d *fakeDevice, name string, params map[string]interface{}) (map[string]interface{}, error) {
+	paramString := func(key string) string {
+		v, _ := params[key].(string)
+		return v
+	}
+	paramFloat := func(key string) (float64, error) {
+		v, ok := params[key].(float64)
+		if !ok {
+			return 0, invalidArgument("Invalid value for %s.", key)
+		}
+		return v, nil
+	}
+
+	switch name {
+	case "sdm.devices.commands.ThermostatMode.SetMode":
+		mode := paramString("mode")
+		if !traitAllows(d, "sdm.devices.traits.ThermostatMode", mode) {
+			return nil, invalidArgument("Invalid mode %s.", mode)
+		}
+		d.Traits["sdm.devices.traits.ThermostatMode"]["mode"] = mode
+		s.updateSetpointTrait(d)
+
+	case "sdm.devices.commands.ThermostatEco.SetMode":
+		mode := paramString("mode")
+		if !traitAllows(d, "sdm.devices.traits.ThermostatEco", mode) {
+			return nil, invalidArgument("Invalid eco mode %s.", mode)
+		}
+		d.Traits["sdm.devices.traits.ThermostatEco"]["mode"] = mode
+		s.updateSetpointTrait(d)
+
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat":
+		heat, err := paramFloat("heatCelsius")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkSetpointMode(d, "HEAT"); err != nil {
+			return nil, err
+		}
+		d.heatCelsius = heat
+		s.updateSetpointTrait(d)
+
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool":
+		cool, err := paramFloat("coolCelsius")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkSetpointMode(d, "COOL"); err != nil {
+			return nil, err
+		}
+		d.coolCelsius = cool
+		s.updateSetpointTrait(d)
+
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange":
+		heat, err := paramFloat("heatCelsius")
+		if err != nil {
+			return nil, err
+		}
+		cool, err := paramFloat("coolCelsius")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkSetpointMode(d, "HEATCOOL"); err != nil {
+			return nil, err
+		}
+		if cool-heat < fakeMinRangeCelsius {
+			return nil, invalidArgument("Cool value must be at least %.1f greater than heat value.", fakeMinRangeCelsius)
+		}
+		d.heatCelsius = heat
+		d.coolCelsius = cool
+		s.updateSetpointTrait(d)
+
+	case "sdm.devices.commands.Fan.SetTimer":
+		if _, ok := d.Traits["sdm.devices.traits.Fan"]; !ok {
+			return nil, invalidArgument("Command not supported.")
+		}
+		switch paramString("timerMode") {
+		case "ON":
+			duration := time.Second * fakeMaxFanTimerSeconds
+			if durString := paramString("duration"); durString != "" {
+				var err error
+				duration, err = time.ParseDuration(durString)
+				if err != nil || duration < time.Second || duration > time.Second*fakeMaxFanTimerSeconds {
+					return nil, invalidArgument("Invalid duration %s.", durString)
+				}
+			}
+			d.Traits["sdm.devices.traits.Fan"]["timerMode"] = "ON"
+			d.Traits["sdm.devices.traits.Fan"]["timerTimeout"] = s.now().Add(duration).UTC().Format(time.RFC3339)
+		case "OFF":
+			d.Traits["sdm.devices.traits.Fan"]["timerMode"] = "OFF"
+			delete(d.Traits["sdm.devices.traits.Fan"], "timerTimeout")
+		default:
+			return nil, invalidArgument("Invalid timer mode %s.", paramString("timerMode"))
+		}
+
+	case "sdm.devices.commands.CameraLiveStream.GenerateRtspStream",
+		"sdm.devices.commands.CameraLiveStream.ExtendRtspStream":
+		if _, ok := d.Traits["sdm.devices.traits.CameraLiveStream"]; !ok {
+			return nil, invalidArgument("Command not supported.")
+		}
+		token := uuid.New().String()
+		results := map[string]interface{}{
+			"streamExtensionToken": uuid.New().String(),
+			"streamToken":          token,
+			"expiresAt":            s.now().Add(time.Minute * 5).UTC().Format(time.RFC3339),
+		}
+		if name == "sdm.devices.commands.CameraLiveStream.GenerateRtspStream" {
+			results["streamUrls"] = map[string]interface{}{
+				"rtspUrl": "rtsps://fake.sdm.example.com/stream?auth=" + token,
+			}
+		}
+		return results, nil
+
+	case "sdm.devices.commands.CameraLiveStream.StopRtspStream":
+		if _, ok := d.Traits["sdm.devices.traits.CameraLiveStream"]; !ok {
+			return nil, invalidArgument("Command not supported.")
+		}
+
+	default:
+		return nil, invalidArgument("Command not supported.")
+	}
+
+	return nil, nil
+}
+
+// Setpoints can only be changed in the matching mode, and not when eco is active
+func (s *fakeState) checkSetpointMode(d *fakeDevice, need string) error {
+	if _, ok := d.Traits["sdm.devices.traits.ThermostatTemperatureSetpoint"]; !ok {
+		return invalidArgument("Command not supported.")
+	}
+
+	if eco := traitString(d, "sdm.devices.traits.ThermostatEco", "mode"); eco != "" && eco != "OFF" {
+		return failedPrecondition("Cannot change setpoint while in eco mode.")
+	}
+
+	if mode := traitString(d, "sdm.devices.traits.ThermostatMode", "mode"); mode != need {
+		return failedPrecondition("Cannot change setpoint in %s mode.", mode)
+	}
+
+	return nil
+}
+
+// The setpoint trait only contains the setpoints that are relevant to the
+// current mode
+func (s *fakeState) updateSetpointTrait(d *fakeDevice) {
+	if _, ok := d.Traits["sdm.devices.traits.ThermostatTemperatureSetpoint"]; !ok {
+		return
+	}
+
+	sp := make(map[string]interface{})
+
+	eco := traitString(d, "sdm.devices.traits.ThermostatEco", "mode")
+	if eco == "" || eco == "OFF" {
+		switch traitString(d, "sdm.devices.traits.ThermostatMode", "mode") {
+		case "HEAT":
+			sp["heatCelsius"] = d.heatCelsius
+		case "COOL":
+			sp["coolCelsius"] = d.coolCelsius
+		case "HEATCOOL":
+			sp["heatCelsius"] = d.heatCelsius
+			sp["coolCelsius"] = d.coolCelsius
+		}
+	}
+
+	d.Traits["sdm.devices.traits.ThermostatTemperatureSetpoint"] = sp
+}
+
+// The setpoints that the thermostat is currently aiming for, 0 if none
+func (s *fakeState) activeSetpoints(d *fakeDevice) (heat float64, cool float64) {
+	eco := traitString(d, "sdm.devices.traits.ThermostatEco", "mode")
+	if eco != "" && eco != "OFF" {
+		heat, _ = traitFloat(d, "sdm.devices.traits.ThermostatEco", "heatCelsius")
+		cool, _ = traitFloat(d, "sdm.devices.traits.ThermostatEco", "coolCelsius")
+		return
+	}
+
+	heat, _ = traitFloat(d, "sdm.devices.traits.ThermostatTemperatureSetpoint", "heatCelsius")
+	cool, _ = traitFloat(d, "sdm.devices.traits.ThermostatTemperatureSetpoint", "coolCelsius")
+	return
+}
+
+// Move time forward for every device : expire fan timers and, if simulation is
+// enabled, drift the ambient temperature towards the active setpoint
+func (s *fakeState) step(elapsed time.Duration) {
+	now := s.now()
+
+	for _, d := range s.devices {
+		if fan, ok := d.Traits["sdm.devices.traits.Fan"]; ok && fan["timerMode"] == "ON" {
+			timeout, err := time.Parse(time.RFC3339, traitString(d, "sdm.devices.traits.Fan", "timerTimeout"))
+			if err == nil && !now.Before(timeout) {
+				fan["timerMode"] = "OFF"
+				delete(fan, "timerTimeout")
+			}
+		}
+
+		if !s.simulate || elapsed <= 0 {
+			continue
+		}
+
+		ambient, ok := traitFloat(d, "sdm.devices.traits.Temperature", "ambientTemperatureCelsius")
+		if !ok {
+			continue
+		}
+
+		heat, cool := s.activeSetpoints(d)
+		delta := s.degreesPerMin * elapsed.Minutes()
+
+		status := "OFF"
+		switch {
+		case heat > 0 && ambient < heat:
+			ambient = math.Min(heat, ambient+delta)
+			status = "HEATING"
+		case cool > 0 && ambient > cool:
+			ambient = math.Max(cool, ambient-delta)
+			status = "COOLING"
+		}
+
+		// Once the setpoint is reached the HVAC goes idle
+		if (status == "HEATING" && ambient >= heat) || (status == "COOLING" && ambient <= cool) {
+			status = "OFF"
+		}
+
+		d.Traits["sdm.devices.traits.Temperature"]["ambientTemperatureCelsius"] = math.Round(ambient*100) / 100
+		if _, ok := d.Traits["sdm.devices.traits.ThermostatHvac"]; ok {
+			d.Traits["sdm.devices.traits.ThermostatHvac"]["status"] = status
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package sdmapi
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+const testFixtures = "../../../sample-sdm-fixtures.json"
+
+func newTestFake(t *testing.T) *Fake {
+	c := NewFakeClient("my-project-id")
+	if err := c.LoadFile(testFixtures); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+
+	return c
+}
+
+// A copy of the data of a device trait
+func fakeTrait(c *Fake, deviceID string, trait string) map[string]interface{} {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	d := c.state.device(c.longDeviceName(deviceID))
+	if d == nil {
+		return nil
+	}
+
+	data := make(map[string]interface{})
+	for k, v := range d.Traits[trait] {
+		data[k] = v
+	}
+
+	return data
+}
+
+func send(t *testing.T, c *Fake, deviceID string, command Command) error {
+	t.Helper()
+
+	_, err := c.SendCommand(deviceID, command)
+	return err
+}
+
+func mustSend(t *testing.T, c *Fake, deviceID string, command Command) {
+	t.Helper()
+
+	if err := send(t, c, deviceID, command); err != nil {
+		t.Fatalf("sending %s: %v", command.commandName(), err)
+	}
+}
+
+// The reason of the SDM API error, as the handlers see it
+func errorReason(err error) string {
+	apiErr, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok || len(apiErr.Errors) == 0 {
+		return ""
+	}
+
+	return apiErr.Errors[0].Reason
+}
+
+func wantReason(t *testing.T, err error, reason string) {
+	t.Helper()
+
+	if got := errorReason(err); got != reason {
+		t.Errorf("got error %v with reason %q, want %q", err, got, reason)
+	}
+}
+
+const (
+	traitMode     = "sdm.devices.traits.ThermostatMode"
+	traitSetpoint = "sdm.devices.traits.ThermostatTemperatureSetpoint"
+	traitFan      = "sdm.devices.traits.Fan"
+)
+
+func TestFakeSetMode(t *testing.T) {
+	c := newTestFake(t)
+
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeCool))
+
+	if mode := fakeTrait(c, "thermostat1", traitMode)["mode"]; mode != "COOL" {
+		t.Errorf("mode is %v, want COOL", mode)
+	}
+
+	// Only the setpoint of the mode is reported
+	sp := fakeTrait(c, "thermostat1", traitSetpoint)
+	if _, ok := sp["heatCelsius"]; ok || sp["coolCelsius"] != fakeDefaultCoolCelsius {
+		t.Errorf("setpoints are %v, want only the default cool setpoint", sp)
+	}
+
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeOff))
+	if sp := fakeTrait(c, "thermostat1", traitSetpoint); len(sp) != 0 {
+		t.Errorf("setpoints are %v when off, want none", sp)
+	}
+}
+
+func TestFakeSetModeUnavailable(t *testing.T) {
+	c := newTestFake(t)
+
+	err := c.SetTrait("thermostat1", traitMode, map[string]interface{}{
+		"availableModes": []interface{}{"HEAT", "OFF"},
+		"mode":           "HEAT",
+	})
+	if err != nil {
+		t.Fatalf("setting trait: %v", err)
+	}
+
+	wantReason(t, send(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeCool)), "invalidArgument")
+}
+
+func TestFakeSetpointNeedsMatchingMode(t *testing.T) {
+	c := newTestFake(t)
+
+	mustSend(t, c, "thermostat1", NewThermostatTemperatureSetpointHeatCommand(21.5))
+	if heat := fakeTrait(c, "thermostat1", traitSetpoint)["heatCelsius"]; heat != 21.5 {
+		t.Errorf("heat setpoint is %v, want 21.5", heat)
+	}
+
+	wantReason(t, send(t, c, "thermostat1", NewThermostatTemperatureSetpointCoolCommand(25)), "failedPrecondition")
+	wantReason(t, send(t, c, "thermostat1", NewThermostatTemperatureSetpointRangeCommand(19, 25)), "failedPrecondition")
+
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeCool))
+	wantReason(t, send(t, c, "thermostat1", NewThermostatTemperatureSetpointHeatCommand(21)), "failedPrecondition")
+}
+
+func TestFakeSetRange(t *testing.T) {
+	c := newTestFake(t)
+
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeHeatCool))
+
+	// The setpoints must be far enough apart
+	wantReason(t, send(t, c, "thermostat1", NewThermostatTemperatureSetpointRangeCommand(21, 22)), "invalidArgument")
+
+	mustSend(t, c, "thermostat1", NewThermostatTemperatureSetpointRangeCommand(19, 25))
+	sp := fakeTrait(c, "thermostat1", traitSetpoint)
+	if sp["heatCelsius"] != 19.0 || sp["coolCelsius"] != 25.0 {
+		t.Errorf("setpoints are %v, want 19 and 25", sp)
+	}
+
+	// The setpoints are kept while in another mode
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeHeat))
+	if heat := fakeTrait(c, "thermostat1", traitSetpoint)["heatCelsius"]; heat != 19.0 {
+		t.Errorf("heat setpoint is %v, want 19", heat)
+	}
+}
+
+func TestFakeEco(t *testing.T) {
+	c := newTestFake(t)
+
+	mustSend(t, c, "thermostat1", NewThermostatEcoCommand(EcoModeManual))
+
+	if sp := fakeTrait(c, "thermostat1", traitSetpoint); len(sp) != 0 {
+		t.Errorf("setpoints are %v in eco mode, want none", sp)
+	}
+	wantReason(t, send(t, c, "thermostat1", NewThermostatTemperatureSetpointHeatCommand(21)), "failedPrecondition")
+
+	mustSend(t, c, "thermostat1", NewThermostatEcoCommand(EcoModeOff))
+
+	if heat := fakeTrait(c, "thermostat1", traitSetpoint)["heatCelsius"]; heat != 20.0 {
+		t.Errorf("heat setpoint is %v after eco, want 20", heat)
+	}
+	mustSend(t, c, "thermostat1", NewThermostatTemperatureSetpointHeatCommand(21))
+}
+
+func TestFakeFanTimer(t *testing.T) {
+	c := newTestFake(t)
+
+	command, err := NewFanCommand(true, time.Minute*15)
+	if err != nil {
+		t.Fatalf("building fan command: %v", err)
+	}
+	mustSend(t, c, "thermostat1", command)
+
+	fan := fakeTrait(c, "thermostat1", traitFan)
+	if fan["timerMode"] != "ON" {
+		t.Fatalf("fan timer is %v, want ON", fan["timerMode"])
+	}
+
+	timeout, err := time.Parse(time.RFC3339, fan["timerTimeout"].(string))
+	if err != nil {
+		t.Fatalf("parsing timer timeout: %v", err)
+	}
+	if left := time.Until(timeout); left < time.Minute*14 || left > time.Minute*15 {
+		t.Errorf("timer ends in %s, want 15m", left)
+	}
+
+	c.Advance(time.Minute * 10)
+	if mode := fakeTrait(c, "thermostat1", traitFan)["timerMode"]; mode != "ON" {
+		t.Errorf("fan timer is %v after 10m, want ON", mode)
+	}
+
+	c.Advance(time.Minute * 10)
+	fan = fakeTrait(c, "thermostat1", traitFan)
+	if _, ok := fan["timerTimeout"]; ok || fan["timerMode"] != "OFF" {
+		t.Errorf("fan is %v after 20m, want the timer expired", fan)
+	}
+
+	mustSend(t, c, "thermostat1", command)
+	stop, err := NewFanCommand(false, 0)
+	if err != nil {
+		t.Fatalf("building fan command: %v", err)
+	}
+	mustSend(t, c, "thermostat1", stop)
+	if mode := fakeTrait(c, "thermostat1", traitFan)["timerMode"]; mode != "OFF" {
+		t.Errorf("fan timer is %v after stopping, want OFF", mode)
+	}
+
+	// Only devices with a fan have a timer
+	wantReason(t, send(t, c, "doorbell1", command), "invalidArgument")
+}
+
+func TestFakeAdvanceSimulation(t *testing.T) {
+	c := newTestFake(t).WithSimulation(6)
+
+	ambient := func() float64 {
+		v, _ := fakeTrait(c, "thermostat1", "sdm.devices.traits.Temperature")["ambientTemperatureCelsius"].(float64)
+		return v
+	}
+	hvac := func() interface{} {
+		return fakeTrait(c, "thermostat1", "sdm.devices.traits.ThermostatHvac")["status"]
+	}
+
+	// 18.5°C heating to 20°C at 6°C an hour
+	c.Advance(time.Minute * 10)
+	if v := ambient(); math.Abs(v-19.5) > 0.05 || hvac() != "HEATING" {
+		t.Errorf("after 10m ambient is %v and hvac %v, want 19.5 and HEATING", v, hvac())
+	}
+
+	c.Advance(time.Minute * 10)
+	if v := ambient(); v != 20 || hvac() != "OFF" {
+		t.Errorf("after 20m ambient is %v and hvac %v, want 20 and OFF", v, hvac())
+	}
+
+	// Cooling towards the cool setpoint once it is below the ambient
+	mustSend(t, c, "thermostat1", NewThermostatModeCommand(thermostatModeCool))
+	mustSend(t, c, "thermostat1", NewThermostatTemperatureSetpointCoolCommand(19))
+	c.Advance(time.Minute * 5)
+	if v := ambient(); math.Abs(v-19.5) > 0.05 || hvac() != "COOLING" {
+		t.Errorf("after cooling for 5m ambient is %v and hvac %v, want 19.5 and COOLING", v, hvac())
+	}
+}
+
+func TestFakeErrors(t *testing.T) {
+	c := newTestFake(t)
+
+	_, err := c.GetDevice("missing")
+	wantReason(t, err, "notFound")
+
+	c.WithRequiredAccessToken("good")
+	_, err = c.WithAccessToken("bad").Devices()
+	if apiErr, ok := errors.Cause(err).(*googleapi.Error); !ok || apiErr.Code != 401 {
+		t.Errorf("got %v with the wrong token, want a 401 error", err)
+	}
+	if _, err := c.WithAccessToken("good").Devices(); err != nil {
+		t.Errorf("listing devices with the right token: %v", err)
+	}
+}
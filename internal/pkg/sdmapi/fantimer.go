@@ -0,0 +1,150 @@
+package sdmapi
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+	"github.com/pkg/errors"
+)
+
+/*
+ *   The fan timer custom capability lets the user choose how long the fan runs
+ *   for, and shows the time remaining on the timer.  It has two attributes,
+ *   defaultDuration and remaining (both in seconds), and two commands :
+ *     startTimer(duration)  - run the fan, for the default duration if omitted
+ *     stopTimer()           - stop the fan timer
+ *
+ *   The default duration is also used when the fan is switched on through the
+ *   standard thermostatFanMode capability.  The duration of a running timer
+ *   isn't known, as Google only reports when it ends.
+ */
+
+// Limits of the SDM Fan.SetTimer command
+const (
+	MinFanTimerDuration     = time.Second
+	MaxFanTimerDuration     = time.Second * 43200
+	DefaultFanTimerDuration = time.Hour
+)
+
+// Name of the fan timer capability within the custom capability namespace
+const fanTimerCapabilityName = "fanTimer"
+
+// FanTimerCapability returns the ID of the fan timer capability in a namespace
+func FanTimerCapability(namespace string) string {
+	return namespace + "." + fanTimerCapabilityName
+}
+
+// FanTimerDurations holds the default fan timer duration, optionally
+// overridden for individual devices
+type FanTimerDurations struct {
+	Default time.Duration
+	Devices map[string]time.Duration
+}
+
+// For returns the fan timer duration to use for a device
+func (d FanTimerDurations) For(deviceID string) time.Duration {
+	if v, ok := d.Devices[deviceID]; ok {
+		return v
+	}
+
+	if d.Default > 0 {
+		return d.Default
+	}
+
+	return DefaultFanTimerDuration
+}
+
+func checkFanTimerDuration(duration time.Duration) error {
+	if duration < MinFanTimerDuration || duration > MaxFanTimerDuration {
+		return newConstraintError("fan timer duration %s is outside of the range %s to %s",
+			duration, MinFanTimerDuration, MaxFanTimerDuration)
+	}
+
+	return nil
+}
+
+// Check that a set of durations read from the config are valid
+func (d FanTimerDurations) Validate() error {
+	if d.Default != 0 {
+		if err := checkFanTimerDuration(d.Default); err != nil {
+			return errors.Wrap(err, "default fan timer duration")
+		}
+	}
+
+	for deviceID, duration := range d.Devices {
+		if err := checkFanTimerDuration(duration); err != nil {
+			return errors.Wrapf(err, "fan timer duration for device %s", deviceID)
+		}
+	}
+
+	return nil
+}
+
+// Convert the fan trait to the states of the fan timer capability, or nil if
+// the device has no fan
+func (t *Traits) FanTimerToSmartthingsStates(capability string) []*models.DeviceStateStatesItems0 {
+	fan, ok := t.traits[sdmDevicesTraitsFan].(*DeviceFanTraits)
+	if !ok {
+		return nil
+	}
+
+	var remaining int64
+	if fan.TimerModeEnabled {
+		if left := time.Until(fan.TimerTimeout); left > 0 {
+			remaining = int64(math.Ceil(left.Seconds()))
+		}
+	}
+
+	model1 := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: capability,
+		Attribute:  "defaultDuration",
+		Value:      int64(t.FanTimerDuration().Seconds()),
+		DeviceStateStatesItems0AdditionalProperties: map[string]interface{}{"unit": "s"},
+	}
+
+	model2 := models.DeviceStateStatesItems0{
+		Component:  "main",
+		Capability: capability,
+		Attribute:  "remaining",
+		Value:      remaining,
+		DeviceStateStatesItems0AdditionalProperties: map[string]interface{}{"unit": "s"},
+	}
+
+	return []*models.DeviceStateStatesItems0{&model1, &model2}
+}
+
+// Convert a fan timer capability command to SDM commands
+func FanTimerCommandToSdmCommands(stCommand *models.Command, traits Traits) ([]Command, error) {
+	switch *stCommand.Command {
+	case "startTimer":
+		duration := traits.FanTimerDuration()
+		if len(stCommand.Arguments) > 1 {
+			return nil, fmt.Errorf("expected at most 1 argument for startTimer, got %d", len(stCommand.Arguments))
+		}
+		if len(stCommand.Arguments) == 1 {
+			seconds, ok := stCommand.Arguments[0].(float64)
+			if !ok {
+				return nil, fmt.Errorf("expected numeric argument, have : %T : %+v", stCommand.Arguments[0], stCommand.Arguments[0])
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		}
+
+		command, err := NewFanCommand(true, duration)
+		if err != nil {
+			return nil, err
+		}
+		return []Command{command}, nil
+
+	case "stopTimer":
+		command, err := NewFanCommand(false, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []Command{command}, nil
+	}
+
+	return nil, nil
+}
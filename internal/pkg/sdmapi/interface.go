@@ -1,6 +1,9 @@
 package sdmapi
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Structure struct {
 	ID         string
@@ -14,19 +17,55 @@ type Room struct {
 	Traits     Traits
 }
 
+// Google device types
+const (
+	DeviceTypeThermostat = "sdm.devices.types.THERMOSTAT"
+	DeviceTypeCamera     = "sdm.devices.types.CAMERA"
+	DeviceTypeDoorbell   = "sdm.devices.types.DOORBELL"
+	DeviceTypeDisplay    = "sdm.devices.types.DISPLAY"
+)
+
 type Device struct {
 	ID         string
 	DeviceType string
 	Traits     Traits
+
+	// The structure and room that the device is assigned to
+	ParentRelations []ParentRelation
+}
+
+// A structure or room that a device is assigned to
+type ParentRelation struct {
+	// eg. enterprises/project-id/structures/s1/rooms/r1
+	Parent string `json:"parent"`
+
+	// The custom name of the structure or room
+	DisplayName string `json:"displayName"`
+}
+
+// IsRoom tells whether the parent is a room rather than a structure
+func (r ParentRelation) IsRoom() bool {
+	return strings.Contains(r.Parent, "/rooms/")
+}
+
+// StructureID returns the name of the structure that the parent is, or is in
+func (r ParentRelation) StructureID() string {
+	if i := strings.Index(r.Parent, "/rooms/"); i >= 0 {
+		return r.Parent[:i]
+	}
+
+	return r.Parent
 }
 
 type Command interface {
 	commandName() string
 }
 
+// Converts a Smartthings command to SDM commands.  The current traits of the
+// device are supplied to ToSdmCommands, eg. to know the temperature scale.
 type stCommandParamsReader interface {
 	Unmarshal(args []interface{}) error
-	ToSdmCommands() []Command
+	ToSdmCommands(traits Traits) ([]Command, error)
 }
 
 type SmartDeviceManagement interface {
@@ -36,5 +75,7 @@ type SmartDeviceManagement interface {
 	Rooms(structureID string) ([]Room, error)
 	Devices() ([]Device, error)
 	GetDevice(deviceID string) (*Device, error)
-	SendCommand(deviceID string, command Command) error
+	// SendCommand returns the decoded command results for commands that
+	// have them, else nil
+	SendCommand(deviceID string, command Command) (interface{}, error)
 }
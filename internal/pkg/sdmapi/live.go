@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
@@ -18,6 +19,7 @@ type Live struct {
 	sdmProjectID string
 	accessToken  string
 	timeout      time.Duration
+	transport    http.RoundTripper
 }
 
 func NewLiveClient(sdmProjectID string) *Live {
@@ -38,9 +40,25 @@ func (c *Live) WithTimeout(d time.Duration) SmartDeviceManagement {
 	return &nc
 }
 
+// WithTransport sends API requests through the given transport, eg. to
+// record or replay them
+func (c *Live) WithTransport(rt http.RoundTripper) *Live {
+	nc := *c
+	nc.transport = rt
+	return &nc
+}
+
 func (c *Live) api() (*sdmv1.Service, error) {
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.accessToken})
-	sdm, err := sdmv1.NewService(context.TODO(), apioption.WithTokenSource(ts))
+
+	opt := apioption.WithTokenSource(ts)
+	if c.transport != nil {
+		opt = apioption.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: c.transport},
+		})
+	}
+
+	sdm, err := sdmv1.NewService(context.TODO(), opt)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +101,9 @@ func (c *Live) Structures() ([]Structure, error) {
 			ID:     s.Name,
 			Traits: t,
 		}
+		if info := t.StructureInfo(); info != nil {
+			item.CustomName = info.CustomName
+		}
 
 		items = append(items, item)
 	}
@@ -115,6 +136,9 @@ func (c *Live) Rooms(structureID string) ([]Room, error) {
 			ID:     r.Name,
 			Traits: t,
 		}
+		if info := t.RoomInfo(); info != nil {
+			item.CustomName = info.CustomName
+		}
 
 		items = append(items, item)
 	}
@@ -144,9 +168,10 @@ func (c *Live) Devices() ([]Device, error) {
 		}
 
 		item := Device{
-			ID:         c.shortDeviceName(d.Name),
-			DeviceType: d.Type,
-			Traits:     t,
+			ID:              c.shortDeviceName(d.Name),
+			DeviceType:      d.Type,
+			Traits:          t,
+			ParentRelations: parentRelations(d.ParentRelations),
 		}
 
 		items = append(items, item)
@@ -155,6 +180,18 @@ func (c *Live) Devices() ([]Device, error) {
 	return items, nil
 }
 
+func parentRelations(relations []*sdmv1.GoogleHomeEnterpriseSdmV1ParentRelation) []ParentRelation {
+	items := make([]ParentRelation, 0, len(relations))
+	for _, r := range relations {
+		items = append(items, ParentRelation{
+			Parent:      r.Parent,
+			DisplayName: r.DisplayName,
+		})
+	}
+
+	return items
+}
+
 func (c *Live) shortDeviceName(longName string) string {
 	return strings.TrimPrefix(longName, c.sdmProjectID+"/devices/")
 }
@@ -184,18 +221,19 @@ func (c *Live) GetDevice(deviceID string) (*Device, error) {
 	}
 
 	item := &Device{
-		ID:         c.shortDeviceName(device.Name),
-		DeviceType: device.Type,
-		Traits:     t,
+		ID:              c.shortDeviceName(device.Name),
+		DeviceType:      device.Type,
+		Traits:          t,
+		ParentRelations: parentRelations(device.ParentRelations),
 	}
 
 	return item, nil
 }
 
-func (c *Live) SendCommand(deviceID string, command Command) error {
+func (c *Live) SendCommand(deviceID string, command Command) (interface{}, error) {
 	s, err := c.api()
 	if err != nil {
-		return errors.Wrap(err, "initialising the api")
+		return nil, errors.Wrap(err, "initialising the api")
 	}
 
 	ctx, cancel := c.MakeContext()
@@ -204,7 +242,7 @@ func (c *Live) SendCommand(deviceID string, command Command) error {
 	longDeviceName := c.longDeviceName(deviceID)
 	cmdParams, err := json.Marshal(command)
 	if err != nil {
-		return errors.Wrap(err, "marshaling command parameters")
+		return nil, errors.Wrap(err, "marshaling command parameters")
 	}
 
 	cmdRequest := sdmv1.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
@@ -216,12 +254,12 @@ func (c *Live) SendCommand(deviceID string, command Command) error {
 
 	resp, err := s.Enterprises.Devices.ExecuteCommand(longDeviceName, &cmdRequest).Context(ctx).Do()
 	if err != nil {
-		return errors.Wrapf(err, "executing command: %s, params %s", cmdRequest.Command, string(cmdRequest.Params))
+		return nil, errors.Wrapf(err, "executing command: %s, params %s", cmdRequest.Command, string(cmdRequest.Params))
 	}
 
 	if resp.HTTPStatusCode != 200 {
-		return fmt.Errorf("command response error: HTTP status %d, %s", resp.HTTPStatusCode, string(resp.Results))
+		return nil, fmt.Errorf("command response error: HTTP status %d, %s", resp.HTTPStatusCode, string(resp.Results))
 	}
 
-	return nil
+	return parseCommandResults(command, resp.Results)
 }
@@ -0,0 +1,163 @@
+package sdmapi
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jake-scott/smartthings-nest/generated/models"
+)
+
+/*
+ *   Registry of the Google Smart Device Management traits that we know how
+ *   to decode.  Each trait is registered once, with its SDM name, a function
+ *   returning a new decoder and optionally an adapter that converts the decoded
+ *   trait to Smartthings device states.
+ */
+
+// Identifies a registered trait
+type TraitID int
+
+// Converts a trait as read from Google, to internal representation.  The
+// decoder is populated by unmarshaling the trait JSON into it.
+type TraitDecoder interface {
+	Unmarshal() interface{}
+}
+
+// Converts a decoded trait to a set of Smartthings device states.  Traits
+// whose decoded value implements StCapability don't need an adapter.
+type StCapabilityAdapter func(value interface{}, traits Traits) []*models.DeviceStateStatesItems0
+
+// Describes a registered trait
+type TraitInfo struct {
+	ID         TraitID
+	Name       string
+	HasAdapter bool
+}
+
+type traitRegistration struct {
+	id         TraitID
+	name       string
+	newDecoder func() TraitDecoder
+	adapter    StCapabilityAdapter
+}
+
+type traitRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*traitRegistration
+	byID   []*traitRegistration
+}
+
+var registry = &traitRegistry{
+	byName: make(map[string]*traitRegistration),
+}
+
+// RegisterTrait adds a trait to the registry and returns its ID.  The adapter
+// may be nil.
+func RegisterTrait(name string, newDecoder func() TraitDecoder, adapter StCapabilityAdapter) (TraitID, error) {
+	if name == "" || newDecoder == nil {
+		return 0, fmt.Errorf("trait registration needs a name and a decoder")
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.byName[name]; ok {
+		return 0, fmt.Errorf("trait %s is already registered", name)
+	}
+
+	reg := &traitRegistration{
+		id:         TraitID(len(registry.byID)),
+		name:       name,
+		newDecoder: newDecoder,
+		adapter:    adapter,
+	}
+
+	registry.byName[name] = reg
+	registry.byID = append(registry.byID, reg)
+
+	return reg.id, nil
+}
+
+// MustRegisterTrait is like RegisterTrait but panics on error, for use when
+// initializing package variables
+func MustRegisterTrait(name string, newDecoder func() TraitDecoder, adapter StCapabilityAdapter) TraitID {
+	id, err := RegisterTrait(name, newDecoder, adapter)
+	if err != nil {
+		panic(err)
+	}
+
+	return id
+}
+
+// LookupTrait returns the ID of a registered trait given its SDM name
+func LookupTrait(name string) (TraitID, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	reg, ok := registry.byName[name]
+	if !ok {
+		return 0, false
+	}
+
+	return reg.id, true
+}
+
+// RegisteredTraits lists every registered trait, ordered by name
+func RegisteredTraits() []TraitInfo {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	infos := make([]TraitInfo, 0, len(registry.byID))
+	for _, reg := range registry.byID {
+		infos = append(infos, TraitInfo{
+			ID:         reg.id,
+			Name:       reg.name,
+			HasAdapter: reg.adapter != nil,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+func (r *traitRegistry) get(id TraitID) *traitRegistration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if int(id) < 0 || int(id) >= len(r.byID) {
+		return nil
+	}
+
+	return r.byID[id]
+}
+
+func (r *traitRegistry) lookup(name string) *traitRegistration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.byName[name]
+}
+
+// return the name of a trait
+func (id TraitID) Name() string {
+	reg := registry.get(id)
+	if reg == nil {
+		return fmt.Sprintf("unknown (id: %d)", id)
+	}
+
+	return reg.name
+}
+
+// Binds a registered adapter to a trait value
+type boundAdapter struct {
+	adapter StCapabilityAdapter
+	value   interface{}
+}
+
+func (a boundAdapter) ToSmartthingsState(traits Traits) []*models.DeviceStateStatesItems0 {
+	return a.adapter(a.value, traits)
+}
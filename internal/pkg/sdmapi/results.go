@@ -0,0 +1,117 @@
+package sdmapi
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ *   Results returned by commands
+ */
+
+// Convert command results as read from Google, to internal representation
+type resultsReader interface {
+	Unmarshal() interface{}
+}
+
+// Commands that return results know how to decode them
+type commandWithResults interface {
+	Command
+	newResults() resultsReader
+}
+
+// Decode the results of a command, if the command has any
+func parseCommandResults(command Command, data []byte) (interface{}, error) {
+	c, ok := command.(commandWithResults)
+	if !ok || len(data) == 0 {
+		return nil, nil
+	}
+
+	decoded := c.newResults()
+	if err := json.Unmarshal(data, decoded); err != nil {
+		return nil, errors.Wrapf(err, "decoding results of command %s", command.commandName())
+	}
+
+	return decoded.Unmarshal(), nil
+}
+
+type rtspStreamResults struct {
+	StreamURLs struct {
+		RtspURL string `json:"rtspUrl"`
+	} `json:"streamUrls"`
+	StreamExtensionToken string `json:"streamExtensionToken"`
+	StreamToken          string `json:"streamToken"`
+	ExpiresAt            string `json:"expiresAt"`
+}
+
+// An RTSP live stream, returned by the GenerateRtspStream and
+// ExtendRtspStream commands.  URL is only populated by GenerateRtspStream.
+type RtspStream struct {
+	URL            string
+	Token          string
+	ExtensionToken string
+	ExpiresAt      time.Time
+}
+
+// SetToken replaces the stream token, including the one in the URL, eg.
+// after the stream has been extended
+func (s *RtspStream) SetToken(token string) {
+	s.Token = token
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return
+	}
+
+	q := u.Query()
+	if q.Get("auth") != "" {
+		q.Set("auth", token)
+		u.RawQuery = q.Encode()
+		s.URL = u.String()
+	}
+}
+
+func (r *rtspStreamResults) Unmarshal() interface{} {
+	v := &RtspStream{
+		URL:            r.StreamURLs.RtspURL,
+		Token:          r.StreamToken,
+		ExtensionToken: r.StreamExtensionToken,
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+	if err == nil {
+		v.ExpiresAt = expiresAt
+	}
+
+	return v
+}
+
+type webRtcStreamResults struct {
+	AnswerSdp      string `json:"answerSdp"`
+	ExpiresAt      string `json:"expiresAt"`
+	MediaSessionID string `json:"mediaSessionId"`
+}
+
+// A WebRTC live stream, returned by the GenerateWebRtcStream command
+type WebRtcStream struct {
+	AnswerSdp      string
+	MediaSessionID string
+	ExpiresAt      time.Time
+}
+
+func (r *webRtcStreamResults) Unmarshal() interface{} {
+	v := &WebRtcStream{
+		AnswerSdp:      r.AnswerSdp,
+		MediaSessionID: r.MediaSessionID,
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+	if err == nil {
+		v.ExpiresAt = expiresAt
+	}
+
+	return v
+}
@@ -0,0 +1,88 @@
+package sdmapi
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+ *   Temperature conversion between the Celsius values used by the SDM API and
+ *   the scale that the user sees in Smartthings.  Nest thermostats use steps of
+ *   0.5°C or 1°F, so setpoints are rounded to the step of the scale they are
+ *   expressed in.  Measured temperatures are converted as they are.
+ */
+
+// ParseTemperatureScale converts a scale name from the config to a
+// TemperatureScale.  An empty name, or "device", returns nil meaning that the
+// scale configured on each device should be used.
+func ParseTemperatureScale(s string) (*TemperatureScale, error) {
+	var scale TemperatureScale
+
+	switch strings.ToLower(s) {
+	case "", "device":
+		return nil, nil
+	case "c", "celsius":
+		scale = TemperatureScaleCelsius
+	case "f", "fahrenheit":
+		scale = TemperatureScaleFarenheit
+	default:
+		return nil, fmt.Errorf("unknown temperature scale [%s], expected celsius, fahrenheit or device", s)
+	}
+
+	return &scale, nil
+}
+
+// The unit reported to Smartthings for the scale
+func (s TemperatureScale) Unit() string {
+	if s == TemperatureScaleFarenheit {
+		return "F"
+	}
+
+	return "C"
+}
+
+// The smallest change that a Nest thermostat makes in the scale
+func (s TemperatureScale) step() float64 {
+	if s == TemperatureScaleFarenheit {
+		return 1.0
+	}
+
+	return 0.5
+}
+
+func (s TemperatureScale) round(v float64) float64 {
+	return math.Round(v/s.step()) * s.step()
+}
+
+// FromCelsius converts a temperature from Google to the scale
+func (s TemperatureScale) FromCelsius(celsius float32) float32 {
+	v := float64(celsius)
+	if s == TemperatureScaleFarenheit {
+		v = v*9/5 + 32
+	}
+
+	return float32(v)
+}
+
+// SetpointFromCelsius converts a setpoint from Google to the scale, rounded to
+// the thermostat step size
+func (s TemperatureScale) SetpointFromCelsius(celsius float32) float32 {
+	v := float64(celsius)
+	if s == TemperatureScaleFarenheit {
+		v = v*9/5 + 32
+	}
+
+	return float32(s.round(v))
+}
+
+// ToCelsius rounds a temperature in the scale to the thermostat step size and
+// converts it to Celsius for Google
+func (s TemperatureScale) ToCelsius(v float32) float32 {
+	rounded := s.round(float64(v))
+	if s == TemperatureScaleFarenheit {
+		rounded = (rounded - 32) * 5 / 9
+	}
+
+	return float32(math.Round(rounded*100) / 100)
+}
@@ -2,88 +2,80 @@ package sdmapi
 
 import (
 	"encoding/json"
-	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 )
 
 /*
- *   Supported Google Smart Device Management trait identifiers and names
+ *   Supported Google Smart Device Management traits
  */
 
-type traitID int
-
-const (
-	sdmStructuresTraitsInfo traitID = iota
-	sdmStructuresTraitsRoomInfo
-	sdmDevicesTraitsConnectivity
-	sdmDevicesTraitsFan
-	sdmDevicesTraitsHumidity
-	sdmDevicesTraitsInfo
-	sdmDevicesTraitsSettings
-	sdmDevicesTraitsTemperature
-	sdmDevicesTraitsThermostatEco
-	sdmDevicesTraitsThermostatMode
-	sdmDevicesTraitsThermostatHvac
-	sdmDevicesTraitsThermostatTemperatureSetpoint
+var (
+	sdmStructuresTraitsInfo = MustRegisterTrait("sdm.structures.traits.Info",
+		func() TraitDecoder { return &StructuresInfoTraits{} }, nil)
+	sdmStructuresTraitsRoomInfo = MustRegisterTrait("sdm.structures.traits.RoomInfo",
+		func() TraitDecoder { return &RoomInfoTraits{} }, nil)
+	sdmDevicesTraitsConnectivity = MustRegisterTrait("sdm.devices.traits.Connectivity",
+		func() TraitDecoder { return &deviceConnectivityTraits{} }, nil)
+	sdmDevicesTraitsFan = MustRegisterTrait("sdm.devices.traits.Fan",
+		func() TraitDecoder { return &deviceFanTraits{} }, nil)
+	sdmDevicesTraitsHumidity = MustRegisterTrait("sdm.devices.traits.Humidity",
+		func() TraitDecoder { return &DeviceHumidityTraits{} }, nil)
+	sdmDevicesTraitsInfo = MustRegisterTrait("sdm.devices.traits.Info",
+		func() TraitDecoder { return &DeviceInfoTraits{} }, nil)
+	sdmDevicesTraitsSettings = MustRegisterTrait("sdm.devices.traits.Settings",
+		func() TraitDecoder { return &deviceSettingsTraits{} }, nil)
+	sdmDevicesTraitsTemperature = MustRegisterTrait("sdm.devices.traits.Temperature",
+		func() TraitDecoder { return &DeviceTemperatureTraits{} }, nil)
+	sdmDevicesTraitsThermostatEco = MustRegisterTrait("sdm.devices.traits.ThermostatEco",
+		func() TraitDecoder { return &deviceThermostatEco{} }, nil)
+	sdmDevicesTraitsThermostatMode = MustRegisterTrait("sdm.devices.traits.ThermostatMode",
+		func() TraitDecoder { return &deviceThermostatMode{} }, nil)
+	sdmDevicesTraitsThermostatHvac = MustRegisterTrait("sdm.devices.traits.ThermostatHvac",
+		func() TraitDecoder { return &deviceThermostatHvac{} }, nil)
+	sdmDevicesTraitsThermostatTemperatureSetpoint = MustRegisterTrait("sdm.devices.traits.ThermostatTemperatureSetpoint",
+		func() TraitDecoder { return &DeviceThermostatTemperatureSetpoint{} }, nil)
+	sdmDevicesTraitsCameraLiveStream = MustRegisterTrait("sdm.devices.traits.CameraLiveStream",
+		func() TraitDecoder { return &DeviceCameraLiveStreamTraits{} }, nil)
+	sdmDevicesTraitsCameraImage = MustRegisterTrait("sdm.devices.traits.CameraImage",
+		func() TraitDecoder { return &DeviceCameraImageTraits{} }, nil)
+	sdmDevicesTraitsCameraMotion = MustRegisterTrait("sdm.devices.traits.CameraMotion",
+		func() TraitDecoder { return &DeviceCameraMotionTraits{} }, nil)
+	sdmDevicesTraitsCameraPerson = MustRegisterTrait("sdm.devices.traits.CameraPerson",
+		func() TraitDecoder { return &DeviceCameraPersonTraits{} }, nil)
+	sdmDevicesTraitsCameraSound = MustRegisterTrait("sdm.devices.traits.CameraSound",
+		func() TraitDecoder { return &DeviceCameraSoundTraits{} }, nil)
+	sdmDevicesTraitsDoorbellChime = MustRegisterTrait("sdm.devices.traits.DoorbellChime",
+		func() TraitDecoder { return &DeviceDoorbellChimeTraits{} }, nil)
 )
 
-var traitNames = []string{
-	"sdm.structures.traits.Info",
-	"sdm.structures.traits.RoomInfo",
-	"sdm.devices.traits.Connectivity",
-	"sdm.devices.traits.Fan",
-	"sdm.devices.traits.Humidity",
-	"sdm.devices.traits.Info",
-	"sdm.devices.traits.Settings",
-	"sdm.devices.traits.Temperature",
-	"sdm.devices.traits.ThermostatEco",
-	"sdm.devices.traits.ThermostatMode",
-	"sdm.devices.traits.ThermostatHvac",
-	"sdm.devices.traits.ThermostatTemperatureSetpoint",
-}
-
-// convert a trait name to its ID
-func parseTraitName(name string) (bool, traitID) {
-	for i, val := range traitNames {
-		if val == name {
-			return true, traitID(i)
-		}
-	}
-
-	return false, 0
-}
-
-// return the name of a trait
-func (id traitID) Name() string {
-	if int(id) > len(traitNames) {
-		return fmt.Sprintf("unknown (id: %d)", id)
-	}
+// A set of traits for a device
+type Traits struct {
+	traits map[TraitID]interface{}
 
-	return traitNames[id]
-}
+	// Traits that aren't registered, kept as received from Google
+	unknown map[string]json.RawMessage
 
-// Convert a trait as read from Google, to internal representation
-type traitsReader interface {
-	Unmarshal() interface{}
-}
+	// Overrides the temperature scale of the device if set
+	scaleOverride *TemperatureScale
 
-// A set of traits for a device
-type Traits struct {
-	traits map[traitID]interface{}
+	// How long to run the fan for when the timer is started, if not the default
+	fanTimerDuration time.Duration
 }
 
 func NewTraits() Traits {
 	return Traits{
-		traits: make(map[traitID]interface{}),
+		traits:  make(map[TraitID]interface{}),
+		unknown: make(map[string]json.RawMessage),
 	}
 }
 
 // Return a list of traid IDs for the trait set
-func (t *Traits) TraitIDs() []traitID {
-	keys := make([]traitID, 0, len(t.traits))
+func (t *Traits) TraitIDs() []TraitID {
+	keys := make([]TraitID, 0, len(t.traits))
 	for k := range t.traits {
 		keys = append(keys, k)
 	}
@@ -92,7 +84,7 @@ func (t *Traits) TraitIDs() []traitID {
 }
 
 // Return the trait data from the trait set given its ID
-func (t *Traits) Trait(id traitID) interface{} {
+func (t *Traits) Trait(id TraitID) interface{} {
 	val, ok := t.traits[id]
 	if ok {
 		return val
@@ -100,6 +92,128 @@ func (t *Traits) Trait(id traitID) interface{} {
 	return nil
 }
 
+// Override the temperature scale configured on the device
+func (t *Traits) SetTemperatureScale(scale *TemperatureScale) {
+	t.scaleOverride = scale
+}
+
+// Return the scale that temperatures are presented to the user in : the
+// override if there is one, otherwise the scale configured on the device
+func (t *Traits) TemperatureScale() TemperatureScale {
+	if t.scaleOverride != nil {
+		return *t.scaleOverride
+	}
+
+	if v := t.Settings(); v != nil {
+		return v.TemperatureScale
+	}
+
+	return TemperatureScaleCelsius
+}
+
+// Return the names of the traits in the set that aren't registered
+func (t *Traits) UnknownTraitNames() []string {
+	names := make([]string, 0, len(t.unknown))
+	for name := range t.unknown {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Return the raw JSON data of a trait that isn't registered
+func (t *Traits) RawTrait(name string) (json.RawMessage, bool) {
+	data, ok := t.unknown[name]
+	return data, ok
+}
+
+// Return the Smartthings adapter for a trait in the set, or nil if the trait
+// can't be expressed in Smartthings
+func (t *Traits) StCapability(id TraitID) StCapability {
+	value, ok := t.traits[id]
+	if !ok {
+		return nil
+	}
+
+	if reg := registry.get(id); reg != nil && reg.adapter != nil {
+		return boundAdapter{adapter: reg.adapter, value: value}
+	}
+
+	if i, ok := value.(StCapability); ok {
+		return i
+	}
+
+	return nil
+}
+
+// Set how long the fan runs for when the timer is started without a duration
+func (t *Traits) SetFanTimerDuration(d time.Duration) {
+	t.fanTimerDuration = d
+}
+
+// Return how long the fan runs for when the timer is started without a duration
+func (t *Traits) FanTimerDuration() time.Duration {
+	if t.fanTimerDuration > 0 {
+		return t.fanTimerDuration
+	}
+
+	return DefaultFanTimerDuration
+}
+
+// Return the settings trait, or nil if it isn't in the set
+func (t *Traits) Settings() *DeviceSettingsTraits {
+	if v, ok := t.traits[sdmDevicesTraitsSettings].(*DeviceSettingsTraits); ok {
+		return v
+	}
+	return nil
+}
+
+// Return the structure info trait, or nil if it isn't in the set
+func (t *Traits) StructureInfo() *StructuresInfoTraits {
+	if v, ok := t.traits[sdmStructuresTraitsInfo].(*StructuresInfoTraits); ok {
+		return v
+	}
+	return nil
+}
+
+// Return the room info trait, or nil if it isn't in the set
+func (t *Traits) RoomInfo() *RoomInfoTraits {
+	if v, ok := t.traits[sdmStructuresTraitsRoomInfo].(*RoomInfoTraits); ok {
+		return v
+	}
+	return nil
+}
+
+// Return the device info trait, or nil if it isn't in the set
+func (t *Traits) Info() *DeviceInfoTraits {
+	if v, ok := t.traits[sdmDevicesTraitsInfo].(*DeviceInfoTraits); ok {
+		return v
+	}
+	return nil
+}
+
+// Tell whether the set has a trait, given its SDM name, whether or not the
+// trait is registered
+func (t *Traits) HasTrait(name string) bool {
+	if id, ok := LookupTrait(name); ok {
+		if _, ok := t.traits[id]; ok {
+			return true
+		}
+	}
+
+	_, ok := t.unknown[name]
+	return ok
+}
+
+// Return the camera live stream trait, or nil if the device has no camera
+func (t *Traits) CameraLiveStream() *DeviceCameraLiveStreamTraits {
+	if v, ok := t.traits[sdmDevicesTraitsCameraLiveStream].(*DeviceCameraLiveStreamTraits); ok {
+		return v
+	}
+	return nil
+}
+
 // Parse a set of traits from JSON into the trait set
 func (t *Traits) Parse(data []byte) error {
 	logging.Logger(nil).Debugf("Trait data: [%s]", data)
@@ -109,51 +223,19 @@ func (t *Traits) Parse(data []byte) error {
 	}
 
 	for traitName, v := range alltraits {
-		ok, traitID := parseTraitName(traitName)
-		if !ok {
-			logging.Logger(nil).Debugf("Ignoring unimplemented trait [%s]", traitName)
-			continue
-		}
-
-		var decoded traitsReader
-		switch traitID {
-		case sdmStructuresTraitsInfo:
-			decoded = &StructuresInfoTraits{}
-		case sdmStructuresTraitsRoomInfo:
-			decoded = &RoomInfoTraits{}
-		case sdmDevicesTraitsConnectivity:
-			decoded = &deviceConnectivityTraits{}
-		case sdmDevicesTraitsFan:
-			decoded = &deviceFanTraits{}
-		case sdmDevicesTraitsHumidity:
-			decoded = &DeviceHumidityTraits{}
-		case sdmDevicesTraitsInfo:
-			decoded = &DeviceInfoTraits{}
-		case sdmDevicesTraitsSettings:
-			decoded = &deviceSettingsTraits{}
-		case sdmDevicesTraitsTemperature:
-			decoded = &DeviceTemperatureTraits{}
-		case sdmDevicesTraitsThermostatEco:
-			decoded = &deviceThermostatEco{}
-		case sdmDevicesTraitsThermostatMode:
-			decoded = &deviceThermostatMode{}
-		case sdmDevicesTraitsThermostatHvac:
-			decoded = &deviceThermostatHvac{}
-		case sdmDevicesTraitsThermostatTemperatureSetpoint:
-			decoded = &DeviceThermostatTemperatureSetpoint{}
-		}
-
-		if decoded == nil {
-			logging.Logger(nil).Debugf("Ignoring unimplemented trait [%s]", traitName)
+		reg := registry.lookup(traitName)
+		if reg == nil {
+			logging.Logger(nil).Debugf("Keeping unimplemented trait [%s] as raw data", traitName)
+			t.unknown[traitName] = v
 			continue
 		}
 
-		if err := json.Unmarshal(v, &decoded); err != nil {
+		decoded := reg.newDecoder()
+		if err := json.Unmarshal(v, decoded); err != nil {
 			return err
 		}
 
-		value := decoded.Unmarshal()
-		t.traits[traitID] = value
+		t.traits[reg.id] = decoded.Unmarshal()
 	}
 
 	return nil
@@ -268,20 +350,58 @@ type deviceThermostatEco struct {
 	HeatCelsius    float32  `json:"heatCelsius"`
 	CoolCelsius    float32  `json:"coolCelsius"`
 }
+
+// Eco can be turned on by the user (manual), or by Nest when nobody is
+// home (auto)
+type EcoMode int
+
+const (
+	EcoModeOff EcoMode = iota
+	EcoModeManual
+	EcoModeAuto
+)
+
+// Name of the eco mode, as used in messages and Smartthings
+func (m EcoMode) String() string {
+	switch m {
+	case EcoModeManual:
+		return "manual"
+	case EcoModeAuto:
+		return "auto"
+	}
+
+	return "off"
+}
+
 type DeviceThermostatEco struct {
+	// Enabled is true in both manual and auto eco modes
 	Enabled     bool
+	Mode        EcoMode
 	HeatCelsius float32 `json:"heatCelsius"`
 	CoolCelsius float32 `json:"coolCelsius"`
+
+	// Whether eco mode can be turned on by a command
+	ManualAvailable bool
 }
 
 func (t *deviceThermostatEco) Unmarshal() interface{} {
 	v := &DeviceThermostatEco{}
-	if t.Mode == "OFF" {
-		v.Enabled = false
-	} else {
-		v.Enabled = true
+	for _, mode := range t.AvailableModes {
+		if mode == "MANUAL_ECO" {
+			v.ManualAvailable = true
+		}
 	}
 
+	switch t.Mode {
+	case "OFF":
+		v.Mode = EcoModeOff
+	case "AUTO_ECO":
+		v.Mode = EcoModeAuto
+	default:
+		v.Mode = EcoModeManual
+	}
+	v.Enabled = v.Mode != EcoModeOff
+
 	v.HeatCelsius = float32(math.Round(float64(t.HeatCelsius)*10) / 10)
 	v.CoolCelsius = float32(math.Round(float64(t.CoolCelsius)*10) / 10)
 	return v
@@ -297,31 +417,78 @@ const (
 	thermostatModeEco
 )
 
+// Name of the mode, as used in messages
+func (m thermostatMode) String() string {
+	switch m {
+	case thermostatModeHeat:
+		return "heat"
+	case thermostatModeCool:
+		return "cool"
+	case thermostatModeHeatCool:
+		return "heat-cool"
+	case thermostatModeEco:
+		return "eco"
+	}
+
+	return "off"
+}
+
 type deviceThermostatMode struct {
 	Mode           string   `json:"mode"`
 	AvailableModes []string `json:"availableModes"`
 }
 
 type DeviceThermostatMode struct {
-	mode thermostatMode
+	mode           thermostatMode
+	availableModes []thermostatMode
 }
 
-func (t *deviceThermostatMode) Unmarshal() interface{} {
-	v := &DeviceThermostatMode{}
-	switch t.Mode {
+func parseThermostatMode(mode string) (thermostatMode, bool) {
+	switch mode {
 	case "OFF":
-		v.mode = thermostatModeOff
+		return thermostatModeOff, true
 	case "HEAT":
-		v.mode = thermostatModeHeat
+		return thermostatModeHeat, true
 	case "COOL":
-		v.mode = thermostatModeCool
+		return thermostatModeCool, true
 	case "HEATCOOL":
-		v.mode = thermostatModeHeatCool
+		return thermostatModeHeatCool, true
+	}
+
+	return thermostatModeOff, false
+}
+
+func (t *deviceThermostatMode) Unmarshal() interface{} {
+	v := &DeviceThermostatMode{}
+	v.mode, _ = parseThermostatMode(t.Mode)
+
+	for _, name := range t.AvailableModes {
+		if mode, ok := parseThermostatMode(name); ok {
+			v.availableModes = append(v.availableModes, mode)
+		} else {
+			logging.Logger(nil).Debugf("Ignoring unknown thermostat mode [%s]", name)
+		}
 	}
 
 	return v
 }
 
+// Whether the thermostat can be switched to a mode.  Devices that don't
+// report their available modes are assumed to support every mode.
+func (t *DeviceThermostatMode) Supports(mode thermostatMode) bool {
+	if len(t.availableModes) == 0 {
+		return true
+	}
+
+	for _, m := range t.availableModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
 type thermostatStatus int
 
 const (
@@ -362,3 +529,53 @@ func (t *DeviceThermostatTemperatureSetpoint) Unmarshal() interface{} {
 	t.CoolCelsius = float32(math.Round(float64(t.CoolCelsius)*10) / 10)
 	return t
 }
+
+type Resolution struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type DeviceCameraLiveStreamTraits struct {
+	MaxVideoResolution Resolution `json:"maxVideoResolution"`
+	VideoCodecs        []string   `json:"videoCodecs"`
+	AudioCodecs        []string   `json:"audioCodecs"`
+	SupportedProtocols []string   `json:"supportedProtocols"`
+}
+
+func (t *DeviceCameraLiveStreamTraits) Unmarshal() interface{} {
+	return t
+}
+
+type DeviceCameraImageTraits struct {
+	MaxImageResolution Resolution `json:"maxImageResolution"`
+}
+
+func (t *DeviceCameraImageTraits) Unmarshal() interface{} {
+	return t
+}
+
+// The camera event traits carry no data, their presence indicates that
+// the device can emit the corresponding events
+type DeviceCameraMotionTraits struct{}
+
+func (t *DeviceCameraMotionTraits) Unmarshal() interface{} {
+	return t
+}
+
+type DeviceCameraPersonTraits struct{}
+
+func (t *DeviceCameraPersonTraits) Unmarshal() interface{} {
+	return t
+}
+
+type DeviceCameraSoundTraits struct{}
+
+func (t *DeviceCameraSoundTraits) Unmarshal() interface{} {
+	return t
+}
+
+type DeviceDoorbellChimeTraits struct{}
+
+func (t *DeviceDoorbellChimeTraits) Unmarshal() interface{} {
+	return t
+}
@@ -5,23 +5,29 @@ import (
 	"time"
 )
 
-func (s *State) GetAccessToken() (string, error) {
-	// Do we have an existing unexpired token ?
-	if s.accessToken != "" && (s.accessTokenExpiry != time.Time{}) {
-		if s.accessTokenExpiry.After(time.Now().Add(s.MinAccessTokenValidity)) {
-			return s.accessToken, nil
-		}
+// Do we have an existing token that won't expire for at least d ?
+func (s *State) validFor(d time.Duration) bool {
+	if d < s.MinAccessTokenValidity {
+		d = s.MinAccessTokenValidity
 	}
 
-	// No, let's refresh
-	if s.refreshToken == "" {
-		return "", fmt.Errorf("access token expired or missing, and no refresh token found - call AuthCodeFlow() to populate")
+	if s.accessToken != "" && (s.accessTokenExpiry != time.Time{}) {
+		return s.accessTokenExpiry.After(time.Now().Add(d))
 	}
 
-	if err := s.refreshTokenFlow(); err != nil {
-		return "", err
+	return false
+}
+
+// Do we have an existing unexpired token ?
+func (s *State) hasValidAccessToken() bool {
+	return s.validFor(s.MinAccessTokenValidity)
+}
+
+// Fetch new tokens using the refresh token, without saving them
+func (s *State) refresh() error {
+	if s.refreshToken == "" {
+		return fmt.Errorf("access token expired or missing, and no refresh token found - call AuthCodeFlow() to populate")
 	}
 
-	s.save()
-	return s.accessToken, nil
+	return s.refreshTokenFlow()
 }
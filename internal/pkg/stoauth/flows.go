@@ -14,6 +14,22 @@ import (
 	"github.com/pkg/errors"
 )
 
+// How long a request to the Smartthings token URL may take
+const tokenRequestTimeout = time.Second * 30
+
+var tokenClient = &http.Client{Timeout: tokenRequestTimeout}
+
+// Send a token request to the Smartthings token URL
+func (s *State) postTokenRequest(reqBody []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.TokenURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return tokenClient.Do(req)
+}
+
 func newAccessTokenRequest(requestID string) models.AccessTokenRequest {
 	stSchema := "st-schema"
 	stVersion := "1.0"
@@ -68,7 +84,7 @@ func (s *State) AuthCodeFlow(requestID string, code string) error {
 	ctxLogger.Debugf("Sending access token request to Smartthings URL [%s]: %s", s.TokenURL, reqBody)
 
 	// Send request
-	resp, err := http.Post(s.TokenURL, "application/json", bytes.NewBuffer(reqBody))
+	resp, err := s.postTokenRequest(reqBody)
 	if err != nil {
 		return errors.Wrap(err, "executing authorization code grant")
 	}
@@ -126,7 +142,7 @@ func (s *State) refreshTokenFlow() error {
 	ctxLogger.Debugf("Sending refresh token request to Smartthings URL [%s]: %s", s.TokenURL, reqBody)
 
 	// Send request
-	resp, err := http.Post(s.TokenURL, "application/json", bytes.NewBuffer(reqBody))
+	resp, err := s.postTokenRequest(reqBody)
 	if err != nil {
 		return errors.Wrap(err, "executing refresh token grant")
 	}
@@ -137,6 +153,12 @@ func (s *State) refreshTokenFlow() error {
 		return errors.Wrap(err, "reading response body")
 	}
 
+	// The refresh token has expired or been revoked
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return errors.Wrapf(ErrNeedsRelink, "%d code from Smartthings token URL (%s): %s", resp.StatusCode, resp.Status, bodyBytes)
+	}
+
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("non-200 code from Smartthings token URL: %d (%s): %s", resp.StatusCode, resp.Status, bodyBytes)
 	}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package stoauth
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
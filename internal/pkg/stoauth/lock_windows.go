@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package stoauth
+
+import (
+	"os"
+)
+
+// Advisory locks are not supported on Windows, where only one of the
+// services should be run against a state file
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -6,10 +6,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
 	"github.com/pkg/errors"
 )
 
@@ -28,7 +26,7 @@ type State struct {
 	accessTokenExpiry time.Time
 	refreshToken      string
 	ctx               context.Context
-	fileName          string
+	store             TokenStore
 }
 
 // Version of state that we marshal/unmarshal
@@ -71,8 +69,8 @@ func (s State) WithClientSecret(secret string) State {
 	return s
 }
 
-func (s *State) Save(fileName string) error {
-	sm := stateMarshal{
+func (s *State) marshal() stateMarshal {
+	return stateMarshal{
 		ClientID:          s.ClientID,
 		Scope:             s.Scope,
 		TokenURL:          s.TokenURL,
@@ -81,57 +79,53 @@ func (s *State) Save(fileName string) error {
 		AccessTokenExpiry: s.accessTokenExpiry,
 		RefreshToken:      s.refreshToken,
 	}
+}
+
+func (s *State) unmarshal(sm stateMarshal) {
+	s.ClientID = sm.ClientID
+	s.Scope = sm.Scope
+	s.TokenURL = sm.TokenURL
+	s.StateCallbackURL = sm.StateCallbackURL
+	s.accessToken = sm.AccessToken
+	s.accessTokenExpiry = sm.AccessTokenExpiry
+	s.refreshToken = sm.RefreshToken
+}
+
+// Save writes the state on its own to a store
+func (s *State) Save(store TokenStore) error {
+	sm := s.marshal()
 
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0750)
+	data, err := json.MarshalIndent(sm, "", "  ")
 	if err != nil {
-		return errors.Wrapf(err, "opening smartthings oauth state %s for write", fileName)
+		return errors.Wrap(err, "encoding smartthings oauth state")
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(sm); err != nil {
-		return errors.Wrapf(err, "saving smartthings oauth state to %s", fileName)
+	if err := store.Write(data); err != nil {
+		return err
 	}
 
 	// Store for later use
-	s.fileName = fileName
+	s.store = store
 	return nil
 }
 
-func (s *State) save() error {
-	if s.fileName != "" {
-		return s.Save(s.fileName)
-	}
-
-	logging.Logger(s.ctx).Warn("cannot save oauth state, no file name available")
-	return nil
-}
-
-func (s *State) Load(fileName string) error {
+// Load reads a state written by Save from a store
+func (s *State) Load(store TokenStore) error {
 	sm := stateMarshal{}
 
-	file, err := os.OpenFile(fileName, os.O_RDONLY, 0750)
+	data, err := store.Read()
 	if err != nil {
-		return errors.Wrapf(err, "opening smartthings oauth state %s for read", fileName)
+		return err
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&sm); err != nil {
-		return errors.Wrapf(err, "loading smartthings oauth state to %s", fileName)
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return errors.Wrapf(err, "decoding smartthings oauth state from %s", store)
 	}
 
-	s.ClientID = sm.ClientID
-	s.Scope = sm.Scope
-	s.TokenURL = sm.TokenURL
-	s.StateCallbackURL = sm.StateCallbackURL
-	s.accessToken = sm.AccessToken
-	s.accessTokenExpiry = sm.AccessTokenExpiry
-	s.refreshToken = sm.RefreshToken
+	s.unmarshal(sm)
 
 	// Store for later use
-	s.fileName = fileName
+	s.store = store
 
 	return nil
 }
@@ -0,0 +1,192 @@
+package stoauth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+/*
+ * A TokenStore persists the Smartthings oauth state of every tenant as a
+ * single JSON document.  The web service writes it when an installation is
+ * linked and the pubsub service reads it, so both must be configured with
+ * the same store.
+ */
+
+// ErrNotStored is returned by a TokenStore that holds no state yet
+var ErrNotStored = errors.New("no smartthings oauth state stored")
+
+// ErrConflict is returned by the Write of a store that isn't locked, when
+// another process has changed the state since it was read
+var ErrConflict = errors.New("smartthings oauth state changed by another process")
+
+type TokenStore interface {
+	// Read returns the stored state, or ErrNotStored
+	Read() ([]byte, error)
+
+	// Write replaces the stored state
+	Write(data []byte) error
+
+	// String describes the store in log and error messages
+	String() string
+}
+
+// A LockingStore can be locked against changes by other processes, so that
+// a read-modify-write of the state is not interleaved with another one
+type LockingStore interface {
+	TokenStore
+
+	// Lock blocks until the store is locked, and returns the function that
+	// unlocks it
+	Lock() (unlock func(), err error)
+}
+
+// A WatchingStore can tell when another process has changed the state
+type WatchingStore interface {
+	TokenStore
+
+	// Watch calls onChange whenever the state changes, until the context is
+	// cancelled
+	Watch(ctx context.Context, onChange func()) error
+}
+
+// FileStore keeps the oauth state in a plain JSON file.  The file is
+// replaced atomically on every write, and locked with an advisory lock on a
+// separate lock file, as the lock would be lost when the file is replaced.
+type FileStore struct {
+	fileName string
+}
+
+func NewFileStore(fileName string) *FileStore {
+	return &FileStore{
+		fileName: fileName,
+	}
+}
+
+func (s *FileStore) Read() ([]byte, error) {
+	data, err := ioutil.ReadFile(s.fileName)
+	if os.IsNotExist(err) {
+		return nil, ErrNotStored
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading smartthings oauth state from %s", s.fileName)
+	}
+
+	return data, nil
+}
+
+// Write the state to a temporary file in the same directory and rename it
+// over the old file, so that readers never see a partly written file
+func (s *FileStore) Write(data []byte) error {
+	dir, base := filepath.Split(s.fileName)
+	if dir == "" {
+		dir = "."
+	}
+
+	file, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "creating temporary file for %s", s.fileName)
+	}
+	tmpName := file.Name()
+	defer os.Remove(tmpName)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(0600)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "saving smartthings oauth state to %s", tmpName)
+	}
+
+	if err := os.Rename(tmpName, s.fileName); err != nil {
+		return errors.Wrapf(err, "saving smartthings oauth state to %s", s.fileName)
+	}
+
+	return nil
+}
+
+func (s *FileStore) lockFileName() string {
+	return s.fileName + ".lock"
+}
+
+func (s *FileStore) Lock() (func(), error) {
+	file, err := os.OpenFile(s.lockFileName(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening lock file %s", s.lockFileName())
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "locking %s", s.lockFileName())
+	}
+
+	return func() {
+		if err := unlockFile(file); err != nil {
+			logging.Logger(nil).WithError(err).Errorf("unlocking %s", s.lockFileName())
+		}
+		file.Close()
+	}, nil
+}
+
+// Watch the directory rather than the file, as the file is replaced by a
+// rename on every write
+func (s *FileStore) Watch(ctx context.Context, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "creating file watcher")
+	}
+
+	dir := filepath.Dir(s.fileName)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "watching %s", dir)
+	}
+
+	fileName := filepath.Clean(s.fileName)
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != fileName {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+					logging.Logger(nil).Debugf("smartthings oauth state %s changed (%s)", s.fileName, event.Op)
+					onChange()
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logging.Logger(nil).WithError(err).Errorf("watching %s", s.fileName)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *FileStore) String() string {
+	return s.fileName
+}
@@ -0,0 +1,202 @@
+package stoauth
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	apioption "google.golang.org/api/option"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+/*
+ * BucketStore keeps the oauth state in an object in a Google Cloud Storage
+ * bucket, so that the web service and the pubsub service don't need to
+ * share a filesystem.  The endpoint can be pointed at a local fake object
+ * server (eg. fsouza/fake-gcs-server) for testing, in which case requests
+ * are sent without credentials unless a credentials file is given.
+ *
+ * Cloud Storage has no locks, so the store remembers the generation of the
+ * object it last read, and only writes the object if it is still at that
+ * generation.  A write that loses to a change made by the other service fails
+ * with ErrConflict, and the change is made again on the latest state.
+ */
+
+const DefaultBucketObject = "smartthings-oauth.json"
+
+type BucketStore struct {
+	bucket    string
+	object    string
+	credsFile string
+	endpoint  string
+	timeout   time.Duration
+
+	// Shared by the copies made by the With* methods
+	generation *bucketGeneration
+}
+
+// The generation of the object when it was last read or written, zero if
+// it didn't exist
+type bucketGeneration struct {
+	mu    sync.Mutex
+	value int64
+	known bool
+}
+
+func (g *bucketGeneration) get() (int64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.value, g.known
+}
+
+func (g *bucketGeneration) set(value int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.value = value
+	g.known = true
+}
+
+func NewBucketStore(bucket string, object string) *BucketStore {
+	if object == "" {
+		object = DefaultBucketObject
+	}
+
+	return &BucketStore{
+		bucket:     bucket,
+		object:     object,
+		timeout:    time.Second * 15,
+		generation: &bucketGeneration{},
+	}
+}
+
+// WithServiceAccountCreds authenticates to Cloud Storage with a service
+// account credentials file instead of the application default credentials
+func (s *BucketStore) WithServiceAccountCreds(credsFile string) *BucketStore {
+	ns := *s
+	ns.credsFile = credsFile
+	return &ns
+}
+
+// WithEndpoint sends requests to another Cloud Storage JSON API endpoint,
+// eg. http://localhost:4443/storage/v1/
+func (s *BucketStore) WithEndpoint(endpoint string) *BucketStore {
+	ns := *s
+	ns.endpoint = endpoint
+	return &ns
+}
+
+func (s *BucketStore) WithTimeout(d time.Duration) *BucketStore {
+	ns := *s
+	ns.timeout = d
+	return &ns
+}
+
+func (s *BucketStore) api(ctx context.Context) (*storagev1.Service, error) {
+	var opts []apioption.ClientOption
+
+	switch {
+	case s.credsFile != "":
+		opts = append(opts, apioption.WithCredentialsFile(s.credsFile))
+	case s.endpoint != "":
+		opts = append(opts, apioption.WithoutAuthentication())
+	}
+
+	if s.endpoint != "" {
+		opts = append(opts, apioption.WithEndpoint(s.endpoint))
+	}
+
+	return storagev1.NewService(ctx, opts...)
+}
+
+func (s *BucketStore) makeContext() (context.Context, context.CancelFunc) {
+	if s.timeout > 0 {
+		return context.WithTimeout(context.Background(), s.timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+func isStatus(err error, code int) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == code
+}
+
+func (s *BucketStore) Read() ([]byte, error) {
+	ctx, cancel := s.makeContext()
+	defer cancel()
+
+	api, err := s.api(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "initialising the storage api")
+	}
+
+	// Read the metadata first, so that the contents are those of the
+	// generation that a write will be conditional on
+	obj, err := api.Objects.Get(s.bucket, s.object).Context(ctx).Do()
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			s.generation.set(0)
+			return nil, ErrNotStored
+		}
+		return nil, errors.Wrapf(err, "reading smartthings oauth state from %s", s)
+	}
+
+	resp, err := api.Objects.Get(s.bucket, s.object).Generation(obj.Generation).Context(ctx).Download()
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading smartthings oauth state from %s", s)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading smartthings oauth state from %s", s)
+	}
+
+	s.generation.set(obj.Generation)
+	return data, nil
+}
+
+// Write replaces the object if it hasn't changed since it was last read, or
+// returns ErrConflict.  The object is replaced regardless if it hasn't been
+// read.
+func (s *BucketStore) Write(data []byte) error {
+	ctx, cancel := s.makeContext()
+	defer cancel()
+
+	api, err := s.api(ctx)
+	if err != nil {
+		return errors.Wrap(err, "initialising the storage api")
+	}
+
+	object := &storagev1.Object{
+		Name:        s.object,
+		ContentType: "application/json",
+	}
+
+	call := api.Objects.Insert(s.bucket, object).Media(bytes.NewReader(data)).Context(ctx)
+	if generation, ok := s.generation.get(); ok {
+		call = call.IfGenerationMatch(generation)
+	}
+
+	obj, err := call.Do()
+	if err != nil {
+		if isStatus(err, http.StatusPreconditionFailed) {
+			return errors.Wrapf(ErrConflict, "saving smartthings oauth state to %s", s)
+		}
+		return errors.Wrapf(err, "saving smartthings oauth state to %s", s)
+	}
+
+	s.generation.set(obj.Generation)
+	return nil
+}
+
+func (s *BucketStore) String() string {
+	return "gs://" + s.bucket + "/" + s.object
+}
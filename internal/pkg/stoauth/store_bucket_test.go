@@ -0,0 +1,302 @@
+package stoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testBucket = "test-bucket"
+	testObject = "test-object.json"
+)
+
+// A Cloud Storage JSON API server holding a single object
+type fakeBucket struct {
+	mu         sync.Mutex
+	data       []byte
+	generation int64
+	uploads    int
+
+	// Called before an upload is applied, eg. to change the object as
+	// another process would
+	beforeUpload func(b *fakeBucket)
+}
+
+func (b *fakeBucket) put(data []byte) {
+	b.data = data
+	b.generation++
+}
+
+func writeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, code, http.StatusText(code))
+}
+
+func (b *fakeBucket) objectMetadata(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"bucket": %q, "name": %q, "generation": "%d"}`, testBucket, testObject, b.generation)
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/"+testBucket+"/o/"+testObject:
+		if b.generation == 0 {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("alt") != "media" {
+			b.objectMetadata(w)
+			return
+		}
+
+		if g := r.URL.Query().Get("generation"); g != "" && g != strconv.FormatInt(b.generation, 10) {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		w.Write(b.data)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/"+testBucket+"/o":
+		data, err := readUpload(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+
+		if b.beforeUpload != nil {
+			b.beforeUpload(b)
+		}
+
+		if g := r.URL.Query().Get("ifGenerationMatch"); g != "" && g != strconv.FormatInt(b.generation, 10) {
+			writeError(w, http.StatusPreconditionFailed)
+			return
+		}
+
+		b.uploads++
+		b.put(data)
+		b.objectMetadata(w)
+
+	default:
+		writeError(w, http.StatusNotFound)
+	}
+}
+
+// Return the media of a multipart upload, after the metadata part
+func readUpload(r *http.Request) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		return nil, err
+	}
+
+	media, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(media)
+}
+
+func newTestBucketStore(t *testing.T, b *fakeBucket) *BucketStore {
+	server := httptest.NewServer(b)
+	t.Cleanup(server.Close)
+
+	return NewBucketStore(testBucket, testObject).WithEndpoint(server.URL + "/storage/v1/")
+}
+
+func TestBucketStoreReadWrite(t *testing.T) {
+	b := &fakeBucket{}
+	store := newTestBucketStore(t, b)
+
+	if _, err := store.Read(); err != ErrNotStored {
+		t.Fatalf("reading an empty bucket: got %v, want ErrNotStored", err)
+	}
+
+	if err := store.Write([]byte(`{"first": true}`)); err != nil {
+		t.Fatalf("creating the object: %v", err)
+	}
+
+	data, err := store.Read()
+	if err != nil {
+		t.Fatalf("reading the object: %v", err)
+	}
+	if string(data) != `{"first": true}` {
+		t.Errorf("read %s, want the data written", data)
+	}
+
+	if err := store.Write([]byte(`{"second": true}`)); err != nil {
+		t.Fatalf("replacing the object: %v", err)
+	}
+
+	// The store tracks the generation it wrote, so it can write again
+	if err := store.Write([]byte(`{"third": true}`)); err != nil {
+		t.Fatalf("replacing the object again: %v", err)
+	}
+
+	if string(b.data) != `{"third": true}` || b.generation != 3 {
+		t.Errorf("bucket holds %s at generation %d, want the last write at generation 3", b.data, b.generation)
+	}
+}
+
+func TestBucketStoreConflict(t *testing.T) {
+	b := &fakeBucket{}
+	store := newTestBucketStore(t, b)
+	other := newTestBucketStore(t, b)
+
+	if err := store.Write([]byte(`{}`)); err != nil {
+		t.Fatalf("creating the object: %v", err)
+	}
+	if _, err := store.Read(); err != nil {
+		t.Fatalf("reading the object: %v", err)
+	}
+
+	// Another process replaces the object after it was read
+	if _, err := other.Read(); err != nil {
+		t.Fatalf("reading the object: %v", err)
+	}
+	if err := other.Write([]byte(`{"other": true}`)); err != nil {
+		t.Fatalf("replacing the object: %v", err)
+	}
+
+	err := store.Write([]byte(`{"mine": true}`))
+	if errors.Cause(err) != ErrConflict {
+		t.Fatalf("writing a changed object: got %v, want ErrConflict", err)
+	}
+	if string(b.data) != `{"other": true}` {
+		t.Errorf("bucket holds %s, want the other write", b.data)
+	}
+}
+
+func TestBucketStoreCreateConflict(t *testing.T) {
+	b := &fakeBucket{}
+	store := newTestBucketStore(t, b)
+
+	if _, err := store.Read(); err != ErrNotStored {
+		t.Fatalf("reading an empty bucket: got %v, want ErrNotStored", err)
+	}
+
+	// Created by another process after it was found missing
+	b.put([]byte(`{"other": true}`))
+
+	if err := store.Write([]byte(`{"mine": true}`)); errors.Cause(err) != ErrConflict {
+		t.Fatalf("creating an object that exists: got %v, want ErrConflict", err)
+	}
+}
+
+func TestTenantsUpdateRetriesConflict(t *testing.T) {
+	b := &fakeBucket{}
+	store := newTestBucketStore(t, b)
+
+	tenants := NewTenants(store)
+	if err := tenants.Put(Tenant{ID: "mine", State: NewState()}); err != nil {
+		t.Fatalf("adding a tenant: %v", err)
+	}
+
+	// The other service adds a tenant just before the next change is saved
+	b.beforeUpload = func(b *fakeBucket) {
+		b.beforeUpload = nil
+
+		var tm tenantsMarshal
+		if err := json.Unmarshal(b.data, &tm); err != nil {
+			t.Errorf("decoding the tenants: %v", err)
+			return
+		}
+		tm.Tenants["other"] = tenantMarshal{}
+
+		data, err := json.Marshal(tm)
+		if err != nil {
+			t.Errorf("encoding the tenants: %v", err)
+			return
+		}
+		b.put(data)
+	}
+
+	if err := tenants.SetDevices("mine", []string{"device1"}, nil); err != nil {
+		t.Fatalf("setting the devices: %v", err)
+	}
+
+	if b.uploads != 2 {
+		t.Errorf("%d uploads succeeded, want 2", b.uploads)
+	}
+
+	list := tenants.List()
+	if len(list) != 2 || list[0].ID != "mine" || list[1].ID != "other" {
+		t.Fatalf("got tenants %+v, want mine and other", list)
+	}
+	if len(list[0].DeviceIDs) != 1 || list[0].DeviceIDs[0] != "device1" {
+		t.Errorf("got devices %v, want device1", list[0].DeviceIDs)
+	}
+}
+
+func TestTenantsRefreshRetriesConflictWithoutRefreshing(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	b := &fakeBucket{}
+	tenants := newTestTenants(newTestBucketStore(t, b))
+	putTestTenant(t, tenants, "home", url, 0)
+
+	// The web service records a Google token after the refresh, just before
+	// the new tokens are saved
+	b.beforeUpload = func(b *fakeBucket) {
+		b.beforeUpload = nil
+
+		var tm tenantsMarshal
+		if err := json.Unmarshal(b.data, &tm); err != nil {
+			t.Errorf("decoding the tenants: %v", err)
+			return
+		}
+		home := tm.Tenants["home"]
+		home.GoogleToken = "google-token"
+		tm.Tenants["home"] = home
+
+		data, err := json.Marshal(tm)
+		if err != nil {
+			t.Errorf("encoding the tenants: %v", err)
+			return
+		}
+		b.put(data)
+	}
+
+	token, _, err := NewTokenManager(tenants).AccessToken("home")
+	if err != nil {
+		t.Fatalf("fetching access token: %v", err)
+	}
+	if token != "access-1" {
+		t.Errorf("got token %s, want the refreshed token", token)
+	}
+
+	if b.uploads != 2 {
+		t.Errorf("%d uploads succeeded, want 2", b.uploads)
+	}
+
+	// The refresh token is only spent once, and the retried change keeps the
+	// new tokens
+	if calls, _ := server.received(); calls != 1 {
+		t.Errorf("%d refreshes, want 1", calls)
+	}
+
+	tenant, _ := tenants.Get("home")
+	if tenant.NeedsRelink || tenant.State.refreshToken != "refresh-1" {
+		t.Errorf("saved %s (needs relink %t), want the refreshed tokens", tenant.State, tenant.NeedsRelink)
+	}
+	if tenant.GoogleToken != "google-token" {
+		t.Errorf("saved Google token %q, want the other service's change kept", tenant.GoogleToken)
+	}
+}
@@ -0,0 +1,154 @@
+package stoauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ * EncryptedFileStore keeps the oauth state in a file encrypted with
+ * AES-GCM, so that the refresh tokens are not readable by anyone who can
+ * read the file.  The key is a base64 encoded 16, 24 or 32 byte AES key,
+ * read from a key file or an environment variable, eg. generated with
+ *
+ *     openssl rand -base64 32
+ */
+
+const encryptedStoreVersion = 1
+
+// Version of the encrypted file that we marshal/unmarshal
+type encryptedMarshal struct {
+	Version    int    `json:"version"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type EncryptedFileStore struct {
+	file *FileStore
+	aead cipher.AEAD
+}
+
+func NewEncryptedFileStore(fileName string, key []byte) (*EncryptedFileStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "initialising oauth state cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "initialising oauth state cipher")
+	}
+
+	return &EncryptedFileStore{
+		file: NewFileStore(fileName),
+		aead: aead,
+	}, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding base64 key")
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+
+	return nil, errors.Errorf("key is %d bytes, expected 16, 24 or 32", len(key))
+}
+
+// KeyFromFile reads a base64 encoded AES key from a file
+func KeyFromFile(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading oauth state key from %s", fileName)
+	}
+
+	key, err := decodeKey(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading oauth state key from %s", fileName)
+	}
+
+	return key, nil
+}
+
+// KeyFromEnv reads a base64 encoded AES key from an environment variable
+func KeyFromEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errors.Errorf("oauth state key variable %s not set", name)
+	}
+
+	key, err := decodeKey(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading oauth state key from %s", name)
+	}
+
+	return key, nil
+}
+
+func (s *EncryptedFileStore) Read() ([]byte, error) {
+	data, err := s.file.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var em encryptedMarshal
+	if err := json.Unmarshal(data, &em); err != nil {
+		return nil, errors.Wrapf(err, "decoding encrypted smartthings oauth state from %s", s)
+	}
+	if em.Version != encryptedStoreVersion {
+		return nil, errors.Errorf("unsupported encrypted smartthings oauth state version %d in %s", em.Version, s)
+	}
+
+	plaintext, err := s.aead.Open(nil, em.Nonce, em.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting smartthings oauth state from %s", s)
+	}
+
+	return plaintext, nil
+}
+
+func (s *EncryptedFileStore) Write(data []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "generating nonce")
+	}
+
+	em := encryptedMarshal{
+		Version:    encryptedStoreVersion,
+		Nonce:      nonce,
+		Ciphertext: s.aead.Seal(nil, nonce, data, nil),
+	}
+
+	encrypted, err := json.MarshalIndent(em, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding encrypted smartthings oauth state")
+	}
+
+	return s.file.Write(encrypted)
+}
+
+func (s *EncryptedFileStore) Lock() (func(), error) {
+	return s.file.Lock()
+}
+
+func (s *EncryptedFileStore) Watch(ctx context.Context, onChange func()) error {
+	return s.file.Watch(ctx, onChange)
+}
+
+func (s *EncryptedFileStore) String() string {
+	return s.file.String() + " (encrypted)"
+}
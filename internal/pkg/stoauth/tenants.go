@@ -0,0 +1,564 @@
+package stoauth
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Tenants holds the Smartthings oauth state of each installation (tenant)
+ * of the integration, so that several households can share one deployment.
+ *
+ * A tenant is identified by the first Google structure that the user shared
+ * when they linked their account.  Pub/sub events carry the SDM user ID and
+ * the device ID, so each tenant records the user IDs and device IDs that
+ * belong to it in order to route events to the right Smartthings callback.
+ *
+ * The tenants are kept in a TokenStore.  Every change is made by re-reading
+ * the store, applying the change and writing the store back, so that the web
+ * service and the pubsub service can both update it.  Stores that support it
+ * are locked for the duration of the change, and watched so that a service
+ * sees the changes made by the other one.  A store that can't be locked
+ * reports a conflict if the other service saved it first, and the change is
+ * made again.
+ */
+
+// ID of the tenant created from a state file written before multi-tenancy
+const LegacyTenantID = "default"
+
+// How many times a change is made when other processes keep saving the store
+const maxUpdateAttempts = 5
+
+type Tenant struct {
+	ID        string
+	UserIDs   []string
+	DeviceIDs []string
+	State     State
+
+	// Devices of the tenant that the device filters keep from Smartthings
+	ExcludedDeviceIDs []string
+
+	// Smartthings rejected the refresh token, so no callbacks can be sent
+	// until the installation is linked again
+	NeedsRelink bool
+
+	// The latest Google access token that Smartthings sent for the tenant,
+	// used by the pubsub service to discover devices.  It is saved with the
+	// rest of the tenant, so the web service only records it when the store
+	// is encrypted or the operator allows it in plain text.
+	GoogleToken     string
+	GoogleTokenSeen time.Time
+}
+
+// Version of a tenant that we marshal/unmarshal
+type tenantMarshal struct {
+	stateMarshal
+	UserIDs     []string `json:"user-ids,omitempty"`
+	DeviceIDs   []string `json:"device-ids,omitempty"`
+	NeedsRelink bool     `json:"needs-relink,omitempty"`
+
+	ExcludedDeviceIDs []string `json:"excluded-device-ids,omitempty"`
+
+	GoogleToken     string    `json:"google-access-token,omitempty"`
+	GoogleTokenSeen time.Time `json:"google-access-token-seen,omitempty"`
+}
+
+type tenantsMarshal struct {
+	Tenants map[string]tenantMarshal `json:"tenants"`
+}
+
+type Tenants struct {
+	ctx          context.Context
+	clientSecret string
+	store        TokenStore
+
+	mu      sync.Mutex
+	tenants map[string]*Tenant
+}
+
+func NewTenants(store TokenStore) *Tenants {
+	return &Tenants{
+		ctx:     context.Background(),
+		store:   store,
+		tenants: make(map[string]*Tenant),
+	}
+}
+
+// WithClientSecret sets the Smartthings client secret used to refresh the
+// tokens of every tenant
+func (t *Tenants) WithClientSecret(secret string) *Tenants {
+	t.clientSecret = secret
+	return t
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Load reads the tenants from the store.  An empty store means there are no
+// tenants yet.
+func (t *Tenants) Load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.load()
+}
+
+// call with the lock held
+func (t *Tenants) load() error {
+	data, err := t.store.Read()
+	if err == ErrNotStored {
+		t.tenants = make(map[string]*Tenant)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var tm tenantsMarshal
+	if err := json.Unmarshal(data, &tm); err != nil {
+		return errors.Wrapf(err, "decoding smartthings tenants from %s", t.store)
+	}
+
+	// A state file from before multi-tenancy holds a single state
+	if tm.Tenants == nil {
+		var sm stateMarshal
+		if err := json.Unmarshal(data, &sm); err != nil {
+			return errors.Wrapf(err, "decoding smartthings oauth state from %s", t.store)
+		}
+		if sm.ClientID != "" {
+			logging.Logger(t.ctx).Infof("Loading single oauth state from %s as tenant %s", t.store, LegacyTenantID)
+			tm.Tenants = map[string]tenantMarshal{LegacyTenantID: {stateMarshal: sm}}
+		}
+	}
+
+	tenants := make(map[string]*Tenant)
+	for id, m := range tm.Tenants {
+		tenant := &Tenant{
+			ID:          id,
+			UserIDs:     m.UserIDs,
+			DeviceIDs:   m.DeviceIDs,
+			State:       NewState().WithContext(t.ctx).WithClientSecret(t.clientSecret),
+			NeedsRelink: m.NeedsRelink,
+
+			ExcludedDeviceIDs: m.ExcludedDeviceIDs,
+
+			GoogleToken:     m.GoogleToken,
+			GoogleTokenSeen: m.GoogleTokenSeen,
+		}
+		tenant.State.unmarshal(m.stateMarshal)
+		tenants[id] = tenant
+	}
+
+	t.tenants = tenants
+	return nil
+}
+
+// call with the lock held
+func (t *Tenants) save() error {
+	tm := tenantsMarshal{Tenants: make(map[string]tenantMarshal)}
+	for id, tenant := range t.tenants {
+		tm.Tenants[id] = tenantMarshal{
+			stateMarshal: tenant.State.marshal(),
+			UserIDs:      tenant.UserIDs,
+			DeviceIDs:    tenant.DeviceIDs,
+			NeedsRelink:  tenant.NeedsRelink,
+
+			ExcludedDeviceIDs: tenant.ExcludedDeviceIDs,
+
+			GoogleToken:     tenant.GoogleToken,
+			GoogleTokenSeen: tenant.GoogleTokenSeen,
+		}
+	}
+
+	data, err := json.MarshalIndent(tm, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding smartthings tenants")
+	}
+
+	return t.store.Write(data)
+}
+
+// Lock the store against changes by the other service, if it supports it
+func (t *Tenants) lockStore() (func(), error) {
+	if ls, ok := t.store.(LockingStore); ok {
+		return ls.Lock()
+	}
+
+	return func() {}, nil
+}
+
+// Re-read the tenants, apply a change and save them, holding the locks.  The
+// change is applied again if another process saved the store in between, so
+// it must only change the tenants: anything with side effects, such as
+// fetching tokens, is done before calling update.
+func (t *Tenants) update(change func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	unlock, err := t.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		if err := t.load(); err != nil {
+			return err
+		}
+
+		if err := change(); err != nil {
+			return err
+		}
+
+		err := t.save()
+		if errors.Cause(err) != ErrConflict || attempt == maxUpdateAttempts {
+			return err
+		}
+
+		logging.Logger(t.ctx).Debugf("%s was changed by another process, updating it again", t.store)
+	}
+}
+
+// Put adds a tenant, or replaces the oauth state and devices of an existing
+// tenant while keeping the user IDs learned from events.  A tenant that
+// needed to be linked again is usable once more.
+func (t *Tenants) Put(tenant Tenant) error {
+	return t.update(func() error {
+		if existing, ok := t.tenants[tenant.ID]; ok {
+			for _, userID := range existing.UserIDs {
+				if !contains(tenant.UserIDs, userID) {
+					tenant.UserIDs = append(tenant.UserIDs, userID)
+				}
+			}
+		}
+
+		t.tenants[tenant.ID] = &tenant
+		return nil
+	})
+}
+
+// Excludes tells whether the device filters keep a device of the tenant from
+// Smartthings
+func (t Tenant) Excludes(deviceID string) bool {
+	return contains(t.ExcludedDeviceIDs, deviceID)
+}
+
+func without(list []string, s string) []string {
+	kept := make([]string, 0, len(list))
+	for _, i := range list {
+		if i != s {
+			kept = append(kept, i)
+		}
+	}
+
+	return kept
+}
+
+// SetDevices replaces the device IDs of a tenant, and the IDs of the devices
+// that are excluded from Smartthings
+func (t *Tenants) SetDevices(id string, deviceIDs []string, excludedIDs []string) error {
+	return t.update(func() error {
+		tenant, ok := t.tenants[id]
+		if !ok {
+			return errors.Errorf("no such tenant: %s", id)
+		}
+		tenant.DeviceIDs = deviceIDs
+		tenant.ExcludedDeviceIDs = excludedIDs
+		return nil
+	})
+}
+
+// AddDevice adds a device ID to a tenant, recording whether it is excluded
+// from Smartthings
+func (t *Tenants) AddDevice(id string, deviceID string, excluded bool) error {
+	return t.update(func() error {
+		tenant, ok := t.tenants[id]
+		if !ok {
+			return errors.Errorf("no such tenant: %s", id)
+		}
+		if !contains(tenant.DeviceIDs, deviceID) {
+			tenant.DeviceIDs = append(tenant.DeviceIDs, deviceID)
+		}
+
+		tenant.ExcludedDeviceIDs = without(tenant.ExcludedDeviceIDs, deviceID)
+		if excluded {
+			tenant.ExcludedDeviceIDs = append(tenant.ExcludedDeviceIDs, deviceID)
+		}
+		return nil
+	})
+}
+
+// RemoveDevice removes a device ID from a tenant
+func (t *Tenants) RemoveDevice(id string, deviceID string) error {
+	return t.update(func() error {
+		tenant, ok := t.tenants[id]
+		if !ok {
+			return errors.Errorf("no such tenant: %s", id)
+		}
+
+		tenant.DeviceIDs = without(tenant.DeviceIDs, deviceID)
+		tenant.ExcludedDeviceIDs = without(tenant.ExcludedDeviceIDs, deviceID)
+		return nil
+	})
+}
+
+// SetGoogleToken records the latest Google access token of a tenant
+func (t *Tenants) SetGoogleToken(id string, token string) error {
+	t.mu.Lock()
+	tenant, ok := t.tenants[id]
+	unchanged := ok && tenant.GoogleToken == token
+	t.mu.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	return t.update(func() error {
+		tenant, ok := t.tenants[id]
+		if !ok {
+			return errors.Errorf("no such tenant: %s", id)
+		}
+		tenant.GoogleToken = token
+		tenant.GoogleTokenSeen = time.Now()
+		return nil
+	})
+}
+
+// Remove deletes a tenant
+func (t *Tenants) Remove(id string) error {
+	return t.update(func() error {
+		if _, ok := t.tenants[id]; !ok {
+			return errors.Errorf("no such tenant: %s", id)
+		}
+		delete(t.tenants, id)
+		return nil
+	})
+}
+
+// List returns a copy of every tenant, ordered by ID
+func (t *Tenants) List() []Tenant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]Tenant, 0, len(t.tenants))
+	for _, tenant := range t.tenants {
+		list = append(list, *tenant)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+// call with the lock held
+func (t *Tenants) find(userID string, deviceID string) *Tenant {
+	for _, tenant := range t.tenants {
+		if userID != "" && contains(tenant.UserIDs, userID) {
+			return tenant
+		}
+	}
+
+	for _, tenant := range t.tenants {
+		if deviceID != "" && contains(tenant.DeviceIDs, deviceID) {
+			return tenant
+		}
+	}
+
+	// A single tenant from before multi-tenancy doesn't know its devices
+	if legacy, ok := t.tenants[LegacyTenantID]; ok && len(t.tenants) == 1 && len(legacy.DeviceIDs) == 0 {
+		return legacy
+	}
+
+	return nil
+}
+
+// ForEvent returns the ID of the tenant that an SDM event belongs to, given
+// the user ID and device ID from the event.  The user ID is recorded against
+// the tenant if it was found by device ID.  The tenants are reloaded if the
+// event doesn't match any, in case the web service has added a tenant.
+func (t *Tenants) ForEvent(userID string, deviceID string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tenant := t.find(userID, deviceID)
+	if tenant == nil {
+		if err := t.load(); err != nil {
+			logging.Logger(t.ctx).WithError(err).Error("reloading smartthings tenants")
+			return "", false
+		}
+
+		if tenant = t.find(userID, deviceID); tenant == nil {
+			return "", false
+		}
+	}
+
+	if userID != "" && !contains(tenant.UserIDs, userID) {
+		if err := t.recordUser(tenant.ID, userID); err != nil {
+			logging.Logger(t.ctx).WithError(err).Error("recording user for smartthings tenant")
+		}
+	}
+
+	return tenant.ID, true
+}
+
+// Re-read the tenants and add a user ID to a tenant, call with the lock held
+func (t *Tenants) recordUser(id string, userID string) error {
+	unlock, err := t.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	tenant, ok := t.tenants[id]
+	if !ok {
+		return errors.Errorf("tenant %s has been removed", id)
+	}
+	if contains(tenant.UserIDs, userID) {
+		return nil
+	}
+
+	logging.Logger(t.ctx).Infof("Recording user %s for tenant %s", userID, id)
+	tenant.UserIDs = append(tenant.UserIDs, userID)
+	return t.save()
+}
+
+// How often to reload the tenants from a store that can't be watched
+const tenantsPollInterval = time.Minute
+
+// Watch reloads the tenants whenever the other service changes them, until
+// the context is cancelled.  Stores that can't be watched are reloaded
+// periodically instead, so that removed tenants are noticed.
+func (t *Tenants) Watch(ctx context.Context) error {
+	reload := func() {
+		if err := t.Load(); err != nil {
+			logging.Logger(t.ctx).WithError(err).Error("reloading smartthings tenants")
+			return
+		}
+		logging.Logger(t.ctx).Debugf("Reloaded smartthings tenants from %s", t.store)
+	}
+
+	if ws, ok := t.store.(WatchingStore); ok {
+		return ws.Watch(ctx, reload)
+	}
+
+	logging.Logger(t.ctx).Infof("Smartthings oauth state %s cannot be watched for changes, reloading every %s", t.store, tenantsPollInterval)
+	go func() {
+		ticker := time.NewTicker(tenantsPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reload()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Get returns a copy of a tenant
+func (t *Tenants) Get(id string) (Tenant, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tenant, ok := t.tenants[id]
+	if !ok {
+		return Tenant{}, false
+	}
+
+	return *tenant, true
+}
+
+// Refresh the tokens of a tenant if the access token expires within the
+// margin, which is at least the minimum access token validity.  The tenants
+// are reloaded first, as the other service may have refreshed the tokens
+// already, which makes our refresh token invalid.
+//
+// No lock is held while Smartthings is asked for new tokens, so that a slow
+// token URL doesn't hold up the other tenants.  The new tokens are then saved
+// if the tenant still has the refresh token that was used, otherwise the
+// tokens saved in the meantime are kept.  The tenant is marked as needing to
+// be linked again if Smartthings rejects the refresh token.  Use a
+// TokenManager rather than calling this directly, so that only one refresh
+// runs at a time.
+func (t *Tenants) refreshTokens(id string, margin time.Duration) (State, error) {
+	if err := t.Load(); err != nil {
+		return State{}, errors.Wrapf(err, "reloading tenant %s", id)
+	}
+
+	tenant, ok := t.Get(id)
+	if !ok {
+		return State{}, errors.Errorf("no such tenant: %s", id)
+	}
+	if tenant.NeedsRelink {
+		return State{}, errors.Wrapf(ErrNeedsRelink, "tenant %s", id)
+	}
+	if tenant.State.validFor(margin) {
+		return tenant.State, nil
+	}
+
+	state := tenant.State
+	usedToken := state.refreshToken
+
+	refreshErr := state.refresh()
+	if refreshErr != nil && !errors.Is(refreshErr, ErrNeedsRelink) {
+		return State{}, errors.Wrapf(refreshErr, "refreshing access token for tenant %s", id)
+	}
+
+	var saved State
+	var needsRelink bool
+
+	err := t.update(func() error {
+		current, ok := t.tenants[id]
+		if !ok {
+			return errors.Errorf("tenant %s has been removed", id)
+		}
+
+		switch {
+		case current.State.refreshToken != usedToken:
+			logging.Logger(t.ctx).Infof("Tokens of tenant %s were replaced while refreshing them, keeping the saved tokens", id)
+		case refreshErr != nil:
+			current.NeedsRelink = true
+		default:
+			current.State.accessToken = state.accessToken
+			current.State.accessTokenExpiry = state.accessTokenExpiry
+			current.State.refreshToken = state.refreshToken
+		}
+
+		saved = current.State
+		needsRelink = current.NeedsRelink
+		return nil
+	})
+	if err != nil {
+		return State{}, errors.Wrapf(err, "saving access token for tenant %s", id)
+	}
+
+	if needsRelink {
+		logging.Logger(t.ctx).WithError(refreshErr).Errorf("tenant %s needs to be linked again", id)
+		return State{}, errors.Wrapf(ErrNeedsRelink, "refreshing access token for tenant %s", id)
+	}
+
+	return saved, nil
+}
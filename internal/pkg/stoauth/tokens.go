@@ -0,0 +1,204 @@
+package stoauth
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+/*
+ * TokenManager hands out the Smartthings access token of each tenant.
+ *
+ * Only one refresh runs at a time for a tenant; callers that need a token
+ * while it is being refreshed wait for that refresh and share its result,
+ * rather than starting another one that would invalidate the refresh token
+ * used by the first.
+ *
+ * Run renews the tokens in the background before they come within the
+ * minimum access token validity of expiring, with some random jitter so that
+ * the tenants, and the two services, don't all refresh at the same moment.
+ */
+
+// ErrNeedsRelink is returned for a tenant whose refresh token Smartthings
+// has rejected, until the installation is linked again
+var ErrNeedsRelink = errors.New("smartthings rejected the refresh token, the installation needs to be linked again")
+
+const (
+	defaultRenewalJitter        = time.Minute * 5
+	defaultRenewalCheckInterval = time.Second * 30
+)
+
+// A refresh in progress, shared by every caller that needs its result
+type refreshCall struct {
+	done  chan struct{}
+	state State
+	err   error
+}
+
+// When to renew the tokens of a tenant, for the current access token expiry
+type renewal struct {
+	expiry time.Time
+	at     time.Time
+}
+
+type TokenManager struct {
+	ctx      context.Context
+	tenants  *Tenants
+	jitter   time.Duration
+	interval time.Duration
+
+	mu       sync.Mutex
+	calls    map[string]*refreshCall
+	renewals map[string]renewal
+	rand     *rand.Rand
+}
+
+func NewTokenManager(tenants *Tenants) *TokenManager {
+	return &TokenManager{
+		ctx:      context.Background(),
+		tenants:  tenants,
+		jitter:   defaultRenewalJitter,
+		interval: defaultRenewalCheckInterval,
+		calls:    make(map[string]*refreshCall),
+		renewals: make(map[string]renewal),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// WithRenewalJitter sets the maximum random time by which background
+// renewals are brought forward
+func (m *TokenManager) WithRenewalJitter(d time.Duration) *TokenManager {
+	m.jitter = d
+	return m
+}
+
+// Refresh the tokens of a tenant, or wait for the refresh that is already
+// running
+func (m *TokenManager) refresh(id string, margin time.Duration) (State, error) {
+	m.mu.Lock()
+	if call, ok := m.calls[id]; ok {
+		m.mu.Unlock()
+		<-call.done
+		return call.state, call.err
+	}
+
+	call := &refreshCall{done: make(chan struct{})}
+	m.calls[id] = call
+	m.mu.Unlock()
+
+	call.state, call.err = m.tenants.refreshTokens(id, margin)
+
+	m.mu.Lock()
+	delete(m.calls, id)
+	m.mu.Unlock()
+	close(call.done)
+
+	return call.state, call.err
+}
+
+// AccessToken returns a valid Smartthings access token for a tenant,
+// refreshing it if needed, along with the tenant's state callback URL.
+// Returns ErrNeedsRelink if the tenant has to be linked again.
+func (m *TokenManager) AccessToken(id string) (token string, callbackURL string, err error) {
+	tenant, ok := m.tenants.Get(id)
+	if !ok {
+		return "", "", errors.Errorf("no such tenant: %s", id)
+	}
+	if tenant.NeedsRelink {
+		return "", "", errors.Wrapf(ErrNeedsRelink, "tenant %s", id)
+	}
+
+	state := tenant.State
+	if !state.hasValidAccessToken() {
+		if state, err = m.refresh(id, 0); err != nil {
+			return "", "", err
+		}
+	}
+
+	return state.accessToken, state.StateCallbackURL, nil
+}
+
+// NeedsRelink tells whether Smartthings has rejected the refresh token of a
+// tenant
+func (m *TokenManager) NeedsRelink(id string) bool {
+	tenant, ok := m.tenants.Get(id)
+	return ok && tenant.NeedsRelink
+}
+
+// Run renews the tokens of every tenant in the background until the context
+// is cancelled
+func (m *TokenManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.renewDue()
+
+		select {
+		case <-ctx.Done():
+			logging.Logger(m.ctx).Info("token-renewal: shutting down")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// When to renew a tenant's tokens, chosen once for each access token
+func (m *TokenManager) renewalTime(id string, state State) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.renewals[id]; ok && r.expiry.Equal(state.accessTokenExpiry) {
+		return r.at
+	}
+
+	var jitter time.Duration
+	if m.jitter > 0 {
+		jitter = time.Duration(m.rand.Int63n(int64(m.jitter)))
+	}
+
+	r := renewal{
+		expiry: state.accessTokenExpiry,
+		at:     state.accessTokenExpiry.Add(-state.MinAccessTokenValidity - jitter),
+	}
+	m.renewals[id] = r
+
+	return r.at
+}
+
+func (m *TokenManager) renewDue() {
+	tenants := m.tenants.List()
+
+	seen := make(map[string]bool)
+	for _, tenant := range tenants {
+		seen[tenant.ID] = true
+
+		if tenant.NeedsRelink || tenant.State.refreshToken == "" {
+			continue
+		}
+
+		if time.Now().Before(m.renewalTime(tenant.ID, tenant.State)) {
+			continue
+		}
+
+		// The margin covers the jitter, so that the tokens are renewed unless
+		// the other service has already done it
+		logging.Logger(m.ctx).Infof("Renewing smartthings access token for tenant %s", tenant.ID)
+		if _, err := m.refresh(tenant.ID, tenant.State.MinAccessTokenValidity+m.jitter); err != nil {
+			logging.Logger(m.ctx).WithError(err).Errorf("renewing smartthings access token for tenant %s", tenant.ID)
+		}
+	}
+
+	// Forget tenants that have been removed
+	m.mu.Lock()
+	for id := range m.renewals {
+		if !seen[id] {
+			delete(m.renewals, id)
+		}
+	}
+	m.mu.Unlock()
+}
@@ -0,0 +1,306 @@
+package stoauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Smartthings token URL that hands out numbered tokens
+type tokenServer struct {
+	mu            sync.Mutex
+	calls         int
+	refreshTokens []string
+
+	// Answer with this status instead of new tokens, if set
+	status int
+
+	// Called before the tokens are handed out, eg. to hold the refresh up or
+	// to change the tenants as the other service would
+	beforeRefresh func()
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CallbackAuthentication struct {
+			RefreshToken string `json:"refreshToken"`
+		} `json:"callbackAuthentication"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls++
+	n := s.calls
+	s.refreshTokens = append(s.refreshTokens, req.CallbackAuthentication.RefreshToken)
+	status := s.status
+	before := s.beforeRefresh
+	s.mu.Unlock()
+
+	if before != nil {
+		before()
+	}
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{
+		"headers": {"schema": "st-schema", "version": "1.0", "interactionType": "accessTokenResponse", "requestId": "r%d"},
+		"callbackAuthentication": {"tokenType": "Bearer", "accessToken": "access-%d", "refreshToken": "refresh-%d", "expiresIn": 3600}
+	}`, n, n, n)
+}
+
+func (s *tokenServer) received() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls, append([]string(nil), s.refreshTokens...)
+}
+
+func newTestTokenServer(t *testing.T) (*tokenServer, string) {
+	s := &tokenServer{}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return s, server.URL
+}
+
+func newTestTenants(store TokenStore) *Tenants {
+	return NewTenants(store).WithClientSecret("client-secret")
+}
+
+// Add a tenant whose access token expires after the given time
+func putTestTenant(t *testing.T, tenants *Tenants, id string, tokenURL string, expiresIn time.Duration) {
+	state := NewState()
+	state.ClientID = "client-id"
+	state.TokenURL = tokenURL
+	state.accessToken = "access-" + id
+	state.accessTokenExpiry = time.Now().Add(expiresIn)
+	state.refreshToken = "refresh-" + id
+
+	if err := tenants.Put(Tenant{ID: id, State: state}); err != nil {
+		t.Fatalf("adding tenant %s: %v", id, err)
+	}
+}
+
+func newTestFileStore(t *testing.T) *FileStore {
+	return NewFileStore(filepath.Join(t.TempDir(), "tenants.json"))
+}
+
+func TestTokenManagerValidToken(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	tenants := newTestTenants(newTestFileStore(t))
+	putTestTenant(t, tenants, "home", url, time.Hour)
+
+	token, _, err := NewTokenManager(tenants).AccessToken("home")
+	if err != nil {
+		t.Fatalf("fetching access token: %v", err)
+	}
+	if calls, _ := server.received(); token != "access-home" || calls != 0 {
+		t.Errorf("got token %s after %d refreshes, want the saved token", token, calls)
+	}
+}
+
+func TestTokenManagerSharesRefresh(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	tenants := newTestTenants(newTestFileStore(t))
+	putTestTenant(t, tenants, "home", url, 0)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server.beforeRefresh = func() {
+		close(started)
+		<-release
+	}
+
+	m := NewTokenManager(tenants)
+
+	const callers = 10
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _, errs[i] = m.AccessToken("home")
+		}(i)
+	}
+
+	// Let the other callers find the refresh running
+	<-started
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "access-1" {
+			t.Errorf("caller %d got %q, %v, want the refreshed token", i, tokens[i], errs[i])
+		}
+	}
+
+	if calls, _ := server.received(); calls != 1 {
+		t.Errorf("%d refreshes, want 1", calls)
+	}
+
+	// The new tokens are saved for the other service
+	saved := newTestTenants(tenants.store)
+	if err := saved.Load(); err != nil {
+		t.Fatalf("loading tenants: %v", err)
+	}
+	if tenant, _ := saved.Get("home"); tenant.State.accessToken != "access-1" || tenant.State.refreshToken != "refresh-1" {
+		t.Errorf("saved %s, want the refreshed tokens", tenant.State)
+	}
+}
+
+func TestTokenManagerNeedsRelink(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	server.status = http.StatusUnauthorized
+
+	tenants := newTestTenants(newTestFileStore(t))
+	putTestTenant(t, tenants, "home", url, 0)
+	m := NewTokenManager(tenants)
+
+	if _, _, err := m.AccessToken("home"); !errors.Is(err, ErrNeedsRelink) {
+		t.Fatalf("got %v, want ErrNeedsRelink", err)
+	}
+	if !m.NeedsRelink("home") {
+		t.Error("tenant isn't marked as needing to be linked again")
+	}
+
+	saved := newTestTenants(tenants.store)
+	if err := saved.Load(); err != nil {
+		t.Fatalf("loading tenants: %v", err)
+	}
+	if tenant, _ := saved.Get("home"); !tenant.NeedsRelink {
+		t.Error("saved tenant isn't marked as needing to be linked again")
+	}
+
+	// The rejected refresh token isn't sent again
+	if _, _, err := m.AccessToken("home"); !errors.Is(err, ErrNeedsRelink) {
+		t.Errorf("got %v, want ErrNeedsRelink", err)
+	}
+	if calls, _ := server.received(); calls != 1 {
+		t.Errorf("%d refreshes, want 1", calls)
+	}
+
+	// Linking again makes the tenant usable
+	server.mu.Lock()
+	server.status = 0
+	server.mu.Unlock()
+	putTestTenant(t, tenants, "home", url, 0)
+
+	if _, _, err := m.AccessToken("home"); err != nil {
+		t.Errorf("fetching access token after linking again: %v", err)
+	}
+}
+
+func TestTokenManagerKeepsTokensReplacedDuringRefresh(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	store := newTestFileStore(t)
+	tenants := newTestTenants(store)
+	putTestTenant(t, tenants, "home", url, 0)
+
+	// The installation is linked again while the refresh is running
+	other := newTestTenants(store)
+	server.beforeRefresh = func() {
+		err := other.update(func() error {
+			state := &other.tenants["home"].State
+			state.accessToken = "access-relinked"
+			state.accessTokenExpiry = time.Now().Add(time.Hour)
+			state.refreshToken = "refresh-relinked"
+			return nil
+		})
+		if err != nil {
+			t.Errorf("linking again: %v", err)
+		}
+	}
+
+	token, _, err := NewTokenManager(tenants).AccessToken("home")
+	if err != nil {
+		t.Fatalf("fetching access token: %v", err)
+	}
+	if token != "access-relinked" {
+		t.Errorf("got token %s, want the token saved by the other service", token)
+	}
+
+	if tenant, _ := tenants.Get("home"); tenant.State.refreshToken != "refresh-relinked" {
+		t.Errorf("saved refresh token %s, want the one saved by the other service", tenant.State.refreshToken)
+	}
+}
+
+func TestTokenManagerRenewalTime(t *testing.T) {
+	tenants := newTestTenants(newTestFileStore(t))
+	state := NewState()
+	state.accessTokenExpiry = time.Now().Add(time.Hour)
+
+	m := NewTokenManager(tenants).WithRenewalJitter(0)
+	if at := m.renewalTime("home", state); !at.Equal(state.accessTokenExpiry.Add(-state.MinAccessTokenValidity)) {
+		t.Errorf("renewal at %s without jitter, want the minimum validity before expiry %s", at, state.accessTokenExpiry)
+	}
+
+	jitter := time.Minute * 5
+	m = NewTokenManager(tenants).WithRenewalJitter(jitter)
+
+	at := m.renewalTime("home", state)
+	latest := state.accessTokenExpiry.Add(-state.MinAccessTokenValidity)
+	if at.After(latest) || at.Before(latest.Add(-jitter)) {
+		t.Errorf("renewal at %s, want within %s before %s", at, jitter, latest)
+	}
+
+	// Chosen once for each access token
+	for i := 0; i < 10; i++ {
+		if again := m.renewalTime("home", state); !again.Equal(at) {
+			t.Fatalf("renewal moved from %s to %s", at, again)
+		}
+	}
+
+	state.accessTokenExpiry = state.accessTokenExpiry.Add(time.Hour)
+	if again := m.renewalTime("home", state); !again.After(at.Add(time.Minute * 50)) {
+		t.Errorf("renewal at %s for a new access token, want about an hour after %s", again, at)
+	}
+}
+
+func TestTokenManagerRenewDue(t *testing.T) {
+	server, url := newTestTokenServer(t)
+	tenants := newTestTenants(newTestFileStore(t))
+
+	putTestTenant(t, tenants, "fresh", url, time.Hour)
+	putTestTenant(t, tenants, "due", url, time.Second*30)
+	putTestTenant(t, tenants, "relink", url, 0)
+	if err := tenants.update(func() error {
+		tenants.tenants["relink"].NeedsRelink = true
+		return nil
+	}); err != nil {
+		t.Fatalf("marking tenant: %v", err)
+	}
+
+	m := NewTokenManager(tenants).WithRenewalJitter(0)
+	m.renewDue()
+
+	if _, refreshed := server.received(); len(refreshed) != 1 || refreshed[0] != "refresh-due" {
+		t.Fatalf("refreshed %v, want only the tenant that is due", refreshed)
+	}
+	if tenant, _ := tenants.Get("due"); tenant.State.accessToken != "access-1" {
+		t.Errorf("due tenant has %s, want the renewed token", tenant.State)
+	}
+
+	// Nothing is due until the renewed token nears its expiry
+	m.renewDue()
+	if calls, _ := server.received(); calls != 1 {
+		t.Errorf("%d refreshes after renewing, want 1", calls)
+	}
+}
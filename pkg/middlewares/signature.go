@@ -0,0 +1,424 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jake-scott/smartthings-nest/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+/*
+ * SignatureMw verifies the HTTP Signature that Smartthings adds to webhook
+ * requests, eg.
+ *
+ *    Authorization: Signature keyId="/pl/useast2/1a-2b-3c",signature="...",headers="(request-target) digest date",algorithm="rsa-sha256"
+ *
+ * The signature must cover the request target, the Date header and the
+ * Digest header, so that the body is signed as well.  Requests dated outside
+ * of the allowed clock skew are rejected, as are signatures that have already
+ * been seen within that window.
+ */
+
+const (
+	DefaultSignatureClockSkew = time.Minute * 5
+
+	// Same limit as the JSON request decoder
+	maxSignedBodySize = 100 * 1024
+)
+
+// Headers that every signature must cover
+var requiredSignedHeaders = []string{"(request-target)", "date", "digest"}
+
+// A KeySource returns the public keys that may have made a signature with
+// the given key ID
+type KeySource interface {
+	PublicKeys(keyID string) ([]crypto.PublicKey, error)
+}
+
+// Parse PEM encoded public keys and certificates
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing public key")
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing public key")
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing certificate")
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded public keys or certificates found")
+	}
+
+	return keys, nil
+}
+
+// FileKeySource trusts the public keys and certificates in a PEM file for
+// any key ID
+type FileKeySource struct {
+	keys []crypto.PublicKey
+}
+
+func NewFileKeySource(fileName string) (*FileKeySource, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signature keys from %s", fileName)
+	}
+
+	keys, err := parsePublicKeys(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signature keys from %s", fileName)
+	}
+
+	return &FileKeySource{keys: keys}, nil
+}
+
+func (s *FileKeySource) PublicKeys(keyID string) ([]crypto.PublicKey, error) {
+	return s.keys, nil
+}
+
+type cachedKeys struct {
+	keys    []crypto.PublicKey
+	fetched time.Time
+}
+
+// URLKeySource fetches the certificate for a key ID from a base URL, eg.
+// https://key.smartthings.com/pl/useast2/1a-2b-3c, and caches it
+type URLKeySource struct {
+	baseURL  *url.URL
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedKeys
+}
+
+func NewURLKeySource(baseURL string, cacheTTL time.Duration) (*URLKeySource, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing signature key URL %s", baseURL)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("signature key URL %s must be http or https", baseURL)
+	}
+
+	return &URLKeySource{
+		baseURL:  u,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: time.Second * 10},
+		cache:    make(map[string]cachedKeys),
+	}, nil
+}
+
+func (s *URLKeySource) PublicKeys(keyID string) ([]crypto.PublicKey, error) {
+	// The key ID is a path on the key server, don't let it go elsewhere
+	if !strings.HasPrefix(keyID, "/") || strings.Contains(keyID, "..") || strings.ContainsAny(keyID, "?#") {
+		return nil, errors.Errorf("invalid key ID %s", keyID)
+	}
+
+	s.mu.Lock()
+	cached, ok := s.cache[keyID]
+	s.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < s.cacheTTL {
+		return cached.keys, nil
+	}
+
+	keyURL := *s.baseURL
+	keyURL.Path = strings.TrimSuffix(keyURL.Path, "/") + keyID
+
+	resp, err := s.client.Get(keyURL.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching signature key %s", keyURL.String())
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching signature key %s", keyURL.String())
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Errorf("non-200 code fetching signature key %s: %d (%s)", keyURL.String(), resp.StatusCode, resp.Status)
+	}
+
+	keys, err := parsePublicKeys(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signature key %s", keyURL.String())
+	}
+
+	s.mu.Lock()
+	s.cache[keyID] = cachedKeys{keys: keys, fetched: time.Now()}
+	s.mu.Unlock()
+
+	return keys, nil
+}
+
+// Signatures seen recently, to reject replayed requests
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// Record a signature, returning false if it has been seen before it expires
+func (c *replayCache) add(signature string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for sig, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, sig)
+		}
+	}
+
+	if _, ok := c.seen[signature]; ok {
+		return false
+	}
+
+	c.seen[signature] = expires
+	return true
+}
+
+type SignatureMw struct {
+	keys      KeySource
+	clockSkew time.Duration
+	replays   *replayCache
+	next      http.Handler
+}
+
+func NewSignatureMw(keys KeySource, clockSkew time.Duration) mux.MiddlewareFunc {
+	// Shared by every request
+	replays := &replayCache{seen: make(map[string]time.Time)}
+
+	return func(next http.Handler) http.Handler {
+		return &SignatureMw{
+			keys:      keys,
+			clockSkew: clockSkew,
+			replays:   replays,
+			next:      next,
+		}
+	}
+}
+
+type signatureParams struct {
+	keyID     string
+	algorithm string
+	headers   []string
+	signature []byte
+}
+
+// Parse the parameters of an `Authorization: Signature ...` header
+func parseSignatureHeader(header string) (signatureParams, error) {
+	var p signatureParams
+
+	if !strings.HasPrefix(header, "Signature ") {
+		return p, errors.New("not a Signature authorization header")
+	}
+
+	for _, param := range strings.Split(strings.TrimPrefix(header, "Signature "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return p, errors.Errorf("bad signature parameter: %s", param)
+		}
+		value := strings.Trim(kv[1], `"`)
+
+		switch kv[0] {
+		case "keyId":
+			p.keyID = value
+		case "algorithm":
+			p.algorithm = value
+		case "headers":
+			p.headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			sig, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return p, errors.Wrap(err, "decoding signature")
+			}
+			p.signature = sig
+		}
+	}
+
+	if p.keyID == "" || len(p.signature) == 0 {
+		return p, errors.New("signature header needs keyId and signature")
+	}
+
+	// Only the Date header is signed by default
+	if len(p.headers) == 0 {
+		p.headers = []string{"date"}
+	}
+
+	return p, nil
+}
+
+// Build the string that was signed, from the signed headers
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("%s: %s %s", h, strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			lines = append(lines, h+": "+r.Host)
+		default:
+			values, ok := r.Header[http.CanonicalHeaderKey(h)]
+			if !ok {
+				return "", errors.Errorf("signed header %s is missing", h)
+			}
+			lines = append(lines, h+": "+strings.Join(values, ", "))
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func verifySignature(key crypto.PublicKey, algorithm string, digest []byte, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" && algorithm != "hs2019" && algorithm != "" {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if algorithm != "ecdsa-sha256" && algorithm != "hs2019" && algorithm != "" {
+			return false
+		}
+		return ecdsa.VerifyASN1(k, digest, signature)
+	}
+
+	return false
+}
+
+// Check the Digest header against the body
+func verifyDigest(header string, body []byte) error {
+	for _, d := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "SHA-256") {
+			continue
+		}
+
+		want, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return errors.Wrap(err, "decoding digest")
+		}
+
+		sum := sha256.Sum256(body)
+		if subtle.ConstantTimeCompare(want, sum[:]) != 1 {
+			return errors.New("body does not match digest")
+		}
+		return nil
+	}
+
+	return errors.New("no SHA-256 digest")
+}
+
+func (mw *SignatureMw) verify(r *http.Request, body []byte) error {
+	p, err := parseSignatureHeader(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+
+	for _, required := range requiredSignedHeaders {
+		found := false
+		for _, h := range p.headers {
+			if h == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("signature does not cover %s", required)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return errors.Wrap(err, "parsing Date header")
+	}
+	if skew := time.Since(date); skew > mw.clockSkew || skew < -mw.clockSkew {
+		return errors.Errorf("request date %s is outside the allowed clock skew", date)
+	}
+
+	if err := verifyDigest(r.Header.Get("Digest"), body); err != nil {
+		return err
+	}
+
+	s, err := signingString(r, p.headers)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(s))
+
+	keys, err := mw.keys.PublicKeys(p.keyID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if verifySignature(key, p.algorithm, digest[:], p.signature) {
+			if !mw.replays.add(string(p.signature), date.Add(mw.clockSkew)) {
+				return errors.New("signature has already been used")
+			}
+			return nil
+		}
+	}
+
+	return errors.Errorf("signature does not match key %s", p.keyID)
+}
+
+func (mw *SignatureMw) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxSignedBodySize))
+	if err != nil {
+		logging.Logger(r.Context()).WithError(err).Error("reading request body")
+		http.Error(rw, "unable to read request", http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := mw.verify(r, body); err != nil {
+		logging.Logger(r.Context()).WithError(err).Warn("rejecting request with invalid signature")
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	mw.next.ServeHTTP(rw, r)
+}
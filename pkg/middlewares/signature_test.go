@@ -0,0 +1,226 @@
+package middlewares
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const testKeyID = "/pl/test/key1"
+
+// Trusts one key for one key ID
+type testKeySource struct {
+	keyID string
+	key   crypto.PublicKey
+}
+
+func (s testKeySource) PublicKeys(keyID string) ([]crypto.PublicKey, error) {
+	if keyID != s.keyID {
+		return nil, errors.Errorf("unknown key ID %s", keyID)
+	}
+
+	return []crypto.PublicKey{s.key}, nil
+}
+
+type testSigner struct {
+	name      string
+	algorithm string
+	key       crypto.Signer
+}
+
+func newTestSigners(t *testing.T) []testSigner {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ECDSA key: %v", err)
+	}
+
+	return []testSigner{
+		{name: "rsa", algorithm: "rsa-sha256", key: rsaKey},
+		{name: "ecdsa", algorithm: "ecdsa-sha256", key: ecdsaKey},
+	}
+}
+
+type signedRequest struct {
+	keyID   string
+	headers []string
+	date    time.Time
+
+	// Sent instead of the body that was signed
+	tamperedBody string
+}
+
+const testBody = `{"headers": {"interactionType": "discoveryRequest"}}`
+
+// Build a request signed the way Smartthings signs them
+func (s testSigner) request(t *testing.T, sr signedRequest) *http.Request {
+	if sr.keyID == "" {
+		sr.keyID = testKeyID
+	}
+	if sr.headers == nil {
+		sr.headers = []string{"(request-target)", "digest", "date"}
+	}
+	if sr.date.IsZero() {
+		sr.date = time.Now()
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/nest", strings.NewReader(testBody))
+	r.Header.Set("Date", sr.date.UTC().Format(http.TimeFormat))
+
+	sum := sha256.Sum256([]byte(testBody))
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+
+	signed, err := signingString(r, sr.headers)
+	if err != nil {
+		t.Fatalf("building signing string: %v", err)
+	}
+	digest := sha256.Sum256([]byte(signed))
+
+	sig, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("signing request: %v", err)
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf(`Signature keyId="%s",signature="%s",headers="%s",algorithm="%s"`,
+		sr.keyID, base64.StdEncoding.EncodeToString(sig), strings.Join(sr.headers, " "), s.algorithm))
+
+	if sr.tamperedBody != "" {
+		r.Body = ioutil.NopCloser(strings.NewReader(sr.tamperedBody))
+	}
+
+	return r
+}
+
+// Returns the handler and a function that tells what body the next handler
+// received, if it was called
+func newTestSignatureMw(s testSigner) (http.Handler, func() (string, bool)) {
+	var body string
+	var called bool
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		called = true
+	})
+
+	mw := NewSignatureMw(testKeySource{keyID: testKeyID, key: s.key.Public()}, DefaultSignatureClockSkew)
+	return mw(next), func() (string, bool) { return body, called }
+}
+
+func serve(h http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestSignatureValid(t *testing.T) {
+	for _, s := range newTestSigners(t) {
+		t.Run(s.name, func(t *testing.T) {
+			h, received := newTestSignatureMw(s)
+
+			if code := serve(h, s.request(t, signedRequest{})); code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", code)
+			}
+
+			body, called := received()
+			if !called {
+				t.Fatal("next handler wasn't called")
+			}
+			if body != testBody {
+				t.Errorf("next handler read %q, want the request body", body)
+			}
+		})
+	}
+}
+
+func TestSignatureRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		req  signedRequest
+	}{
+		{
+			name: "body does not match digest",
+			req:  signedRequest{tamperedBody: `{"headers": {"interactionType": "commandRequest"}}`},
+		},
+		{
+			name: "request target not signed",
+			req:  signedRequest{headers: []string{"digest", "date"}},
+		},
+		{
+			name: "digest not signed",
+			req:  signedRequest{headers: []string{"(request-target)", "date"}},
+		},
+		{
+			name: "date too old",
+			req:  signedRequest{date: time.Now().Add(-DefaultSignatureClockSkew - time.Minute)},
+		},
+		{
+			name: "date in the future",
+			req:  signedRequest{date: time.Now().Add(DefaultSignatureClockSkew + time.Minute)},
+		},
+		{
+			name: "unknown key ID",
+			req:  signedRequest{keyID: "/pl/test/other"},
+		},
+	}
+
+	for _, s := range newTestSigners(t) {
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				h, received := newTestSignatureMw(s)
+
+				if code := serve(h, s.request(t, tt.req)); code != http.StatusUnauthorized {
+					t.Errorf("got status %d, want 401", code)
+				}
+				if _, called := received(); called {
+					t.Error("next handler was called")
+				}
+			})
+		}
+	}
+}
+
+func TestSignatureReplayed(t *testing.T) {
+	for _, s := range newTestSigners(t) {
+		t.Run(s.name, func(t *testing.T) {
+			h, _ := newTestSignatureMw(s)
+			r := s.request(t, signedRequest{})
+			replayed := r.Clone(r.Context())
+			replayed.Body = ioutil.NopCloser(strings.NewReader(testBody))
+
+			if code := serve(h, r); code != http.StatusOK {
+				t.Fatalf("first request: got status %d, want 200", code)
+			}
+			if code := serve(h, replayed); code != http.StatusUnauthorized {
+				t.Errorf("replayed request: got status %d, want 401", code)
+			}
+		})
+	}
+}
+
+func TestSignatureWrongKey(t *testing.T) {
+	signers := newTestSigners(t)
+
+	// Signed with the ECDSA key, verified with the RSA key
+	h, _ := newTestSignatureMw(signers[0])
+	if code := serve(h, signers[1].request(t, signedRequest{})); code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want 401", code)
+	}
+}